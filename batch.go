@@ -0,0 +1,168 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// WriteBatch is a batch of records appended to the WAL at once by Commit.
+// Unlike PendingWrites and WriteAll, every batch has its own records,
+// so several goroutines can build their batches concurrently.
+// A WriteBatch itself must not be used by several goroutines at once.
+type WriteBatch struct {
+	wal     *WAL
+	records [][]byte
+	size    int64
+}
+
+// NewWriteBatch returns a new empty batch of the WAL.
+func (wal *WAL) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{wal: wal}
+}
+
+// Append adds the record to the batch, it is written by Commit.
+func (b *WriteBatch) Append(data []byte) {
+	b.records = append(b.records, data)
+	b.size += b.wal.options.maxDataWriteSize(int64(len(data)) + b.wal.options.recordOverhead())
+}
+
+// Len returns the number of records in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Size returns the maximum size the records of the batch take in a segment file.
+func (b *WriteBatch) Size() int64 {
+	return b.size
+}
+
+// Reset removes all the records of the batch.
+func (b *WriteBatch) Reset() {
+	b.records = b.records[:0]
+	b.size = 0
+}
+
+// Commit writes all the records of the batch into the active segment file at once,
+// rotating it first if they don't fit, and returns their positions in order.
+// The batch is reset on success. On error nothing is appended and the batch is left intact,
+// ErrPendingSizeTooLarge is returned if the records can't fit in a single segment file.
+// With AllowBatchSpanSegments they are written across segment files instead, and the records
+// written before an error are kept, their positions are returned with it.
+// The records are synced like WriteAll by DiskFlushSync, BytesPerSync and MaxSyncDelay,
+// if the sync fails they are written already, the batch is reset and their positions are returned with the error.
+func (b *WriteBatch) Commit() ([]*ChunkPosition, error) {
+	if len(b.records) == 0 {
+		return make([]*ChunkPosition, 0), nil
+	}
+
+	b.wal.mu.Lock()
+	defer b.wal.mu.Unlock()
+
+	positions, _, err := b.wal.writeBatch(context.Background(), b.records, b.size)
+	if err != nil {
+		return positions, err
+	}
+	b.Reset()
+	if err := b.wal.syncIfNeeded(); err != nil {
+		return positions, err
+	}
+	return positions, nil
+}
+
+// ReadBatchError is returned by ReadBatch, it tells which position of the batch failed.
+type ReadBatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *ReadBatchError) Error() string {
+	return fmt.Sprintf("read the position %d of the batch failed: %v", e.Index, e.Err)
+}
+
+func (e *ReadBatchError) Unwrap() error {
+	return e.Err
+}
+
+// ReadBatch reads the records at the positions, and returns them in the order of the positions.
+// The WAL is locked once, and the positions are read in their order in the segment files,
+// so that the records in the same block are read from the block cache.
+// A *ReadBatchError is returned for the first position which fails in that order.
+func (wal *WAL) ReadBatch(positions []*ChunkPosition) ([][]byte, error) {
+	order := make([]int, len(positions))
+	for i, pos := range positions {
+		if pos == nil {
+			return nil, &ReadBatchError{Index: i, Err: errors.New("read position is nil")}
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return positions[order[a]].Compare(positions[order[b]]) < 0
+	})
+
+	results := make([][]byte, len(positions))
+	if err := wal.readBatch(positions, order, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// readBatch reads the positions of the given indexes, sorted by position, into results.
+func (wal *WAL) readBatch(positions []*ChunkPosition, order []int, results [][]byte) error {
+	// the sorted indexes of every shard stay sorted, they are the indexes of the caller's positions,
+	// so the errors of the shards carry them. The first failing position of all the shards is returned.
+	if wal.shards != nil {
+		shardOrders := make(map[*WAL][]int)
+		for _, i := range order {
+			shard := wal.shardOf(positions[i].SegmentId)
+			shardOrders[shard] = append(shardOrders[shard], i)
+		}
+		var first *ReadBatchError
+		for _, shard := range wal.shards {
+			var batchErr *ReadBatchError
+			err := shard.readBatch(positions, shardOrders[shard], results)
+			if err == nil {
+				continue
+			}
+			if !errors.As(err, &batchErr) {
+				return err
+			}
+			if first == nil || positions[batchErr.Index].Compare(positions[first.Index]) < 0 {
+				first = batchErr
+			}
+		}
+		if first != nil {
+			return first
+		}
+		return nil
+	}
+
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	var segment *segment
+	defer func() {
+		if segment != nil {
+			_ = segment.release()
+		}
+	}()
+	for _, i := range order {
+		pos := positions[i]
+		if segment == nil || segment.id != pos.SegmentId {
+			if segment != nil {
+				_ = segment.release()
+			}
+			var err error
+			if segment, err = wal.acquireSegment("read", pos.SegmentId); err != nil {
+				return &ReadBatchError{Index: i, Err: err}
+			}
+		}
+		data, err := segment.Read(pos.BlockNumber, pos.ChunkOffset)
+		if err != nil {
+			return &ReadBatchError{Index: i, Err: segmentError("read", pos.SegmentId, err)}
+		}
+		results[i] = data
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package wal
+
+import (
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// blockCache is the LRU cache of blocks shared by all segments of a WAL.
+// It counts the hits and misses of block lookups, see Stats.
+type blockCache struct {
+	*lru.Cache[uint64, []byte]
+	size   int // the maximum number of blocks.
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newBlockCache(size int) (*blockCache, error) {
+	cache, err := lru.New[uint64, []byte](size)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCache{Cache: cache, size: size}, nil
+}
+
+// Get looks up the block of the given key and records whether it was a hit.
+func (c *blockCache) Get(key uint64) ([]byte, bool) {
+	block, ok := c.Cache.Get(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return block, ok
+}
+
+// WarmCache reads the blocks of the segment file into the block cache in order,
+// so that the following reads of the segment hit the cache. If the segment file
+// is larger than BlockCache, only its last blocks are read, and the older blocks
+// of the other segments may be evicted. The last block is only cached once it is full,
+// like by reads. It does nothing if BlockCache is disabled, and for the segments
+// read through MMapReads or VerifyOnRead, which bypass the cache, or the active
+// segment with NoActiveSegmentCache.
+func (wal *WAL) WarmCache(segId SegSerialID) error {
+	if wal.shards != nil {
+		return wal.shardOf(segId).WarmCache(segId)
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	segment, err := wal.acquireSegment("warm", segId)
+	if err != nil {
+		return err
+	}
+	defer segment.release()
+	return segmentError("warm", segId, segment.warmCache())
+}
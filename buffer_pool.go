@@ -0,0 +1,58 @@
+package wal
+
+import "github.com/valyala/bytebufferpool"
+
+// BufferPool provides the scratch buffers used to frame the chunks of a write
+// and to read the blocks of a segment file, like a sync.Pool of byte slices.
+// A buffer of any capacity may be returned by Get, it is given back by Put
+// once unused, and the records returned to the caller are never pooled memory.
+// A nil BufferPool in Options means the WAL uses its own pools.
+type BufferPool interface {
+	Get() []byte
+	Put(buf []byte)
+}
+
+// getChunkBuffer returns an empty buffer to frame the chunks of a write into.
+func (seg *segment) getChunkBuffer() *bytebufferpool.ByteBuffer {
+	if seg.bufferPool != nil {
+		return &bytebufferpool.ByteBuffer{B: seg.bufferPool.Get()[:0]}
+	}
+	buf := bytebufferpool.Get()
+	buf.Reset()
+	return buf
+}
+
+// putChunkBuffer gives back the buffer returned by getChunkBuffer.
+func (seg *segment) putChunkBuffer(buf *bytebufferpool.ByteBuffer) {
+	// the chunks of a write failing before they are written are dropped with the buffer.
+	seg.unsummed = seg.unsummed[:0]
+	if seg.bufferPool != nil {
+		seg.bufferPool.Put(buf.B)
+		return
+	}
+	bytebufferpool.Put(buf)
+}
+
+// getBlock returns the buffers to read a block and a chunk header into.
+// The blocks read by direct I/O must be aligned, so they never come from the BufferPool.
+func (seg *segment) getBlock() *blockAndHeader {
+	blockSize := int(seg.blockSize)
+	bh := seg.blockPool.Get().(*blockAndHeader)
+	if seg.bufferPool != nil && !seg.directIO {
+		block := seg.bufferPool.Get()
+		if cap(block) < blockSize {
+			block = make([]byte, blockSize)
+		}
+		bh.block = block[:blockSize]
+	}
+	return bh
+}
+
+// putBlock gives back the buffers returned by getBlock.
+func (seg *segment) putBlock(bh *blockAndHeader) {
+	if seg.bufferPool != nil && !seg.directIO {
+		seg.bufferPool.Put(bh.block)
+		bh.block = nil
+	}
+	seg.blockPool.Put(bh)
+}
@@ -0,0 +1,29 @@
+package wal
+
+import (
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// ChecksumType is the algorithm of the checksum stored in every chunk header.
+type ChecksumType uint8
+
+const (
+	// ChecksumCRC32 is the CRC-32 (IEEE) checksum, the default one.
+	ChecksumCRC32 ChecksumType = iota
+	// ChecksumXXHash is the low 32 bits of the 64-bit xxHash, faster on large chunks.
+	ChecksumXXHash
+)
+
+func (t ChecksumType) valid() bool {
+	return t == ChecksumCRC32 || t == ChecksumXXHash
+}
+
+// sum computes the checksum of the chunk bytes following the checksum field.
+func (t ChecksumType) sum(b []byte) uint32 {
+	if t == ChecksumXXHash {
+		return uint32(xxhash.Sum64(b))
+	}
+	return crc32.ChecksumIEEE(b)
+}
@@ -0,0 +1,53 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// sumChunks fills in the checksums of the chunks starting at the offsets of buf,
+// framed by appendChunkBuffer with PipelineChecksums.
+func (seg *segment) sumChunks(buf []byte, starts []int) {
+	for _, start := range starts {
+		end := start + chunkHeaderSize + int(binary.LittleEndian.Uint16(buf[start+4:start+6]))
+		binary.LittleEndian.PutUint32(buf[start:start+4], seg.checksumType.sum(buf[start+4:end]))
+	}
+}
+
+// writePipelined writes the chunks of buf to the segment file in parts of at least a block,
+// while a goroutine computes the checksums of the chunks of the next parts. A chunk is only
+// written once its checksum is filled in. The file is truncated back to the size of the segment
+// before the write, fromBlock and fromSize, if a part fails to be written.
+func (seg *segment) writePipelined(buf []byte, starts []int, fromBlock, fromSize uint32) error {
+	// the end of every chunk summed, the padding after it is written with it.
+	summed := make(chan int, len(starts))
+	go func() {
+		defer close(summed)
+		for i := range starts {
+			seg.sumChunks(buf, starts[i:i+1])
+			if i+1 < len(starts) {
+				summed <- starts[i+1]
+			} else {
+				summed <- len(buf)
+			}
+		}
+	}()
+
+	var written int
+	var err error
+	// the channel is drained even after a failure, the buffer is reused once the goroutine is done.
+	for end := range summed {
+		if err != nil || (end-written < int(seg.blockSize) && end < len(buf)) {
+			continue
+		}
+		_, err = seg.fd.Write(buf[written:end])
+		written = end
+	}
+	if err != nil {
+		// the next writes are appended right after the segment.
+		if e := seg.fd.Truncate(int64(fromBlock)*seg.blockSize + int64(fromSize)); e != nil {
+			return errors.Join(err, e)
+		}
+	}
+	return err
+}
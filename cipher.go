@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// cipherNonceSize is the size of the nonce passed to the Cipher,
+// it is stored before the sealed payload of every encrypted record.
+const cipherNonceSize = 12
+
+// Cipher encrypts the payload of every record before it is framed into chunks,
+// and reverses it when the record is read back.
+// A nil Cipher in Options means records are stored unencrypted.
+//
+// Every record is sealed with a new random nonce of 12 bytes, rather than one derived
+// from its position, because positions are written again after TruncateTail or Delete.
+type Cipher interface {
+	Seal(plaintext, nonce []byte) []byte
+	Open(ciphertext, nonce []byte) ([]byte, error)
+	// Overhead returns the difference between the lengths of a ciphertext and its plaintext.
+	Overhead() int
+}
+
+// AESGCMCipher is the built-in Cipher based on AES-GCM.
+type AESGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCipher returns an AES-GCM Cipher, the key must be 16, 24 or 32 bytes
+// to select AES-128, AES-192 or AES-256.
+func NewAESGCMCipher(key []byte) (*AESGCMCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMCipher{aead: aead}, nil
+}
+
+func (c *AESGCMCipher) Seal(plaintext, nonce []byte) []byte {
+	return c.aead.Seal(nil, nonce, plaintext, nil)
+}
+
+func (c *AESGCMCipher) Open(ciphertext, nonce []byte) ([]byte, error) {
+	return c.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func (c *AESGCMCipher) Overhead() int {
+	return c.aead.Overhead()
+}
+
+// sealRecord encrypts the record payload, the result is the nonce followed by the ciphertext.
+func sealRecord(c Cipher, data []byte) ([]byte, error) {
+	nonce := make([]byte, cipherNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return append(nonce, c.Seal(data, nonce)...), nil
+}
+
+// openRecord decrypts the record payload sealed by sealRecord.
+func openRecord(c Cipher, data []byte) ([]byte, error) {
+	if len(data) < cipherNonceSize {
+		return nil, ErrDecryptFailed
+	}
+	plaintext, err := c.Open(data[cipherNonceSize:], data[:cipherNonceSize])
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
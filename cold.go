@@ -0,0 +1,265 @@
+package wal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// coldMagic starts the segment files compressed by CompressColdSegments.
+// A cold segment file is the magic, the size of the segment file and its block size,
+// then the offset of every compressed block and the end of the last one, and the blocks,
+// every one compressed by gzip on its own, so that a read only decompresses the blocks it needs.
+var coldMagic = []byte("KWALGZ01")
+
+// ErrColdSegment is returned by the writes to a segment file compressed by CompressColdSegments.
+var ErrColdSegment = errors.New("the segment file is compressed, it can only be read")
+
+const coldHeaderSize = 20
+
+// the default ColdSegmentAge.
+const defaultColdSegmentAge = time.Hour
+
+// coldFileExt returns the extension of the cold segment files being written,
+// before they replace the segment files.
+func coldFileExt(extName string) string {
+	return ".cold" + extName
+}
+
+// coldFile is a cold segment file, read as the segment file it was compressed from.
+type coldFile struct {
+	File
+	size      int64   // the size of the segment file.
+	blockSize int64   // the size of the compressed blocks, the last one may be smaller.
+	offsets   []int64 // the offset of every compressed block, and the end of the last one.
+}
+
+// openColdFile returns the cold segment file read through fd, or fd itself if it is not one.
+func openColdFile(fd File) (File, error) {
+	// the header is read like the segment header, which works with direct I/O.
+	header := alignedBuffer(directIOAlignment)
+	n, err := fd.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < coldHeaderSize || !bytes.Equal(header[:len(coldMagic)], coldMagic) {
+		return fd, nil
+	}
+	f := &coldFile{
+		File:      fd,
+		size:      int64(binary.BigEndian.Uint64(header[8:16])),
+		blockSize: int64(binary.BigEndian.Uint32(header[16:20])),
+	}
+	if f.blockSize == 0 || f.size < 0 {
+		return nil, fmt.Errorf("the header of the cold segment file %s is corrupted", fd.Name())
+	}
+	index := make([]byte, 8*((f.size+f.blockSize-1)/f.blockSize+1))
+	if _, err := fd.ReadAt(index, coldHeaderSize); err != nil {
+		return nil, fmt.Errorf("read the index of the cold segment file %s failed: %w", fd.Name(), err)
+	}
+	f.offsets = make([]int64, len(index)/8)
+	for i := range f.offsets {
+		f.offsets[i] = int64(binary.BigEndian.Uint64(index[8*i:]))
+	}
+	return f, nil
+}
+
+// ReadAt reads the segment file at the offset off, from the blocks it decompresses.
+func (f *coldFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < f.size {
+		blockNumber := off / f.blockSize
+		block, err := f.readBlock(blockNumber)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[off-blockNumber*f.blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock decompresses the block.
+func (f *coldFile) readBlock(blockNumber int64) ([]byte, error) {
+	start, end := f.offsets[blockNumber], f.offsets[blockNumber+1]
+	r, err := gzip.NewReader(io.NewSectionReader(f.File, start, end-start))
+	if err != nil {
+		return nil, err
+	}
+	// reading to the end verifies the checksum of gzip.
+	block, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) != min(f.blockSize, f.size-blockNumber*f.blockSize) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return block, nil
+}
+
+// Seek only reports the size of the segment file, it is never read by Read.
+func (f *coldFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		return offset, nil
+	case io.SeekEnd:
+		return f.size + offset, nil
+	}
+	return 0, errors.New("seek from the current offset of a cold segment file")
+}
+
+func (f *coldFile) Write([]byte) (int, error) {
+	return 0, ErrColdSegment
+}
+
+func (f *coldFile) WriteAt([]byte, int64) (int, error) {
+	return 0, ErrColdSegment
+}
+
+func (f *coldFile) Truncate(int64) error {
+	return ErrColdSegment
+}
+
+// writeColdFile compresses the first size bytes of the segment file into a cold segment file.
+func writeColdFile(options Options, seg *segment, size int64, name string) (err error) {
+	fs := options.fs()
+	fd, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, options.filePerm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fd.Close()
+			_ = fs.Remove(name)
+		}
+	}()
+
+	count := (size + seg.blockSize - 1) / seg.blockSize
+	index := make([]byte, 8*(count+1))
+	offset := coldHeaderSize + int64(len(index))
+	block := make([]byte, seg.blockSize)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	for blockNumber := int64(0); blockNumber < count; blockNumber++ {
+		blockSize := min(seg.blockSize, size-blockNumber*seg.blockSize)
+		if err := seg.readFile(block, uint32(blockNumber), blockSize); err != nil {
+			return err
+		}
+		compressed.Reset()
+		zw.Reset(&compressed)
+		if _, err := zw.Write(block[:blockSize]); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if _, err := fd.WriteAt(compressed.Bytes(), offset); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(index[8*blockNumber:], uint64(offset))
+		offset += int64(compressed.Len())
+	}
+	binary.BigEndian.PutUint64(index[8*count:], uint64(offset))
+
+	header := make([]byte, coldHeaderSize)
+	copy(header, coldMagic)
+	binary.BigEndian.PutUint64(header[8:16], uint64(size))
+	binary.BigEndian.PutUint32(header[16:20], uint32(seg.blockSize))
+	if _, err := fd.WriteAt(append(header, index...), 0); err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// compressPeriodically compresses the cold segment files until the WAL is closed.
+func (wal *WAL) compressPeriodically(interval time.Duration) {
+	defer wal.syncStopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wal.syncDone:
+			return
+		case <-ticker.C:
+			// a segment file failing to be compressed is left as is, and tried again next time.
+			_ = wal.compressColdSegments()
+		}
+	}
+}
+
+// compressColdSegments compresses the older segment files unread for ColdSegmentAge.
+func (wal *WAL) compressColdSegments() error {
+	age := wal.options.coldSegmentAge()
+	wal.mu.RLock()
+	var cold []*segment
+	for _, segment := range wal.olderSegments {
+		if !segment.cold && time.Since(segment.lastUsed()) >= age && segment.acquire() {
+			cold = append(cold, segment)
+		}
+	}
+	wal.mu.RUnlock()
+
+	var err error
+	for _, segment := range cold {
+		if err == nil {
+			err = wal.compressSegment(segment)
+		}
+		_ = segment.release()
+	}
+	return err
+}
+
+// compressSegment replaces the older segment file with a cold segment file of the same content.
+func (wal *WAL) compressSegment(seg *segment) error {
+	fs := wal.options.fs()
+	ext := wal.options.DiskFileExtension
+	tmpName := wal.options.segmentFileName(coldFileExt(ext), seg.id)
+	if err := writeColdFile(wal.options, seg, seg.Size(), tmpName); err != nil {
+		return segmentError("compress", seg.id, err)
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	// deleted or replaced meanwhile.
+	if wal.olderSegments[seg.id] != seg {
+		return fs.Remove(tmpName)
+	}
+	// the rename fails on Windows while the segment file is read, it is tried again next time.
+	if err := fs.Rename(tmpName, wal.options.segmentFileName(ext, seg.id)); err != nil {
+		_ = fs.Remove(tmpName)
+		return segmentError("compress", seg.id, err)
+	}
+	if err := syncDir(fs, wal.options.DirPath); err != nil {
+		return segmentError("compress", seg.id, err)
+	}
+	segment, err := openSegmentFile(wal.options, seg.id, wal.blockCache)
+	if err != nil {
+		return segmentError("compress", seg.id, err)
+	}
+	segment.handles = wal.handles
+	segment.records = seg.records
+	// the readers of the old segment file read it until they release it.
+	_ = seg.Close()
+	wal.sealSegment(segment)
+	return nil
+}
+
+// lastUsed returns when the segment file was last read or rotated, or modified before Open.
+func (seg *segment) lastUsed() time.Time {
+	if lastAccess := seg.lastAccess.Load(); lastAccess > seg.createdAt.UnixNano() {
+		return time.Unix(0, lastAccess)
+	}
+	return seg.createdAt
+}
@@ -0,0 +1,329 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// compactManifestName is the file recording the ids of the segment files replaced by Compact,
+// from the moment the new segment files are complete until the old ones are deleted.
+const compactManifestName = "COMPACT"
+
+// compactFileExt returns the extension of the segment files written by Compact,
+// before they replace the compacted ones.
+func compactFileExt(extName string) string {
+	return ".compact" + extName
+}
+
+// Compact rewrites the records of all the segment files into new segment files,
+// only the records for which keep returns true are written, in the same order.
+//
+// The new segment files take the ids after the active segment, they are written
+// with a temporary extension and synced, then the manifest is written with the old
+// and the new ids. It is the commit point: a Compact interrupted before it leaves the
+// old segment files untouched, and its temporary files are deleted by the next Open,
+// while the next Open finishes a committed one by renaming the new segment files
+// and deleting the old ones, before the manifest itself is deleted.
+// If the new segment files fail to be renamed or opened, the Compact is rolled back
+// and the WAL keeps the old ones, after that it uses the new ones even on a failure.
+//
+// The kept records keep their type and write time, the records without a write time
+// get the time of the Compact if StoreTimestamps is set.
+//
+// The positions returned before Compact are invalid after it,
+// but the readers created before it keep reading the old segment files.
+func (wal *WAL) Compact(keep func(pos *ChunkPosition, data []byte) bool) (err error) {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return ErrShardsUnsupported
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	tmpOptions := wal.options
+	tmpOptions.DiskFileExtension = compactFileExt(wal.options.DiskFileExtension)
+
+	var compacted []*segment
+	defer func() {
+		if err != nil {
+			for _, segment := range compacted {
+				_ = segment.Remove()
+			}
+		}
+	}()
+
+	// nothing to compact before the initial segment file is created.
+	if wal.activeSegment == nil {
+		return nil
+	}
+	oldSegments := wal.sortedSegments()
+	id, err := wal.options.nextSegmentID(wal.activeSegment.id)
+	if err != nil {
+		return err
+	}
+	current, err := openSegmentFile(tmpOptions, id, nil)
+	if err != nil {
+		return err
+	}
+	compacted = append(compacted, current)
+
+	// write the kept records to the new segment files.
+	for _, segment := range oldSegments {
+		reader := segment.NewReader()
+		for {
+			data, pos, meta, err := reader.nextWithMeta()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !keep(pos, data) {
+				continue
+			}
+			if current.Size()+wal.options.maxDataWriteSize(int64(len(data))+1+wal.options.recordOverhead()) > wal.options.SegmentSize {
+				if err := wal.syncSegment(current); err != nil {
+					return err
+				}
+				id, err := wal.options.nextSegmentID(current.id)
+				if err != nil {
+					return err
+				}
+				if current, err = openSegmentFile(tmpOptions, id, nil); err != nil {
+					return err
+				}
+				compacted = append(compacted, current)
+			}
+			if _, err := current.writeRecord(data, meta.Type, meta.Time); err != nil {
+				return err
+			}
+		}
+	}
+	if err := wal.syncSegment(current); err != nil {
+		return err
+	}
+
+	var newIDs []SegSerialID
+	for _, segment := range compacted {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+		newIDs = append(newIDs, segment.id)
+	}
+	oldIDs := make([]SegSerialID, 0, len(oldSegments))
+	for _, segment := range oldSegments {
+		oldIDs = append(oldIDs, segment.id)
+	}
+	if err := writeCompactManifest(wal.options, oldIDs, newIDs); err != nil {
+		_ = wal.options.fs().Remove(filepath.Join(wal.options.DirPath, compactManifestName+".tmp"))
+		return err
+	}
+	// the Compact is committed, it is rolled back until the new segment files are opened.
+	compacted = nil
+
+	// rename the new segment files, and reopen them with their final names.
+	newSegments, err := wal.openCompacted(newIDs)
+	if err != nil {
+		return errors.Join(err, rollbackCompact(wal.options, newIDs))
+	}
+
+	// the WAL reads and writes the new segment files from now on,
+	// the next Open finishes the Compact if the old ones fail to be deleted.
+	keepFirst := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	for _, segment := range oldSegments {
+		keepFirst(segmentError("remove", segment.id, segment.Remove()))
+	}
+	wal.olderSegments = make(map[SegSerialID]*segment)
+	for _, segment := range newSegments[:len(newSegments)-1] {
+		wal.sealSegment(segment)
+		if wal.options.SegmentFooterChecksum {
+			keepFirst(segmentError("checksum", segment.id, segment.writeChecksumFile()))
+		}
+	}
+	wal.activeSegment = newSegments[len(newSegments)-1]
+
+	// everything left in the active segment file has been synced.
+	wal.markSynced()
+	// the last chunk is looked up again by LastPosition.
+	wal.lastPosition = nil
+	wal.generation++
+	keepFirst(finishCompact(wal.options, oldIDs, newIDs))
+	return err
+}
+
+// openCompacted renames the new segment files of the ids written by Compact to their final names,
+// and opens them. The opened ones are closed on a failure.
+func (wal *WAL) openCompacted(ids []SegSerialID) (_ []*segment, err error) {
+	tmpExt := compactFileExt(wal.options.DiskFileExtension)
+	for _, id := range ids {
+		oldName := wal.options.segmentFileName(tmpExt, id)
+		newName := wal.options.segmentFileName(wal.options.DiskFileExtension, id)
+		if err := wal.options.fs().Rename(oldName, newName); err != nil {
+			return nil, err
+		}
+		if err := wal.options.renameMirror(id, tmpExt, wal.options.DiskFileExtension); err != nil {
+			return nil, err
+		}
+	}
+	if err := syncDir(wal.options.fs(), wal.options.DirPath); err != nil {
+		return nil, err
+	}
+	segments := make([]*segment, 0, len(ids))
+	defer func() {
+		if err != nil {
+			for _, segment := range segments {
+				_ = segment.Close()
+			}
+		}
+	}()
+	for _, id := range ids {
+		segment, err := openSegmentFile(wal.options, id, wal.blockCache)
+		if err != nil {
+			return nil, err
+		}
+		segment.handles = wal.handles
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// writeCompactManifest writes the manifest of the Compact replacing the segment files
+// of the old ids with the new ones: the number of old ids, then the old ids and the new ids.
+func writeCompactManifest(options Options, oldIDs, newIDs []SegSerialID) error {
+	buf := make([]byte, 4*(1+len(oldIDs)+len(newIDs)))
+	binary.BigEndian.PutUint32(buf, uint32(len(oldIDs)))
+	for i, id := range append(oldIDs[:len(oldIDs):len(oldIDs)], newIDs...) {
+		binary.BigEndian.PutUint32(buf[4*(i+1):], id)
+	}
+	return writeManifest(options, compactManifestName, buf)
+}
+
+// recoverCompact finishes the Compact recorded by the manifest, if any,
+// and deletes the temporary files of an uncommitted Compact.
+func recoverCompact(options Options) error {
+	name := filepath.Join(options.DirPath, compactManifestName)
+	buf, err := readManifest(options, compactManifestName)
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		if len(buf) < 4 || len(buf)%4 != 0 || int(binary.BigEndian.Uint32(buf)) > len(buf)/4-1 {
+			return fmt.Errorf("read %s failed: %w", name, io.ErrUnexpectedEOF)
+		}
+		ids := make([]SegSerialID, 0, len(buf)/4-1)
+		for i := 4; i < len(buf); i += 4 {
+			ids = append(ids, binary.BigEndian.Uint32(buf[i:]))
+		}
+		oldCount := binary.BigEndian.Uint32(buf)
+		if err := finishCompact(options, ids[:oldCount], ids[oldCount:]); err != nil {
+			return err
+		}
+	}
+	_ = options.fs().Remove(name + ".tmp")
+	return removeCompactFiles(options)
+}
+
+// finishCompact renames the new segment files to their final names, deletes the old ones
+// and the manifest. It is replayed after a crash, so every step may be done already.
+func finishCompact(options Options, oldIDs, newIDs []SegSerialID) error {
+	fs := options.fs()
+	ext := options.DiskFileExtension
+	tmpExt := compactFileExt(ext)
+	for _, id := range newIDs {
+		err := fs.Rename(options.segmentFileName(tmpExt, id), options.segmentFileName(ext, id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := options.renameMirror(id, tmpExt, ext); err != nil {
+			return err
+		}
+	}
+	for _, id := range oldIDs {
+		if err := removeSegmentFile(options, id); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(fs, options.DirPath); err != nil {
+		return err
+	}
+	if err := removeIfExists(fs, filepath.Join(options.DirPath, compactManifestName)); err != nil {
+		return err
+	}
+	return syncDir(fs, options.DirPath)
+}
+
+// rollbackCompact deletes the new segment files of a Compact which failed to replace
+// the old ones, with their temporary files, then the manifest.
+func rollbackCompact(options Options, newIDs []SegSerialID) error {
+	for _, id := range newIDs {
+		if err := removeSegmentFile(options, id); err != nil {
+			return err
+		}
+	}
+	if err := removeCompactFiles(options); err != nil {
+		return err
+	}
+	if options.MirrorDirPath != "" {
+		if err := removeCompactFiles(options.mirrorOptions()); err != nil {
+			return err
+		}
+	}
+	if err := removeIfExists(options.fs(), filepath.Join(options.DirPath, compactManifestName)); err != nil {
+		return err
+	}
+	return syncDir(options.fs(), options.DirPath)
+}
+
+// removeSegmentFile deletes the segment file of the id with its checksum file and its mirror,
+// the missing files are ignored.
+func removeSegmentFile(options Options, id SegSerialID) error {
+	name := options.segmentFileName(options.DiskFileExtension, id)
+	if err := removeIfExists(options.fs(), name+checksumFileExt); err != nil {
+		return err
+	}
+	if options.MirrorDirPath != "" {
+		if err := removeIfExists(options.fs(), options.mirrorOptions().segmentFileName(options.DiskFileExtension, id)); err != nil {
+			return err
+		}
+	}
+	return removeIfExists(options.fs(), name)
+}
+
+// removeCompactFiles deletes the temporary segment files left by an interrupted Compact.
+func removeCompactFiles(options Options) error {
+	return removeSegmentFiles(options, compactFileExt(options.DiskFileExtension))
+}
+
+// removeSegmentFiles deletes all the segment files with the extension.
+func removeSegmentFiles(options Options, extName string) error {
+	ids, err := listSegmentIDs(options, extName)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := options.fs().Remove(options.segmentFileName(extName, uint32(id))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir syncs the directory, so that the renamed files are durable.
+func syncDir(fs FS, dirPath string) error {
+	dir, err := fs.OpenFile(dirPath, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open directory %s failed: %w", dirPath, err)
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,22 @@
+package wal
+
+import "github.com/golang/snappy"
+
+// Compressor compresses the payload of every record before it is framed into chunks,
+// and reverses it when the record is read back.
+// A nil Compressor in Options means records are stored as is.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// SnappyCompressor is the built-in Compressor based on snappy block format.
+type SnappyCompressor struct{}
+
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (SnappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
@@ -0,0 +1,37 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the name of the file locked by an opened WAL in its directory.
+const lockFileName = "FLOCK"
+
+var ErrDirLocked = errors.New("the WAL directory is used by another opened WAL")
+
+// lockDir locks the WAL directory exclusively, so that offline tools
+// like Repair can detect an opened WAL.
+func lockDir(fs FS, dirPath string) (File, error) {
+	fd, err := fs.OpenFile(filepath.Join(dirPath, lockFileName), os.O_CREATE|os.O_RDWR, fileModePerm)
+	if err != nil {
+		return nil, err
+	}
+	// only the operating system files can be locked.
+	if descriptor, ok := fileDescriptor(fd); ok {
+		if err := flock(descriptor); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	return fd, nil
+}
+
+// unlockDir releases the lock taken by lockDir.
+func unlockDir(fd File) error {
+	if fd == nil {
+		return nil
+	}
+	return fd.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package wal
+
+// flock is a no-op on the platforms without flock(2),
+// there the user must make sure a directory is opened by only one WAL.
+func flock(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package wal
+
+import (
+	"errors"
+	"syscall"
+)
+
+func flock(fd uintptr) error {
+	err := syscall.Flock(int(fd), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrDirLocked
+	}
+	return err
+}
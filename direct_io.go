@@ -0,0 +1,79 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"unsafe"
+)
+
+// directIOAlignment is the alignment of the memory buffers, file offsets and sizes
+// of the direct I/O reads and writes, the logical block size of most devices divides it.
+const directIOAlignment = 4096
+
+var ErrDirectIOUnsupported = errors.New("direct I/O is not supported on this platform")
+
+// alignedBuffer returns a zeroed buffer of the given size whose address is aligned for direct I/O.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1)); rem != 0 {
+		shift = directIOAlignment - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
+
+// writeDirect writes the chunk buffer starting at the given block and offset with direct I/O.
+// The partially written block the buffer starts in is written again from its start,
+// and the end of the write is padded with zeros to a whole block,
+// so the file size is always a multiple of blockSize, see chunksEnd.
+func (seg *segment) writeDirect(buf []byte, fromBlock, fromSize uint32) error {
+	blockSize := int(seg.blockSize)
+	total := int(fromSize) + len(buf)
+	out := alignedBuffer((total + blockSize - 1) / blockSize * blockSize)
+	copy(out, seg.tail[:fromSize])
+	copy(out[fromSize:], buf)
+
+	if _, err := seg.fd.WriteAt(out, int64(fromBlock)*seg.blockSize); err != nil {
+		return err
+	}
+
+	// keep the written part of the new current block for the next write.
+	clear(seg.tail)
+	if seg.currentBlockSize > 0 {
+		start := int(seg.currentBlockNumber-fromBlock) * blockSize
+		copy(seg.tail, out[start:start+int(seg.currentBlockSize)])
+	}
+	return nil
+}
+
+// loadTail reads the written part of the current block, the next direct write starts with it.
+func (seg *segment) loadTail() error {
+	clear(seg.tail)
+	if seg.currentBlockSize == 0 {
+		return nil
+	}
+	block := alignedBuffer(int(seg.blockSize))
+	n, err := seg.fd.ReadAt(block, int64(seg.currentBlockNumber)*seg.blockSize)
+	if err != nil && !(err == io.EOF && n >= int(seg.currentBlockSize)) {
+		return err
+	}
+	copy(seg.tail, block[:seg.currentBlockSize])
+	return nil
+}
+
+// chunksEnd returns the end offset of the chunks in the last block of a segment file,
+// the first chunk starts at the given offset.
+// A block padded by a direct write ends with zeros, which start with an all-zero chunk
+// header that no real chunk has, since the checksum of a chunk header is never 0.
+func chunksEnd(block []byte, offset int64) int64 {
+	for offset+chunkHeaderSize <= int64(len(block)) {
+		header := block[offset : offset+chunkHeaderSize]
+		if binary.LittleEndian.Uint32(header[:4]) == 0 &&
+			binary.LittleEndian.Uint16(header[4:6]) == 0 && header[6] == 0 {
+			return offset
+		}
+		offset += chunkHeaderSize + int64(binary.LittleEndian.Uint16(header[4:6]))
+	}
+	return min(offset, int64(len(block)))
+}
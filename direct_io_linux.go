@@ -0,0 +1,10 @@
+//go:build linux
+
+package wal
+
+import "syscall"
+
+const (
+	directIOSupported = true
+	oDirect           = syscall.O_DIRECT
+)
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package wal
+
+const (
+	directIOSupported = false
+	oDirect           = 0
+)
@@ -0,0 +1,38 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+var (
+	// ErrNoSpace is returned when the disk is full, or its free space is below MinFreeBytes.
+	ErrNoSpace = errors.New("no space left for the WAL")
+	// ErrDiskSpaceUnsupported is returned by Open if MinFreeBytes is set on a platform
+	// where the free disk space can't be read.
+	ErrDiskSpaceUnsupported = errors.New("reading the free disk space is not supported on this platform")
+)
+
+// noSpaceError wraps the error of a write or a sync with ErrNoSpace if the disk is full.
+func noSpaceError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrNoSpace) {
+		return fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+	return err
+}
+
+// checkFreeSpace returns ErrNoSpace if the free disk space of the WAL directory is below MinFreeBytes.
+func (wal *WAL) checkFreeSpace() error {
+	if wal.options.MinFreeBytes <= 0 {
+		return nil
+	}
+	free, err := freeDiskSpace(wal.options.DirPath)
+	if err != nil {
+		return err
+	}
+	if free < wal.options.MinFreeBytes {
+		return fmt.Errorf("%w: %d bytes free, MinFreeBytes is %d", ErrNoSpace, free, wal.options.MinFreeBytes)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package wal
+
+const diskSpaceSupported = false
+
+func freeDiskSpace(path string) (int64, error) {
+	return 0, ErrDiskSpaceUnsupported
+}
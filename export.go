@@ -0,0 +1,236 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// exportMagic starts every stream written by Export.
+var exportMagic = []byte("KWALEXP1")
+
+var (
+	ErrInvalidExport  = errors.New("the stream is not a WAL export")
+	ErrImportNotEmpty = errors.New("the WAL directory to import into already has segment files")
+)
+
+// exportedSegment is a segment file and the size of it to export.
+type exportedSegment struct {
+	segment *segment
+	size    int64
+}
+
+// Export writes all the segment files of the WAL to w, in a stream which is restored by Import.
+// The stream is the magic, the number of segment files, then the id, the size and the raw
+// content of every segment file, so the positions of the records stay valid after Import.
+//
+// The records written during Export may be missing from the stream, but the ones
+// written before it are all in it. The options of the WAL are not in the stream.
+func (wal *WAL) Export(w io.Writer) error {
+	segments := wal.exportSegments()
+	defer func() {
+		for _, exported := range segments {
+			_ = exported.segment.release()
+		}
+	}()
+
+	if _, err := w.Write(exportMagic); err != nil {
+		return err
+	}
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header, uint32(len(segments)))
+	if _, err := w.Write(header[:4]); err != nil {
+		return err
+	}
+	for _, exported := range segments {
+		block := alignedBuffer(int(exported.segment.blockSize))
+		binary.BigEndian.PutUint32(header[:4], exported.segment.id)
+		binary.BigEndian.PutUint64(header[4:], uint64(exported.size))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		for offset := int64(0); offset < exported.size; offset += exported.segment.blockSize {
+			size := min(exported.size-offset, exported.segment.blockSize)
+			if err := exported.segment.readFile(block, uint32(offset/exported.segment.blockSize), size); err != nil {
+				return segmentError("export", exported.segment.id, err)
+			}
+			if _, err := w.Write(block[:size]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportSegments acquires the segment files of the WAL sorted by id, with their current sizes.
+func (wal *WAL) exportSegments() []exportedSegment {
+	var segments []exportedSegment
+	if wal.shards != nil {
+		for _, shard := range wal.shards {
+			segments = append(segments, shard.exportSegments()...)
+		}
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].segment.id < segments[j].segment.id
+		})
+		return segments
+	}
+
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	for _, segment := range wal.sortedSegments() {
+		if segment.acquire() {
+			segments = append(segments, exportedSegment{segment: segment, size: segment.Size()})
+		}
+	}
+	return segments
+}
+
+// ReadSegmentRange returns the raw bytes of the blocks from startBlock to endBlock, excluded,
+// of the segment file with the id, as they are on disk: the chunk headers and the padding are
+// included, and the chunks are neither verified nor decoded. Block 0 starts with the segment
+// header. The range is cut at the end of the segment file, so the last block of the active
+// segment file is only the part written so far, and a range after the end is empty.
+//
+// The bytes are meant to be written verbatim at the same offset of the segment file with the same
+// id on a peer with the same BlockSize. The caller must honor the block boundaries: a range starts
+// at a block, and the next one must start where it ended, as the chunks are aligned on the blocks.
+func (wal *WAL) ReadSegmentRange(id SegSerialID, startBlock, endBlock uint32) ([]byte, error) {
+	if wal.shards != nil {
+		return wal.shardOf(id).ReadSegmentRange(id, startBlock, endBlock)
+	}
+	if startBlock > endBlock {
+		return nil, fmt.Errorf("the start block %d is after the end block %d", startBlock, endBlock)
+	}
+	wal.mu.RLock()
+	segment, err := wal.acquireSegment("read", id)
+	if err != nil {
+		wal.mu.RUnlock()
+		return nil, err
+	}
+	size := segment.Size()
+	wal.mu.RUnlock()
+	defer segment.release()
+
+	start := min(int64(startBlock)*segment.blockSize, size)
+	end := min(int64(endBlock)*segment.blockSize, size)
+	data := make([]byte, 0, end-start)
+	block := alignedBuffer(int(segment.blockSize))
+	for offset := start; offset < end; offset += segment.blockSize {
+		blockSize := min(end-offset, segment.blockSize)
+		if err := segment.readFile(block, uint32(offset/segment.blockSize), blockSize); err != nil {
+			return nil, segmentError("read", id, err)
+		}
+		data = append(data, block[:blockSize]...)
+	}
+	return data, nil
+}
+
+// Import restores the segment files of a stream written by Export into options.DirPath,
+// with their ids and contents, the WAL is then opened by Open with the same options.
+// The directory must have no segment files, and the options must match the exported
+// WAL in ChecksumType, Compressor and Cipher for the records to be read back.
+func Import(options Options, r io.Reader) (err error) {
+	fs := options.fs()
+	if err := fs.MkdirAll(options.DirPath, options.dirPerm()); err != nil {
+		return err
+	}
+	dirLock, err := lockDir(fs, options.DirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unlockDir(dirLock)
+	}()
+	ids, err := listSegmentIDs(options, options.DiskFileExtension)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return ErrImportNotEmpty
+	}
+
+	header := make([]byte, len(exportMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	if !bytes.Equal(header[:len(exportMagic)], exportMagic) {
+		return ErrInvalidExport
+	}
+	count := binary.BigEndian.Uint32(header[len(exportMagic):])
+
+	// remove the segment files restored before a failure, the directory is left as it was.
+	var restored []string
+	defer func() {
+		if err != nil {
+			for _, name := range restored {
+				_ = fs.Remove(name)
+			}
+		}
+	}()
+	segmentHeader := make([]byte, 12)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, segmentHeader); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		id := binary.BigEndian.Uint32(segmentHeader[:4])
+		size := int64(binary.BigEndian.Uint64(segmentHeader[4:]))
+		name := options.segmentFileName(options.DiskFileExtension, id)
+		fd, err := fs.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, options.filePerm())
+		if err != nil {
+			return err
+		}
+		restored = append(restored, name)
+		if _, err := io.CopyN(fd, r, size); err != nil {
+			_ = fd.Close()
+			if err == io.EOF {
+				err = fmt.Errorf("%w: %v", ErrInvalidExport, io.ErrUnexpectedEOF)
+			}
+			return err
+		}
+		if err := fd.Sync(); err != nil {
+			_ = fd.Close()
+			return err
+		}
+		if err := fd.Close(); err != nil {
+			return err
+		}
+	}
+	return syncDir(fs, options.DirPath)
+}
+
+// Fork copies the segment files of the WAL into newDirPath, and opens a new WAL there with the
+// same options, so that both are written independently and the positions stay valid in the fork.
+// The active segment file is synced first, the records written during Fork may be missing from
+// the fork like from Export. The directory must have no segment files.
+//
+// The fork has no MirrorDirPath, which would share the mirror files.
+//
+// The segment files are copied rather than hard-linked: a hard link is cheap, but the file
+// would be shared, so the writes and truncations of one WAL would show up in the other.
+func (wal *WAL) Fork(newDirPath string) (*WAL, error) {
+	if !wal.options.ReadOnly {
+		if err := wal.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	options := wal.options
+	options.DirPath = newDirPath
+	// the mirror files belong to the WAL.
+	options.MirrorDirPath = ""
+
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(wal.Export(w))
+	}()
+	err := Import(options, r)
+	// unblock Export if Import stopped early.
+	_ = r.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return nil, err
+	}
+	return Open(options)
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package wal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, the file size is not changed by fallocate.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk space for the file without changing its size.
+// It does nothing if the file system doesn't support it.
+func preallocate(fd uintptr, size int64) error {
+	err := syscall.Fallocate(int(fd), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package wal
+
+// preallocate does nothing, the preallocation is only supported on Linux.
+func preallocate(fd uintptr, size int64) error {
+	return nil
+}
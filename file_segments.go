@@ -1,21 +1,31 @@
 package wal
 
 import (
+	"bytes"
+	"cmp"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/valyala/bytebufferpool"
 )
 
 type ChunkType = byte
 type SegSerialID = uint32
 
+// RecordType is a small tag stored with a record by WriteWithType,
+// like the logical stream it belongs to. Records written by Write have the type 0.
+type RecordType = uint8
+
 const (
 	ChunkTypeFull ChunkType = iota
 	ChunkTypeFirst
@@ -23,36 +33,128 @@ const (
 	ChunkTypeLast
 )
 
+const (
+	// the low bits of the chunk type byte hold the ChunkType,
+	// the high bits are flags describing how the record payload is stored.
+	chunkTypeMask ChunkType = 0x0f
+
+	// the record payload was compressed by the Compressor before framing.
+	chunkFlagCompressed ChunkType = 1 << 7
+	// the record payload is prefixed with a non-zero RecordType byte,
+	// the chunks without it are read as type 0.
+	chunkFlagTyped ChunkType = 1 << 6
+	// the record payload was sealed by the Cipher, after compression.
+	chunkFlagEncrypted ChunkType = 1 << 5
+	// the record payload is prefixed with its write time, before the RecordType byte.
+	chunkFlagTimestamp ChunkType = 1 << 4
+)
+
+// timestampSize is the size of the write time prefixed to the record payload,
+// in nanoseconds since the Unix epoch.
+const timestampSize = 8
+
 var (
-	ErrClosed     = errors.New("the seg file is closed")
-	ErrInvalidCRC = errors.New("invalid crc, the data may be corrupted")
+	ErrClosed        = errors.New("the seg file is closed")
+	ErrInvalidCRC    = errors.New("invalid crc, the data may be corrupted")
+	ErrNoCompressor  = errors.New("the chunk is compressed but no compressor is configured")
+	ErrNoCipher      = errors.New("the chunk is encrypted but no cipher is configured")
+	ErrDecryptFailed = errors.New("decrypt the chunk failed, the key may be wrong or the data corrupted")
+	ErrSegmentSealed = errors.New("the segment file is sealed, only the active segment file is written")
+	// ErrInvalidPosition is returned by DecodeChunkPosition for bytes not written by Encode.
+	ErrInvalidPosition = errors.New("the encoded chunk position is invalid")
 )
 
+// ChecksumError is returned when the checksum of a chunk doesn't match its data,
+// it tells where the corrupted chunk is. errors.Is(err, ErrInvalidCRC) reports true for it.
+type ChecksumError struct {
+	SegmentId   SegSerialID
+	BlockNumber uint32
+	ChunkOffset int64
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("invalid crc of the chunk at segment %d, block %d, offset %d, the data may be corrupted",
+		e.SegmentId, e.BlockNumber, e.ChunkOffset)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrInvalidCRC
+}
+
 const (
 	chunkHeaderSize = 7
 
-	blockSize = 32 * KB
+	// the block size of Options.BlockSize 0, and of the segment files written before the header.
+	defaultBlockSize = 32 * KB
+	// the chunk length is 2 bytes, so a chunk fills at most a block of 64KB.
+	minBlockSize = 1 * KB
+	maxBlockSize = 64 * KB
 
 	fileModePerm = 0644
+	dirModePerm  = 0755
 
 	maxLen = binary.MaxVarintLen32*3 + binary.MaxVarintLen64
+
+	// an encoded position starts with positionTag and the version of its layout. The positions
+	// encoded before start with the segment id, which is never 0, and are still decoded.
+	positionTag       = 0
+	positionVersion   = 1
+	positionHeaderLen = 2
 )
 
 type segment struct {
 	id                 SegSerialID
-	fd                 *os.File
+	fd                 File
+	fs                 FS
+	filePerm           os.FileMode // the permission of the files created for the segment, like its checksum file.
 	currentBlockNumber uint32
 	currentBlockSize   uint32
-	closed             bool
+	closed             bool         // closed by the WAL, no more writes.
+	refs               atomic.Int32 // the WAL and the Readers using the file, it is closed when reaching 0.
 	header             []byte
-	cache              *lru.Cache[uint64, []byte]
+	cache              *blockCache
 	blockPool          sync.Pool
+	bufferPool         BufferPool
+	compressor         Compressor
+	cipher             Cipher
+	checksumType       ChecksumType
+	createdAt          time.Time
+	directIO           bool        // the file is opened with O_DIRECT.
+	tail               []byte      // the written part of the current block, only for direct I/O.
+	sealed             atomic.Bool // it is an older segment, not written anymore.
+	mmapReads          bool
+	verifyOnRead       bool
+	noActiveCache      bool // the blocks are only cached once it is sealed, see NoActiveSegmentCache.
+	storeTimestamps    bool
+	readAhead          int    // the blocks prefetched by the readers, see ReadAhead.
+	dataStart          int64  // the offset of the first chunk, after the segment header.
+	blockSize          int64  // the block size recorded in the segment header.
+	segmentSize        int64  // the size it is rotated at with SegmentSizeFunc, 0 if not recorded.
+	fileSum            uint32 // the running checksum of the file content, for SegmentFooterChecksum.
+	fileSumValid       bool   // fileSum covers the whole file, false once it is truncated or reopened.
+	mmapMu             sync.RWMutex
+	mmapOnce           sync.Once
+	mmapData           []byte
+	preallocated       bool            // the unused preallocated space is trimmed by trim.
+	records            int64           // the number of records, -1 if unknown until counted by recordCount.
+	handles            *segmentHandles // the open files limited by MaxOpenSegments, nil if unlimited.
+	handle             *list.Element   // the element of the segment in handles, guarded by handles.mu.
+	parked             bool            // the file is closed by handles, guarded by handles.mu.
+	syncing            chan struct{}   // closed once synced in the background with AsyncRotateSync.
+	pipelineChecksums  bool            // the checksums are computed by writeChunkBuffer, see PipelineChecksums.
+	unsummed           []int           // the offsets of the chunks in the chunk buffer whose checksum is not computed yet.
+	cold               bool            // the file is compressed by CompressColdSegments.
+	trackAccess        bool            // the reads update lastAccess, for CompressColdSegments.
+	lastAccess         atomic.Int64    // the time of the last read or of the rotation, in unix nanoseconds.
 }
 
 type segmentReader struct {
 	segment     *segment
 	blockNumber uint32
 	chunkOffset int64
+	size        int64       // the size of the segment file when the reader was created, it reads nothing after.
+	prefetched  uint32      // the blocks before it are prefetched by ReadAhead.
+	prefetching atomic.Bool // a prefetch of the reader is running.
 }
 
 type blockAndHeader struct {
@@ -60,6 +162,35 @@ type blockAndHeader struct {
 	header []byte
 }
 
+// RecordMeta describes how a record is stored in the segment file.
+type RecordMeta struct {
+	// Size is the on-disk size of all the chunks of the record, including the chunk headers.
+	// It doesn't include the block padding, unlike ChunkPosition.ChunkSize.
+	Size uint32
+	// Blocks is the number of blocks the record spans.
+	Blocks uint32
+	// ChunkType is the type of the first chunk of the record,
+	// ChunkTypeFull if the record fits in one chunk, ChunkTypeFirst otherwise.
+	ChunkType ChunkType
+	// Compressed reports whether the record payload is stored compressed.
+	Compressed bool
+	// Type is the RecordType of the record, 0 if it was written by Write.
+	Type RecordType
+	// Time is the write time of the record, zero if it was written without StoreTimestamps.
+	Time time.Time
+}
+
+// RawChunk is a physical chunk of a segment file, as returned by Reader.NextRawChunk.
+type RawChunk struct {
+	// Type is ChunkTypeFull, ChunkTypeFirst, ChunkTypeMiddle or ChunkTypeLast.
+	Type ChunkType
+	// Flags are the high bits of the chunk type byte, telling how the record payload is stored.
+	Flags ChunkType
+	// Data is the payload of the chunk as stored, the record prefixes are not stripped
+	// and it is not decrypted nor decompressed.
+	Data []byte
+}
+
 type ChunkPosition struct {
 	SegmentId   SegSerialID
 	BlockNumber uint32
@@ -67,13 +198,9 @@ type ChunkPosition struct {
 	ChunkSize   uint32
 }
 
-func openSegmentFile(dirPath, extName string, id uint32, cache *lru.Cache[uint64, []byte]) (*segment, error) {
-	fd, err := os.OpenFile(
-		SegmentFileName(dirPath, extName, id),
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		fileModePerm,
-	)
-
+func openSegmentFile(options Options, id uint32, cache *blockCache) (*segment, error) {
+	extName := options.DiskFileExtension
+	fd, directIO, err := openSegmentFd(options, id, segmentFileFlag(options, options.DirectIO))
 	if err != nil {
 		return nil, err
 	}
@@ -84,32 +211,197 @@ func openSegmentFile(dirPath, extName string, id uint32, cache *lru.Cache[uint64
 		panic(fmt.Errorf("seek to the end of segment file %d%s failed: %v", id, extName, err))
 	}
 
-	return &segment{
+	// read the segment header, a file without it is either new, or written before it.
+	var (
+		fresh        = offset == 0
+		dataStart    int64
+		checksumType = options.ChecksumType
+		blockSize    = options.blockSize()
+		segmentSize  int64
+	)
+	if offset > 0 {
+		header := alignedBuffer(directIOAlignment)
+		n, err := fd.ReadAt(header, 0)
+		if err != nil && err != io.EOF {
+			_ = fd.Close()
+			return nil, err
+		}
+		// a file without the header was written with the default block size.
+		fileBlockSize := int64(defaultBlockSize)
+		switch {
+		case isTornSegmentHeader(header[:n]):
+			fresh = true
+			fileBlockSize = blockSize
+		case n >= segmentHeaderSizeV1 && bytes.Equal(header[:len(segmentMagic)], segmentMagic):
+			decoded, err := decodeSegmentHeader(header[:n])
+			if err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+			checksumType, fileBlockSize = decoded.checksumType, decoded.blockSize
+			segmentSize, dataStart = decoded.segmentSize, decoded.size
+		case !isLegacySegment(header[:n]):
+			_ = fd.Close()
+			return nil, ErrNotSegmentFile
+		}
+		if fileBlockSize != blockSize {
+			_ = fd.Close()
+			return nil, fmt.Errorf("%w: segment file %d has %d, not %d",
+				ErrBlockSizeMismatch, id, fileBlockSize, blockSize)
+		}
+	}
+	if fresh {
+		offset = 0
+		if !options.ReadOnly {
+			if err := fd.Truncate(0); err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+			offset, dataStart, segmentSize = segmentHeaderSize, segmentHeaderSize, options.SegmentSize
+		}
+	}
+
+	// the last block may be padded with zeros by direct writes, find where its chunks end.
+	if !fresh && offset%blockSize == 0 {
+		block := alignedBuffer(int(blockSize))
+		if _, err := fd.ReadAt(block, offset-blockSize); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		start := int64(0)
+		if offset == blockSize {
+			start = dataStart
+		}
+		end := offset - blockSize + chunksEnd(block, start)
+		// buffered writes append at the end of the file, drop the padding.
+		if end < offset && !directIO && !options.ReadOnly {
+			if err := fd.Truncate(end); err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+		}
+		offset = end
+	}
+
+	// reserve the disk space of a fresh segment file, the file size is left as is,
+	// so the reads and writes are still bounded by the written chunks.
+	preallocated := false
+	if options.Preallocate && fresh && !options.ReadOnly {
+		if descriptor, ok := fileDescriptor(fd); ok {
+			if err := preallocate(descriptor, segmentSize); err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+			preallocated = true
+		}
+	}
+
+	// a fresh segment file is created now, the age of an existing one is
+	// counted from its last modification.
+	createdAt := time.Now()
+	if !fresh {
+		stat, err := fd.Stat()
+		if err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		createdAt = stat.ModTime()
+	}
+
+	_, cold := fd.(*coldFile)
+	seg := &segment{
 		id:                 id,
 		fd:                 fd,
-		cache:              cache,
+		fs:                 options.fs(),
+		filePerm:           options.filePerm(),
+		compressor:         options.Compressor,
+		cipher:             options.Cipher,
+		checksumType:       checksumType,
+		dataStart:          dataStart,
+		blockSize:          blockSize,
+		segmentSize:        segmentSize,
 		header:             make([]byte, chunkHeaderSize),
-		blockPool:          sync.Pool{New: newBlockAndHeader},
+		bufferPool:         options.BufferPool,
 		currentBlockNumber: uint32(offset / blockSize),
 		currentBlockSize:   uint32(offset % blockSize),
-	}, nil
+		createdAt:          createdAt,
+		directIO:           directIO,
+		mmapReads:          options.MMapReads,
+		verifyOnRead:       options.VerifyOnRead,
+		noActiveCache:      options.NoActiveSegmentCache,
+		storeTimestamps:    options.StoreTimestamps,
+		readAhead:          options.ReadAhead,
+		pipelineChecksums:  options.PipelineChecksums && !directIO,
+		trackAccess:        options.CompressColdSegments,
+		cold:               cold,
+		fileSumValid:       fresh && options.SegmentFooterChecksum,
+		preallocated:       preallocated && options.TrimPreallocated,
+	}
+	seg.blockPool.New = func() interface{} {
+		return &blockAndHeader{
+			block:  alignedBuffer(int(blockSize)),
+			header: make([]byte, chunkHeaderSize),
+		}
+	}
+	// the blocks come from the BufferPool, only the chunk headers are pooled by the segment.
+	if seg.bufferPool != nil && !directIO {
+		seg.blockPool.New = func() interface{} {
+			return &blockAndHeader{header: make([]byte, chunkHeaderSize)}
+		}
+	}
+	seg.refs.Store(1)
+	if directIO {
+		seg.tail = alignedBuffer(int(blockSize))
+	}
+	switch {
+	case fresh && !options.ReadOnly:
+		err = seg.writeHeader()
+		// the new segment file is only durable once its directory entry is.
+		if err == nil && options.SyncDirOnCreate {
+			err = syncDir(options.fs(), options.DirPath)
+		}
+	case directIO:
+		err = seg.loadTail()
+	}
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	seg.cache = cache
+	// the records of an existing segment file are counted when needed.
+	if !fresh {
+		seg.records = -1
+	}
+	return seg, nil
 }
 
-func newBlockAndHeader() interface{} {
-	return &blockAndHeader{
-		block:  make([]byte, blockSize),
-		header: make([]byte, chunkHeaderSize),
+// writeHeader writes the header of a new segment file, the first chunk follows it.
+func (seg *segment) writeHeader() error {
+	header := encodeSegmentHeader(seg.checksumType, seg.blockSize, seg.segmentSize)
+	seg.updateFileSum(header)
+	if seg.directIO {
+		return seg.writeDirect(header, 0, 0)
 	}
+	_, err := seg.fd.Write(header)
+	return err
 }
 
+// NewReader returns a reader of the chunks written to the segment file so far,
+// the ones written after it is created are not read, so it never reads a chunk being written.
 func (seg *segment) NewReader() *segmentReader {
 	return &segmentReader{
 		segment:     seg,
 		blockNumber: 0,
-		chunkOffset: 0,
+		chunkOffset: seg.dataStart,
+		size:        seg.Size(),
 	}
 }
 
+// isEmpty reports whether the segment file has no chunk.
+func (seg *segment) isEmpty() bool {
+	return seg.Size() <= seg.dataStart
+}
+
 func (seg *segment) Sync() error {
 	if seg.closed {
 		return nil
@@ -117,36 +409,206 @@ func (seg *segment) Sync() error {
 	return seg.fd.Sync()
 }
 
+// Remove closes and deletes the segment file.
+// The Readers still using it can read it until they release it.
 func (seg *segment) Remove() error {
+	// the file is synced first, even though it is deleted, as AsyncRotateSync promises.
+	if seg.syncing != nil {
+		<-seg.syncing
+	}
 	if !seg.closed {
 		seg.closed = true
-		_ = seg.fd.Close()
+		_ = seg.dropRef()
 	}
+	seg.dropCache(0)
 
-	return os.Remove(seg.fd.Name())
+	if err := seg.removeChecksumFile(); err != nil {
+		return err
+	}
+	if err := seg.removeMirror(); err != nil {
+		return err
+	}
+	return seg.fs.Remove(seg.fd.Name())
 }
 
+// truncate discards the chunks at and after the given position,
+// the next write will be appended right at this position.
+func (seg *segment) truncate(blockNumber uint32, chunkOffset int64) error {
+	if seg.closed {
+		return ErrClosed
+	}
+
+	size := int64(blockNumber)*seg.blockSize + chunkOffset
+	if chunkOffset < 0 || chunkOffset >= seg.blockSize || size > seg.Size() || size < seg.dataStart {
+		return fmt.Errorf("truncate position %d:%d is beyond the end of segment file %d",
+			blockNumber, chunkOffset, seg.id)
+	}
+	// the pages of the mapping after the new end of the file can't be read anymore.
+	seg.mmapMu.Lock()
+	defer seg.mmapMu.Unlock()
+	seg.unmapLocked()
+	if err := seg.fd.Truncate(size); err != nil {
+		return err
+	}
+	seg.dropCache(blockNumber)
+	seg.fileSumValid = false
+	// the checksum file no longer matches the segment file.
+	if err := seg.removeChecksumFile(); err != nil {
+		return err
+	}
+
+	seg.currentBlockNumber = blockNumber
+	seg.currentBlockSize = uint32(chunkOffset)
+	seg.records = -1
+	if seg.directIO {
+		return seg.loadTail()
+	}
+	return nil
+}
+
+// dropCache removes the cached blocks of the segment from the given block number.
+func (seg *segment) dropCache(fromBlock uint32) {
+	if seg.cache == nil {
+		return
+	}
+	for n := fromBlock; n <= seg.currentBlockNumber; n++ {
+		seg.cache.Remove(seg.getCacheKey(n))
+	}
+}
+
+// Close closes the segment for the WAL,
+// the file is closed once the Readers using it release it too.
 func (seg *segment) Close() error {
 	if seg.closed {
 		return nil
 	}
+	if err := seg.trim(); err != nil {
+		return err
+	}
 
 	seg.closed = true
-	return seg.fd.Close()
+	return seg.dropRef()
+}
+
+// dropRef drops the reference of the WAL, when it closes or deletes the segment file.
+func (seg *segment) dropRef() error {
+	if seg.handles != nil {
+		return seg.handles.drop(seg)
+	}
+	return seg.release()
+}
+
+// acquire takes a reference on the segment file so that it stays open until release,
+// it returns false if the file is already closed. The file closed by MaxOpenSegments
+// is opened again.
+func (seg *segment) acquire() bool {
+	if seg.tryAcquire() {
+		if seg.handles != nil {
+			seg.handles.touch(seg)
+		}
+		return true
+	}
+	return seg.handles != nil && seg.handles.reopen(seg)
+}
+
+// acquireForReader takes the reference of a Reader on the segment file, which holds it
+// until it is closed. The files closed by MaxOpenSegments are only held while they are read.
+func (seg *segment) acquireForReader() bool {
+	return seg.handles != nil || seg.acquire()
+}
+
+// releaseForReader releases the reference taken by acquireForReader.
+func (seg *segment) releaseForReader() error {
+	if seg.handles != nil {
+		return nil
+	}
+	return seg.release()
+}
+
+// tryAcquire takes a reference on the segment file if it is open.
+func (seg *segment) tryAcquire() bool {
+	for {
+		refs := seg.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if seg.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference taken by acquire, or the one of the WAL,
+// and closes the file when it was the last one.
+func (seg *segment) release() error {
+	if seg.handles != nil {
+		seg.handles.mu.Lock()
+		defer seg.handles.mu.Unlock()
+	}
+	return seg.releaseLocked()
+}
+
+// releaseLocked is release, with handles.mu held if the segment has handles.
+func (seg *segment) releaseLocked() error {
+	if seg.refs.Add(-1) == 0 {
+		seg.unmap()
+		return seg.fd.Close()
+	}
+	return nil
 }
 
 func (seg *segment) Size() int64 {
-	size := int64(seg.currentBlockNumber) * int64(blockSize)
+	size := int64(seg.currentBlockNumber) * int64(seg.blockSize)
 	return size + int64(seg.currentBlockSize)
 }
 
-func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteBuffer) (*ChunkPosition, error) {
+func (seg *segment) writeToBuffer(data []byte, recordType RecordType, writeTime time.Time, chunkBuffer *bytebufferpool.ByteBuffer) (*ChunkPosition, error) {
+	blockSize := uint32(seg.blockSize)
 	startBufferLen := chunkBuffer.Len()
 	padding := uint32(0)
 
 	if seg.closed {
 		return nil, ErrClosed
 	}
+	if seg.sealed.Load() {
+		return nil, ErrSegmentSealed
+	}
+
+	// compress the record payload, keep it raw if compression doesn't help.
+	var flags ChunkType
+	if seg.compressor != nil {
+		compressed, err := seg.compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+			flags |= chunkFlagCompressed
+		}
+	}
+	if seg.cipher != nil {
+		sealed, err := sealRecord(seg.cipher, data)
+		if err != nil {
+			return nil, err
+		}
+		data = sealed
+		flags |= chunkFlagEncrypted
+	}
+	// the type is stored out of the compressed and encrypted payload.
+	if recordType != 0 {
+		data = append([]byte{recordType}, data...)
+		flags |= chunkFlagTyped
+	}
+	if seg.storeTimestamps {
+		if writeTime.IsZero() {
+			writeTime = time.Now()
+		}
+		prefixed := make([]byte, timestampSize+len(data))
+		binary.LittleEndian.PutUint64(prefixed, uint64(writeTime.UnixNano()))
+		copy(prefixed[timestampSize:], data)
+		data = prefixed
+		flags |= chunkFlagTimestamp
+	}
 
 	// if the left block size can not hold the chunk header, padding the block
 	if seg.currentBlockSize+chunkHeaderSize >= blockSize {
@@ -172,7 +634,7 @@ func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteB
 	dataSize := uint32(len(data))
 	// The entire chunk can fit into the block.
 	if seg.currentBlockSize+dataSize+chunkHeaderSize <= blockSize {
-		seg.appendChunkBuffer(chunkBuffer, data, ChunkTypeFull)
+		seg.appendChunkBuffer(chunkBuffer, data, ChunkTypeFull|flags)
 		position.ChunkSize = dataSize + chunkHeaderSize
 	} else {
 		// If the size of the data exceeds the size of the block,
@@ -204,7 +666,7 @@ func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteB
 			default: // Middle chunk
 				chunkType = ChunkTypeMiddle
 			}
-			seg.appendChunkBuffer(chunkBuffer, data[dataSize-leftSize:end], chunkType)
+			seg.appendChunkBuffer(chunkBuffer, data[dataSize-leftSize:end], chunkType|flags)
 
 			leftSize -= chunkSize
 			blockCount += 1
@@ -241,35 +703,48 @@ func (seg *segment) writeAll(data [][]byte) (positions []*ChunkPosition, err err
 	originBlockSize := seg.currentBlockSize
 
 	// init chunk buffer
-	chunkBuffer := bytebufferpool.Get()
-	chunkBuffer.Reset()
+	chunkBuffer := seg.getChunkBuffer()
 	defer func() {
 		if err != nil {
 			seg.currentBlockNumber = originBlockNumber
 			seg.currentBlockSize = originBlockSize
 		}
-		bytebufferpool.Put(chunkBuffer)
+		seg.putChunkBuffer(chunkBuffer)
 	}()
 
 	// write all data to the chunk buffer
 	var pos *ChunkPosition
 	positions = make([]*ChunkPosition, len(data))
 	for i := 0; i < len(positions); i++ {
-		pos, err = seg.writeToBuffer(data[i], chunkBuffer)
+		pos, err = seg.writeToBuffer(data[i], 0, time.Time{}, chunkBuffer)
 		if err != nil {
 			return
 		}
 		positions[i] = pos
 	}
 	// write the chunk buffer to the segment file
-	if err = seg.writeChunkBuffer(chunkBuffer); err != nil {
+	if err = seg.writeChunkBuffer(chunkBuffer, originBlockNumber, originBlockSize); err != nil {
 		return
 	}
+	if seg.records >= 0 {
+		seg.records += int64(len(data))
+	}
 	return
 }
 
 // Write writes the data to the segment file.
 func (seg *segment) Write(data []byte) (pos *ChunkPosition, err error) {
+	return seg.writeWithType(data, 0)
+}
+
+// writeWithType writes the record with its type.
+func (seg *segment) writeWithType(data []byte, recordType RecordType) (pos *ChunkPosition, err error) {
+	return seg.writeRecord(data, recordType, time.Time{})
+}
+
+// writeRecord writes the record with its type and write time,
+// the current time is stored by StoreTimestamps if writeTime is zero.
+func (seg *segment) writeRecord(data []byte, recordType RecordType, writeTime time.Time) (pos *ChunkPosition, err error) {
 	if seg.closed {
 		return nil, ErrClosed
 	}
@@ -278,152 +753,618 @@ func (seg *segment) Write(data []byte) (pos *ChunkPosition, err error) {
 	originBlockSize := seg.currentBlockSize
 
 	// init chunk buffer
-	chunkBuffer := bytebufferpool.Get()
-	chunkBuffer.Reset()
+	chunkBuffer := seg.getChunkBuffer()
 	defer func() {
 		if err != nil {
 			seg.currentBlockNumber = originBlockNumber
 			seg.currentBlockSize = originBlockSize
 		}
-		bytebufferpool.Put(chunkBuffer)
+		seg.putChunkBuffer(chunkBuffer)
 	}()
 
 	// write all data to the chunk buffer
-	pos, err = seg.writeToBuffer(data, chunkBuffer)
+	pos, err = seg.writeToBuffer(data, recordType, writeTime, chunkBuffer)
 	if err != nil {
 		return
 	}
 	// write the chunk buffer to the segment file
-	if err = seg.writeChunkBuffer(chunkBuffer); err != nil {
+	if err = seg.writeChunkBuffer(chunkBuffer, originBlockNumber, originBlockSize); err != nil {
 		return
 	}
+	if seg.records >= 0 {
+		seg.records++
+	}
 
 	return
 }
 
+// writeFrom writes a record of size bytes read from r, its chunks are written to the
+// segment file one by one, so that the record is never fully in memory.
+// It doesn't compress nor encrypt the record. The chunks already written
+// are truncated if r fails before size bytes.
+func (seg *segment) writeFrom(r io.Reader, size int64) (pos *ChunkPosition, err error) {
+	blockSize := uint32(seg.blockSize)
+	if seg.closed {
+		return nil, ErrClosed
+	}
+	if seg.sealed.Load() {
+		return nil, ErrSegmentSealed
+	}
+
+	var flags ChunkType
+	dataSize := size
+	if seg.storeTimestamps {
+		prefix := make([]byte, timestampSize)
+		binary.LittleEndian.PutUint64(prefix, uint64(time.Now().UnixNano()))
+		r = io.MultiReader(bytes.NewReader(prefix), r)
+		dataSize += timestampSize
+		flags |= chunkFlagTimestamp
+	}
+
+	originBlockNumber := seg.currentBlockNumber
+	originBlockSize := seg.currentBlockSize
+	chunkBuffer := seg.getChunkBuffer()
+	defer func() {
+		if err != nil {
+			// discard the chunks written before the failure.
+			if e := seg.truncate(originBlockNumber, int64(originBlockSize)); e != nil {
+				err = errors.Join(err, e)
+			}
+		}
+		seg.putChunkBuffer(chunkBuffer)
+	}()
+
+	// if the left block size can not hold the chunk header, padding the block
+	if seg.currentBlockSize+chunkHeaderSize >= blockSize {
+		chunkBuffer.B = append(chunkBuffer.B, make([]byte, blockSize-seg.currentBlockSize)...)
+		seg.currentBlockNumber += 1
+		seg.currentBlockSize = 0
+	}
+	pos = &ChunkPosition{
+		SegmentId:   seg.id,
+		BlockNumber: seg.currentBlockNumber,
+		ChunkOffset: int64(seg.currentBlockSize),
+	}
+
+	// every chunk fills the rest of the block, except the last one.
+	var (
+		chunk     = make([]byte, blockSize)
+		leftSize  = dataSize
+		fromBlock = originBlockNumber
+		fromSize  = originBlockSize
+	)
+	for first := true; first || leftSize > 0; first = false {
+		chunkSize := min(int64(blockSize-seg.currentBlockSize-chunkHeaderSize), leftSize)
+		if _, err := io.ReadFull(r, chunk[:chunkSize]); err != nil {
+			return nil, err
+		}
+		var chunkType ChunkType
+		switch {
+		case chunkSize == dataSize:
+			chunkType = ChunkTypeFull
+		case leftSize == dataSize:
+			chunkType = ChunkTypeFirst
+		case chunkSize == leftSize:
+			chunkType = ChunkTypeLast
+		default:
+			chunkType = ChunkTypeMiddle
+		}
+		seg.appendChunkBuffer(chunkBuffer, chunk[:chunkSize], chunkType|flags)
+		leftSize -= chunkSize
+		pos.ChunkSize += uint32(chunkSize) + chunkHeaderSize
+
+		seg.currentBlockSize += uint32(chunkSize) + chunkHeaderSize
+		if seg.currentBlockSize == blockSize {
+			seg.currentBlockNumber += 1
+			seg.currentBlockSize = 0
+		}
+		if err := seg.writeChunkBuffer(chunkBuffer, fromBlock, fromSize); err != nil {
+			return nil, err
+		}
+		chunkBuffer.Reset()
+		seg.unsummed = seg.unsummed[:0]
+		fromBlock, fromSize = seg.currentBlockNumber, seg.currentBlockSize
+	}
+	if seg.records >= 0 {
+		seg.records++
+	}
+	return pos, nil
+}
+
 func (seg *segment) appendChunkBuffer(buf *bytebufferpool.ByteBuffer, data []byte, chunkType ChunkType) {
 	// Length	2 Bytes	index:4-5
 	binary.LittleEndian.PutUint16(seg.header[4:6], uint16(len(data)))
 	// Type	1 Byte	index:6
 	seg.header[6] = chunkType
-	// Checksum	4 Bytes index:0-3
-	sum := crc32.ChecksumIEEE(seg.header[4:])
-	sum = crc32.Update(sum, crc32.IEEETable, data)
-	binary.LittleEndian.PutUint32(seg.header[:4], sum)
 
 	// append the header and data to segment chunk buffer
+	start := len(buf.B)
 	buf.B = append(buf.B, seg.header...)
 	buf.B = append(buf.B, data...)
+
+	// the checksum is computed by writeChunkBuffer, while the chunks before are written.
+	if seg.pipelineChecksums {
+		seg.unsummed = append(seg.unsummed, start)
+		return
+	}
+	// Checksum	4 Bytes index:0-3, over the rest of the header and the data
+	sum := seg.checksumType.sum(buf.B[start+4:])
+	binary.LittleEndian.PutUint32(buf.B[start:start+4], sum)
 }
 
-// write the pending chunk buffer to the segment file
-func (seg *segment) writeChunkBuffer(buf *bytebufferpool.ByteBuffer) error {
-	if seg.currentBlockSize > blockSize {
+// write the pending chunk buffer to the segment file,
+// it starts at the given block number and size of the segment before the buffered chunks.
+func (seg *segment) writeChunkBuffer(buf *bytebufferpool.ByteBuffer, fromBlock, fromSize uint32) error {
+	if int64(seg.currentBlockSize) > seg.blockSize {
 		panic("wrong! can not exceed the block size")
 	}
 
-	// write the data into underlying file
-	if _, err := seg.fd.Write(buf.Bytes()); err != nil {
+	var err error
+	starts := seg.unsummed
+	seg.unsummed = seg.unsummed[:0]
+	switch {
+	case seg.directIO:
+		err = seg.writeDirect(buf.Bytes(), fromBlock, fromSize)
+	case len(starts) > 1 && int64(buf.Len()) > seg.blockSize:
+		err = seg.writePipelined(buf.Bytes(), starts, fromBlock, fromSize)
+	default:
+		seg.sumChunks(buf.Bytes(), starts)
+		// write the data into underlying file
+		_, err = seg.fd.Write(buf.Bytes())
+	}
+	if err != nil {
+		seg.fileSumValid = false
 		return err
 	}
-
+	seg.updateFileSum(buf.Bytes())
 	return nil
 }
 
+// segmentFileFlag returns the flag the segment files are opened with.
+func segmentFileFlag(options Options, directIO bool) int {
+	if options.ReadOnly {
+		return os.O_RDONLY
+	}
+	if directIO {
+		// direct writes are done at explicit offsets, see writeDirect.
+		return os.O_CREATE | os.O_RDWR | oDirect
+	}
+	return os.O_CREATE | os.O_RDWR | os.O_APPEND
+}
+
+// openSegmentFd opens the segment file with the id, and its mirror with MirrorDirPath.
+// It reports whether the file is opened for direct I/O.
+func openSegmentFd(options Options, id SegSerialID, flag int) (File, bool, error) {
+	fileName := options.segmentFileName(options.DiskFileExtension, id)
+	directIO := flag&oDirect != 0
+	fd, err := options.fs().OpenFile(fileName, flag, options.filePerm())
+	// the file system doesn't support direct I/O, fall back to buffered I/O.
+	if directIO && errors.Is(err, syscall.EINVAL) {
+		directIO = false
+		flag = flag&^oDirect | os.O_APPEND
+		fd, err = options.fs().OpenFile(fileName, flag, options.filePerm())
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if options.MirrorDirPath != "" && !options.ReadOnly {
+		mirrored, err := openMirror(options, fd, id, flag)
+		if err != nil {
+			_ = fd.Close()
+			return nil, false, err
+		}
+		fd = mirrored
+	}
+	// the segment files compressed by CompressColdSegments are read decompressed.
+	cold, err := openColdFile(fd)
+	if err != nil {
+		_ = fd.Close()
+		return nil, false, err
+	}
+	return cold, directIO, nil
+}
+
 // Read reads the data from the segment file by the block number and chunk offset.
 func (seg *segment) Read(blockNumber uint32, chunkOffset int64) ([]byte, error) {
-	value, _, err := seg.readInternal(blockNumber, chunkOffset)
+	return seg.readAppend(nil, blockNumber, chunkOffset)
+}
+
+// readAppend reads the data like Read, and appends it to dst.
+func (seg *segment) readAppend(dst []byte, blockNumber uint32, chunkOffset int64) ([]byte, error) {
+	value, _, _, err := seg.readInternal(dst, blockNumber, chunkOffset, seg.Size())
 	return value, err
 }
 
-func (seg *segment) readInternal(blockNumber uint32, chunkOffset int64) ([]byte, *ChunkPosition, error) {
-	if seg.closed {
-		return nil, nil, ErrClosed
+// readInternal reads the record at the position, from the first segSize bytes of the segment file,
+// and appends it to dst. The decrypted or decompressed records are not in the memory of dst.
+func (seg *segment) readInternal(dst []byte, blockNumber uint32, chunkOffset, segSize int64) ([]byte, *ChunkPosition, RecordMeta, error) {
+	if seg.refs.Load() <= 0 {
+		return nil, nil, RecordMeta{}, ErrClosed
 	}
 
 	var (
-		result    []byte
-		bh        = seg.blockPool.Get().(*blockAndHeader)
-		segSize   = seg.Size()
+		result    = dst
+		flags     ChunkType
+		inRecord  bool
+		bh        = seg.getBlock()
 		nextChunk = &ChunkPosition{SegmentId: seg.id}
+		meta      RecordMeta
 	)
 
 	defer func() {
-		seg.blockPool.Put(bh)
+		seg.putBlock(bh)
 	}()
 
 	for {
-		size := int64(blockSize)
-		offset := int64(blockNumber) * blockSize
-		if size+offset > segSize {
-			size = segSize - offset
+		data, typeByte, err := seg.readChunk(bh, blockNumber, chunkOffset, segSize)
+		// the file ends in the middle of a record spanning several blocks.
+		if err == io.EOF && inRecord {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, nil, RecordMeta{}, err
 		}
+		result = append(result, data...)
 
-		if chunkOffset >= size {
-			return nil, nil, io.EOF
+		// type and flags
+		chunkType := typeByte & chunkTypeMask
+		flags |= typeByte &^ chunkTypeMask
+		if !inRecord {
+			meta.ChunkType = chunkType
 		}
+		meta.Blocks++
+		meta.Size += chunkHeaderSize + uint32(len(data))
 
-		var ok bool
-		var cachedBlock []byte
-		// try to read from the cache if it is enabled
-		if seg.cache != nil {
-			cachedBlock, ok = seg.cache.Get(seg.getCacheKey(blockNumber))
+		if chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
+			nextChunk.BlockNumber, nextChunk.ChunkOffset =
+				seg.nextChunkOffset(blockNumber, chunkOffset+chunkHeaderSize+int64(len(data)))
+			break
 		}
-		// cache hit, get block from the cache
-		if ok {
-			copy(bh.block, cachedBlock)
-		} else {
-			// cache miss, read block from the segment file
-			_, err := seg.fd.ReadAt(bh.block[0:size], offset)
-			if err != nil {
-				return nil, nil, err
-			}
-			// cache the block, so that the next time it can be read from the cache.
-			// if the block size is smaller than blockSize, it means that the block is not full,
-			// so we will not cache it.
-			if seg.cache != nil && size == blockSize && len(cachedBlock) == 0 {
-				cacheBlock := make([]byte, blockSize)
-				copy(cacheBlock, bh.block)
-				seg.cache.Add(seg.getCacheKey(blockNumber), cacheBlock)
+		blockNumber += 1
+		chunkOffset = 0
+		inRecord = true
+	}
+
+	// strip the write time prefix.
+	if flags&chunkFlagTimestamp != 0 {
+		if len(result) < timestampSize {
+			return nil, nil, RecordMeta{}, io.ErrUnexpectedEOF
+		}
+		meta.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(result)))
+		result = result[timestampSize:]
+	}
+	// strip the record type prefix.
+	if flags&chunkFlagTyped != 0 {
+		if len(result) == 0 {
+			return nil, nil, RecordMeta{}, io.ErrUnexpectedEOF
+		}
+		meta.Type = result[0]
+		result = result[1:]
+	}
+	// decrypt the record payload if it was stored encrypted.
+	if flags&chunkFlagEncrypted != 0 {
+		if seg.cipher == nil {
+			return nil, nil, RecordMeta{}, ErrNoCipher
+		}
+		decrypted, err := openRecord(seg.cipher, result)
+		if err != nil {
+			return nil, nil, RecordMeta{}, err
+		}
+		result = decrypted
+	}
+	// decompress the record payload if it was stored compressed.
+	if flags&chunkFlagCompressed != 0 {
+		if seg.compressor == nil {
+			return nil, nil, RecordMeta{}, ErrNoCompressor
+		}
+		decompressed, err := seg.compressor.Decompress(result)
+		if err != nil {
+			return nil, nil, RecordMeta{}, err
+		}
+		result = decompressed
+	}
+	meta.Compressed = flags&chunkFlagCompressed != 0
+	return result, nextChunk, meta, nil
+}
+
+// readChunk reads the block into bh and returns the payload of the chunk at the offset,
+// a slice of bh.block, and the type byte of the chunk with its flags.
+func (seg *segment) readChunk(bh *blockAndHeader, blockNumber uint32, chunkOffset, segSize int64) ([]byte, ChunkType, error) {
+	size := int64(seg.blockSize)
+	offset := int64(blockNumber) * seg.blockSize
+	if size+offset > segSize {
+		size = segSize - offset
+	}
+
+	if chunkOffset >= size {
+		return nil, 0, io.EOF
+	}
+	// the chunk header is cut by the end of the file.
+	if chunkOffset+chunkHeaderSize > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if err := seg.readBlock(bh.block, blockNumber, size); err != nil {
+		return nil, 0, err
+	}
+	data, chunkType, err := seg.parseChunk(bh, blockNumber, chunkOffset, size)
+	// the chunk is corrupted in the segment file, read the block from its mirror.
+	if errors.Is(err, ErrInvalidCRC) && seg.readMirror(bh.block, blockNumber, size) {
+		return seg.parseChunk(bh, blockNumber, chunkOffset, size)
+	}
+	return data, chunkType, err
+}
+
+// readChunkHeader reads the header of the chunk at the offset of the block into bh.header,
+// without the payload, and returns the payload length and the type byte. The checksum is not verified.
+func (seg *segment) readChunkHeader(bh *blockAndHeader, blockNumber uint32, chunkOffset, segSize int64) (int64, ChunkType, error) {
+	size := min(seg.blockSize, segSize-int64(blockNumber)*seg.blockSize)
+	if chunkOffset >= size {
+		return 0, 0, io.EOF
+	}
+	if chunkOffset+chunkHeaderSize > size {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+
+	offset := int64(blockNumber)*seg.blockSize + chunkOffset
+	if !seg.readMapped(bh.header, offset) {
+		if cachedBlock, ok := seg.cachedBlock(blockNumber); ok {
+			copy(bh.header, cachedBlock[chunkOffset:])
+		} else if seg.directIO {
+			// direct reads must read the whole block.
+			if err := seg.readFile(bh.block, blockNumber, size); err != nil {
+				return 0, 0, err
 			}
+			copy(bh.header, bh.block[chunkOffset:])
+		} else if _, err := seg.fd.ReadAt(bh.header, offset); err != nil {
+			return 0, 0, err
 		}
+	}
+
+	length := int64(binary.LittleEndian.Uint16(bh.header[4:6]))
+	if chunkOffset+chunkHeaderSize+length > size {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return length, bh.header[6], nil
+}
 
-		// header
-		copy(bh.header, bh.block[chunkOffset:chunkOffset+chunkHeaderSize])
+// parseChunk returns the payload and the type byte of the chunk at the offset of the block
+// read into bh, the first size bytes of the block are written.
+func (seg *segment) parseChunk(bh *blockAndHeader, blockNumber uint32, chunkOffset, size int64) ([]byte, ChunkType, error) {
+	// header
+	copy(bh.header, bh.block[chunkOffset:chunkOffset+chunkHeaderSize])
 
-		// length
-		length := binary.LittleEndian.Uint16(bh.header[4:6])
+	// length
+	length := binary.LittleEndian.Uint16(bh.header[4:6])
 
-		// copy data
-		start := chunkOffset + chunkHeaderSize
-		result = append(result, bh.block[start:start+int64(length)]...)
+	start := chunkOffset + chunkHeaderSize
+	if start+int64(length) > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 
-		// check sum
-		checksumEnd := chunkOffset + chunkHeaderSize + int64(length)
-		checksum := crc32.ChecksumIEEE(bh.block[chunkOffset+4 : checksumEnd])
-		savedSum := binary.LittleEndian.Uint32(bh.header[:4])
-		if savedSum != checksum {
-			return nil, nil, ErrInvalidCRC
+	// check sum
+	checksumEnd := start + int64(length)
+	checksum := seg.checksumType.sum(bh.block[chunkOffset+4 : checksumEnd])
+	savedSum := binary.LittleEndian.Uint32(bh.header[:4])
+	if savedSum != checksum {
+		return nil, 0, &ChecksumError{
+			SegmentId:   seg.id,
+			BlockNumber: blockNumber,
+			ChunkOffset: chunkOffset,
 		}
+	}
+	return bh.block[start:checksumEnd], bh.header[6], nil
+}
 
-		// type
-		chunkType := bh.header[6]
+// nextChunkOffset returns where the chunk after the one ending at the offset of the block starts.
+func (seg *segment) nextChunkOffset(blockNumber uint32, chunkEnd int64) (uint32, int64) {
+	// If this is the last chunk in the block, and the left block
+	// space are paddings, the next chunk should be in the next block.
+	if chunkEnd+chunkHeaderSize >= seg.blockSize {
+		return blockNumber + 1, 0
+	}
+	return blockNumber, chunkEnd
+}
 
-		if chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
-			nextChunk.BlockNumber = blockNumber
-			nextChunk.ChunkOffset = checksumEnd
-			// If this is the last chunk in the block, and the left block
-			// space are paddings, the next chunk should be in the next block.
-			if checksumEnd+chunkHeaderSize >= blockSize {
-				nextChunk.BlockNumber += 1
-				nextChunk.ChunkOffset = 0
-			}
+// recordCount returns the number of records in the segment file,
+// they are counted by reading the segment file once if unknown.
+func (seg *segment) recordCount() (int64, error) {
+	if seg.records >= 0 {
+		return seg.records, nil
+	}
+	var count int64
+	reader := seg.NewReader()
+	for {
+		if _, _, err := reader.Next(); err == io.EOF {
 			break
+		} else if err != nil {
+			return 0, err
 		}
-		blockNumber += 1
-		chunkOffset = 0
+		count++
+	}
+	seg.records = count
+	return count, nil
+}
+
+// warmCache reads the full blocks of the segment file into the block cache,
+// only the last ones fitting in the cache are read if it is too small.
+func (seg *segment) warmCache() error {
+	if !seg.cached() || seg.verifyOnRead || seg.mapped() {
+		return nil
+	}
+	fullBlocks := int(seg.Size() / seg.blockSize)
+	start := 0
+	if fullBlocks > seg.cache.size {
+		start = fullBlocks - seg.cache.size
+	}
+	for blockNumber := uint32(start); blockNumber < uint32(fullBlocks); blockNumber++ {
+		key := seg.getCacheKey(blockNumber)
+		if seg.cache.Contains(key) {
+			continue
+		}
+		block := make([]byte, seg.blockSize)
+		if err := seg.readFile(block, blockNumber, seg.blockSize); err != nil {
+			return err
+		}
+		seg.cache.Add(key, block)
+	}
+	return nil
+}
+
+// readBlock reads the first size bytes of the block into buf,
+// from the memory mapping of the file or the block cache if possible.
+func (seg *segment) readBlock(buf []byte, blockNumber uint32, size int64) error {
+	offset := int64(blockNumber) * seg.blockSize
+	if seg.trackAccess {
+		seg.lastAccess.Store(time.Now().UnixNano())
+	}
+
+	// the blocks are always read from the file to verify what is on disk.
+	if seg.verifyOnRead {
+		return seg.readFile(buf, blockNumber, size)
+	}
+
+	// older segment files are read from their memory mapping.
+	if seg.readMapped(buf[:size], offset) {
+		return nil
+	}
+
+	// try to read from the cache if it is enabled
+	cached := seg.cached()
+	cachedBlock, ok := seg.cachedBlock(blockNumber)
+	// cache hit, get block from the cache
+	if ok {
+		copy(buf, cachedBlock)
+		return nil
+	}
+
+	// cache miss, read block from the segment file.
+	if err := seg.readFile(buf, blockNumber, size); err != nil {
+		return err
+	}
+	// cache the block, so that the next time it can be read from the cache.
+	// if the block size is smaller than blockSize, it means that the block is not full,
+	// so we will not cache it.
+	if cached && size == seg.blockSize && len(cachedBlock) == 0 {
+		cacheBlock := make([]byte, seg.blockSize)
+		copy(cacheBlock, buf)
+		seg.cache.Add(seg.getCacheKey(blockNumber), cacheBlock)
+	}
+	return nil
+}
+
+// cachedBlock returns the block from the block cache, if it is there.
+func (seg *segment) cachedBlock(blockNumber uint32) ([]byte, bool) {
+	if !seg.cached() {
+		return nil, false
+	}
+	return seg.cache.Get(seg.getCacheKey(blockNumber))
+}
+
+// cached reports whether the blocks of the segment file are read through the block cache.
+func (seg *segment) cached() bool {
+	return seg.cache != nil && (!seg.noActiveCache || seg.sealed.Load())
+}
+
+// trim frees the disk space preallocated after the written chunks.
+func (seg *segment) trim() error {
+	if !seg.preallocated {
+		return nil
+	}
+	if err := seg.fd.Truncate(seg.Size()); err != nil {
+		return err
+	}
+	seg.preallocated = false
+	return nil
+}
+
+// readFile reads the first size bytes of the block into buf from the segment file,
+// direct reads must read the whole block, which is padded by direct writes.
+func (seg *segment) readFile(buf []byte, blockNumber uint32, size int64) error {
+	readSize := size
+	if seg.directIO {
+		readSize = seg.blockSize
+	}
+	n, err := seg.fd.ReadAt(buf[0:readSize], int64(blockNumber)*seg.blockSize)
+	if err != nil && !(err == io.EOF && int64(n) >= size) {
+		return err
+	}
+	return nil
+}
+
+// seal marks the segment as an older one, which is not written anymore.
+func (seg *segment) seal() {
+	seg.sealed.Store(true)
+}
+
+// unseal makes the segment writable again, its mapping is dropped.
+func (seg *segment) unseal() {
+	seg.mmapMu.Lock()
+	defer seg.mmapMu.Unlock()
+	seg.sealed.Store(false)
+	seg.unmapLocked()
+}
+
+// unmap drops the memory mapping of the segment file, it is mapped again by the next read.
+func (seg *segment) unmap() {
+	seg.mmapMu.Lock()
+	defer seg.mmapMu.Unlock()
+	seg.unmapLocked()
+}
+
+// unmapLocked is unmap, with mmapMu held.
+func (seg *segment) unmapLocked() {
+	if seg.mmapData != nil {
+		_ = munmapFile(seg.mmapData)
+		seg.mmapData = nil
 	}
-	return result, nextChunk, nil
+	seg.mmapOnce = sync.Once{}
+}
+
+// mapLocked returns the memory mapping of a sealed segment file if MMapReads is enabled,
+// the file is mapped on the first call. It returns nil if the file can't be mapped,
+// like on 32-bit platforms whose address space is too small, so that it is read normally.
+// mmapMu must be held, for reading at least, as long as the mapping is used.
+func (seg *segment) mapLocked() []byte {
+	if !seg.mmapReads || !seg.sealed.Load() || strconv.IntSize < 64 {
+		return nil
+	}
+	seg.mmapOnce.Do(func() {
+		if size := seg.Size(); size > 0 {
+			if descriptor, ok := fileDescriptor(seg.fd); ok {
+				if data, err := mmapFile(descriptor, size); err == nil {
+					seg.mmapData = data
+				}
+			}
+		}
+	})
+	return seg.mmapData
+}
+
+// mapped reports whether the segment file is read from its memory mapping.
+func (seg *segment) mapped() bool {
+	if !seg.mmapReads || !seg.sealed.Load() {
+		return false
+	}
+	seg.mmapMu.RLock()
+	defer seg.mmapMu.RUnlock()
+	return seg.mapLocked() != nil
+}
+
+// readMapped copies the bytes at the offset of the segment file into buf from its memory mapping,
+// and reports whether they were all mapped. The mapping can't be dropped while it is read.
+func (seg *segment) readMapped(buf []byte, offset int64) bool {
+	if !seg.mmapReads || !seg.sealed.Load() {
+		return false
+	}
+	seg.mmapMu.RLock()
+	defer seg.mmapMu.RUnlock()
+	mapped := seg.mapLocked()
+	if offset+int64(len(buf)) > int64(len(mapped)) {
+		return false
+	}
+	copy(buf, mapped[offset:])
+	return true
 }
 
 func (seg *segment) getCacheKey(blockNumber uint32) uint64 {
@@ -431,11 +1372,30 @@ func (seg *segment) getCacheKey(blockNumber uint32) uint64 {
 }
 
 func (segReader *segmentReader) Next() ([]byte, *ChunkPosition, error) {
-	// The segment file is closed
-	if segReader.segment.closed {
-		return nil, nil, ErrClosed
+	value, chunkPosition, _, err := segReader.nextWithMeta()
+	return value, chunkPosition, err
+}
+
+// hold takes a reference on a segment file whose file may be closed by MaxOpenSegments,
+// for the time of a read, it returns false if the segment file was deleted.
+// The other segment files are held by the reader from its creation.
+func (segReader *segmentReader) hold() bool {
+	return segReader.segment.handles == nil || segReader.segment.acquire()
+}
+
+// unhold releases the reference taken by hold.
+func (segReader *segmentReader) unhold() {
+	if segReader.segment.handles != nil {
+		_ = segReader.segment.release()
 	}
+}
 
+// nextWithMeta is like Next, and also returns how the record is stored.
+func (segReader *segmentReader) nextWithMeta() ([]byte, *ChunkPosition, RecordMeta, error) {
+	if !segReader.hold() {
+		return nil, nil, RecordMeta{}, io.EOF
+	}
+	defer segReader.unhold()
 	// this position describes the current chunk info
 	chunkPosition := &ChunkPosition{
 		SegmentId:   segReader.segment.id,
@@ -443,38 +1403,132 @@ func (segReader *segmentReader) Next() ([]byte, *ChunkPosition, error) {
 		ChunkOffset: segReader.chunkOffset,
 	}
 
-	value, nextChunk, err := segReader.segment.readInternal(
+	value, nextChunk, meta, err := segReader.segment.readInternal(
+		nil,
 		segReader.blockNumber,
 		segReader.chunkOffset,
+		segReader.size,
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, RecordMeta{}, err
 	}
 
 	chunkPosition.ChunkSize =
-		nextChunk.BlockNumber*blockSize + uint32(nextChunk.ChunkOffset) -
-			(segReader.blockNumber*blockSize + uint32(segReader.chunkOffset))
+		nextChunk.BlockNumber*uint32(segReader.segment.blockSize) + uint32(nextChunk.ChunkOffset) -
+			(segReader.blockNumber*uint32(segReader.segment.blockSize) + uint32(segReader.chunkOffset))
 
 	// update the position
 	segReader.blockNumber = nextChunk.BlockNumber
 	segReader.chunkOffset = nextChunk.ChunkOffset
+	segReader.prefetch()
+
+	return value, chunkPosition, meta, nil
+}
+
+// nextRawChunk returns the next physical chunk of the segment file, without reassembling the record.
+func (segReader *segmentReader) nextRawChunk() (RawChunk, *ChunkPosition, error) {
+	if !segReader.hold() {
+		return RawChunk{}, nil, io.EOF
+	}
+	defer segReader.unhold()
+	seg := segReader.segment
+	if seg.refs.Load() <= 0 {
+		return RawChunk{}, nil, ErrClosed
+	}
+	bh := seg.getBlock()
+	defer seg.putBlock(bh)
+
+	data, typeByte, err := seg.readChunk(bh, segReader.blockNumber, segReader.chunkOffset, segReader.size)
+	if err != nil {
+		return RawChunk{}, nil, err
+	}
+	chunkPosition := &ChunkPosition{
+		SegmentId:   seg.id,
+		BlockNumber: segReader.blockNumber,
+		ChunkOffset: segReader.chunkOffset,
+		ChunkSize:   chunkHeaderSize + uint32(len(data)),
+	}
+	segReader.blockNumber, segReader.chunkOffset =
+		seg.nextChunkOffset(segReader.blockNumber, segReader.chunkOffset+chunkHeaderSize+int64(len(data)))
 
-	return value, chunkPosition, nil
+	chunk := RawChunk{
+		Type:  typeByte & chunkTypeMask,
+		Flags: typeByte &^ chunkTypeMask,
+		Data:  append([]byte(nil), data...),
+	}
+	return chunk, chunkPosition, nil
 }
 
+// nextPosition returns the position of the next record, reading only the headers of its chunks.
+func (segReader *segmentReader) nextPosition() (*ChunkPosition, error) {
+	if !segReader.hold() {
+		return nil, io.EOF
+	}
+	defer segReader.unhold()
+	seg := segReader.segment
+	if seg.refs.Load() <= 0 {
+		return nil, ErrClosed
+	}
+	bh := seg.getBlock()
+	defer seg.putBlock(bh)
+
+	blockNumber, chunkOffset := segReader.blockNumber, segReader.chunkOffset
+	for first := true; ; first = false {
+		length, typeByte, err := seg.readChunkHeader(bh, blockNumber, chunkOffset, segReader.size)
+		// the file ends in the middle of a record spanning several blocks.
+		if err == io.EOF && !first {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		blockNumber, chunkOffset = seg.nextChunkOffset(blockNumber, chunkOffset+chunkHeaderSize+length)
+		if chunkType := typeByte & chunkTypeMask; chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
+			break
+		}
+	}
+
+	blockSize := uint32(seg.blockSize)
+	chunkPosition := &ChunkPosition{
+		SegmentId:   seg.id,
+		BlockNumber: segReader.blockNumber,
+		ChunkOffset: segReader.chunkOffset,
+		ChunkSize: blockNumber*blockSize + uint32(chunkOffset) -
+			(segReader.blockNumber*blockSize + uint32(segReader.chunkOffset)),
+	}
+	segReader.blockNumber, segReader.chunkOffset = blockNumber, chunkOffset
+	return chunkPosition, nil
+}
+
+// Compare orders the positions by segment id, then block number, then chunk offset.
+// It returns -1 if cp is before other, 0 if they are the same position, +1 if cp is after other.
+func (cp *ChunkPosition) Compare(other *ChunkPosition) int {
+	if cp.SegmentId != other.SegmentId {
+		return cmp.Compare(cp.SegmentId, other.SegmentId)
+	}
+	if cp.BlockNumber != other.BlockNumber {
+		return cmp.Compare(cp.BlockNumber, other.BlockNumber)
+	}
+	return cmp.Compare(cp.ChunkOffset, other.ChunkOffset)
+}
+
+// Encode encodes the position in a few bytes, which are decoded by DecodeChunkPosition.
+// The layout is versioned, so the positions stored by a version of the WAL are decoded by the next ones.
 func (cp *ChunkPosition) Encode() []byte {
 	return cp.encode(true)
 }
 
+// EncodeFixedSize encodes the position like Encode, padded with zeros to the same size for every position.
 func (cp *ChunkPosition) EncodeFixedSize() []byte {
 	return cp.encode(false)
 }
 
 // encode the chunk position to a byte slice.
 func (cp *ChunkPosition) encode(shrink bool) []byte {
-	buf := make([]byte, maxLen)
+	buf := make([]byte, positionHeaderLen+maxLen)
+	buf[0], buf[1] = positionTag, positionVersion
 
-	var index = 0
+	var index = positionHeaderLen
 	// SegmentId
 	index += binary.PutUvarint(buf[index:], uint64(cp.SegmentId))
 	// BlockNumber
@@ -490,29 +1544,38 @@ func (cp *ChunkPosition) encode(shrink bool) []byte {
 	return buf
 }
 
-func DecodeChunkPosition(buf []byte) *ChunkPosition {
+// DecodeChunkPosition decodes a position encoded by Encode or EncodeFixedSize,
+// ErrInvalidPosition is returned if the bytes are not a position of a known version.
+func DecodeChunkPosition(buf []byte) (*ChunkPosition, error) {
 	if len(buf) == 0 {
-		return nil
+		return nil, ErrInvalidPosition
+	}
+	if buf[0] == positionTag {
+		if len(buf) < positionHeaderLen || buf[1] != positionVersion {
+			return nil, ErrInvalidPosition
+		}
+		buf = buf[positionHeaderLen:]
 	}
 
+	var fields [4]uint64
 	var index = 0
-	// SegmentId
-	segmentId, n := binary.Uvarint(buf[index:])
-	index += n
-	// BlockNumber
-	blockNumber, n := binary.Uvarint(buf[index:])
-	index += n
-	// ChunkOffset
-	chunkOffset, n := binary.Uvarint(buf[index:])
-	index += n
-	// ChunkSize
-	chunkSize, n := binary.Uvarint(buf[index:])
-	index += n
+	// SegmentId, BlockNumber, ChunkOffset and ChunkSize.
+	for i := range fields {
+		value, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, ErrInvalidPosition
+		}
+		fields[i] = value
+		index += n
+	}
+	if fields[0] > math.MaxUint32 || fields[1] > math.MaxUint32 || fields[2] > math.MaxInt64 || fields[3] > math.MaxUint32 {
+		return nil, ErrInvalidPosition
+	}
 
 	return &ChunkPosition{
-		SegmentId:   uint32(segmentId),
-		BlockNumber: uint32(blockNumber),
-		ChunkOffset: int64(chunkOffset),
-		ChunkSize:   uint32(chunkSize),
-	}
+		SegmentId:   uint32(fields[0]),
+		BlockNumber: uint32(fields[1]),
+		ChunkOffset: int64(fields[2]),
+		ChunkSize:   uint32(fields[3]),
+	}, nil
 }
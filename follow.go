@@ -0,0 +1,133 @@
+package wal
+
+import (
+	"context"
+	"io"
+)
+
+// Record is a record sent by Follow, with its position.
+type Record struct {
+	Pos  *ChunkPosition
+	Data []byte
+}
+
+// Follow sends the records from start, or from the first one if start is nil, then the new
+// records as they are written, like tail -f, until ctx is done. It waits for the writes
+// rather than polling. The records are sent once written to the segment file, they are
+// synced or not according to DiskFlushSync and BytesPerSync.
+// After Reset, Compact or TruncateTail, it sends the records again from the first one.
+//
+// When it stops, the error channel gets ctx.Err() or the error of a read, then both channels
+// are closed. The sharded WALs return ErrShardsUnsupported.
+func (wal *WAL) Follow(ctx context.Context, start *ChunkPosition) (<-chan Record, <-chan error) {
+	records := make(chan Record)
+	errs := make(chan error, 1)
+	if wal.shards != nil {
+		errs <- ErrShardsUnsupported
+		close(records)
+		close(errs)
+		return records, errs
+	}
+	go func() {
+		defer close(errs)
+		defer close(records)
+		errs <- wal.follow(ctx, start, records)
+	}()
+	return records, errs
+}
+
+// follow sends the records to the channel until ctx is done or a read fails.
+// It keeps one reader, extended after every write with the records written since.
+func (wal *WAL) follow(ctx context.Context, start *ChunkPosition, records chan<- Record) error {
+	reader, generation := wal.newFollowReader()
+	defer func() { reader.Close() }()
+	if start != nil {
+		if err := reader.skipTo(start, false); err != nil {
+			return err
+		}
+	}
+	for {
+		// taken before reading, so that a record written after the read wakes it up.
+		written := wal.waitWritten()
+		if !wal.extendFollowReader(reader, generation) {
+			// the records were removed or rewritten, it starts again from the first one.
+			reader.Close()
+			reader, generation = wal.newFollowReader()
+		}
+
+		for {
+			data, pos, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			select {
+			case records <- Record{Pos: pos, Data: data}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newFollowReader returns a reader of all the records, and the generation of the WAL it reads.
+func (wal *WAL) newFollowReader() (*Reader, uint64) {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	return wal.newReaderLocked(0), wal.generation
+}
+
+// extendFollowReader makes the records written after the reader was created or last extended
+// visible to it, and returns false if the WAL is not at the generation of the reader anymore.
+// Only the segment files rotated in since are looked up, so it is O(1) between the rotations.
+func (wal *WAL) extendFollowReader(r *Reader, generation uint64) bool {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.generation != generation {
+		return false
+	}
+
+	var lastID SegSerialID
+	if n := len(r.segmentReaders); n > 0 {
+		last := r.segmentReaders[n-1]
+		last.size = last.segment.Size()
+		lastID = last.segment.id
+		// read the rest of the last segment file, which was read to its end.
+		if r.currentReader == n {
+			r.currentReader = n - 1
+		}
+	}
+	if wal.activeSegment == nil || wal.activeSegment.id <= lastID {
+		return true
+	}
+	for _, segment := range wal.sortedSegments() {
+		if segment.id > lastID && segment.acquireForReader() {
+			r.segmentReaders = append(r.segmentReaders, segment.NewReader())
+		}
+	}
+	return true
+}
+
+// waitWritten returns a channel closed by the next write.
+func (wal *WAL) waitWritten() <-chan struct{} {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	wal.writeFollowed.Store(true)
+	return wal.written
+}
+
+// notifyWritten wakes up the Follow calls waiting for a write. The WAL must be locked.
+func (wal *WAL) notifyWritten() {
+	if wal.writeFollowed.Swap(false) {
+		close(wal.written)
+		wal.written = make(chan struct{})
+	}
+}
@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"io"
+	"os"
+)
+
+// FS is the file system where the WAL directory and its segment files are,
+// it is set by Options.FS, OSFS is used if it is nil.
+//
+// A directory is synced by opening it with OpenFile(dirPath, os.O_RDONLY, 0) and calling Sync.
+// Memory mapping, preallocation, direct I/O and the directory lock are only done for the
+// files with a Fd() uintptr method, like *os.File, they are skipped for the others.
+type FS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// File is a file opened by FS, *os.File implements it.
+type File interface {
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSFS is the FS of the operating system, based on the os package.
+type OSFS struct{}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoid a non-nil File holding a nil *os.File.
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// fileDescriptor returns the descriptor of the file if it is an operating system file.
+func fileDescriptor(fd File) (uintptr, bool) {
+	if mirrored, ok := fd.(*mirroredFile); ok {
+		fd = mirrored.File
+	}
+	f, ok := fd.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, false
+	}
+	return f.Fd(), true
+}
+
+// dirPerm returns the permission of the WAL directory, dirModePerm if DirPerm is 0.
+func (options Options) dirPerm() os.FileMode {
+	if options.DirPerm == 0 {
+		return dirModePerm
+	}
+	return options.DirPerm
+}
+
+// filePerm returns the permission of the segment files, fileModePerm if FilePerm is 0.
+func (options Options) filePerm() os.FileMode {
+	if options.FilePerm == 0 {
+		return fileModePerm
+	}
+	return options.FilePerm
+}
+
+// fs returns the file system of the WAL.
+func (options Options) fs() FS {
+	if options.FS != nil {
+		return options.FS
+	}
+	return OSFS{}
+}
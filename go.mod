@@ -3,6 +3,8 @@ module github.com/kuentra-official/wal
 go 1.22.2
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/golang/snappy v1.0.0
 	github.com/hashicorp/golang-lru/v2 v2.0.7
 	github.com/stretchr/testify v1.9.0
 	github.com/valyala/bytebufferpool v1.0.0
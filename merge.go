@@ -0,0 +1,318 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// mergeManifestName is the file recording the ids of the segment files being merged,
+// from the moment the merged segment file is complete until the old ones are deleted.
+const mergeManifestName = "MERGE"
+
+// mergeFileExt returns the extension of the segment files written by the merge on Open,
+// before they replace the merged ones.
+func mergeFileExt(extName string) string {
+	return ".merge" + extName
+}
+
+// mergedRecord is the old and the new position of a record moved by the merge.
+type mergedRecord struct {
+	oldPos, newPos *ChunkPosition
+}
+
+// mergeSmallSegments finishes the merge interrupted by a crash, then merges the runs of
+// consecutive older segment files smaller than MergeSmallSegmentsOnOpen. The directory is locked.
+//
+// A run is written to a temporary segment file, which is synced, then the manifest is written
+// with the first and the last id of the run. It is the commit point: the temporary files without
+// a manifest are deleted, and a manifest is replayed by renaming the temporary file over the
+// first segment file of the run and deleting the others, before the manifest itself is deleted.
+// A file skipped as not a segment file ends the run, so that a run never spans a file it didn't read.
+func mergeSmallSegments(options Options) error {
+	if err := recoverMerge(options); err != nil {
+		return err
+	}
+	if options.MergeSmallSegmentsOnOpen <= 0 {
+		return nil
+	}
+	segmentIDs, err := listSegmentIDs(options, options.DiskFileExtension)
+	if err != nil {
+		return err
+	}
+	// the last segment file is the active one.
+	if len(segmentIDs) > 0 {
+		segmentIDs = segmentIDs[:len(segmentIDs)-1]
+	}
+
+	var run []*segment
+	var runSize int64
+	closeRun := func() {
+		for _, segment := range run {
+			_ = segment.Close()
+		}
+		run, runSize = nil, 0
+	}
+	defer closeRun()
+	flush := func() error {
+		if len(run) > 1 {
+			if err := mergeRun(options, run); err != nil {
+				return err
+			}
+		}
+		closeRun()
+		return nil
+	}
+	for _, id := range segmentIDs {
+		segment, err := openSegmentFile(options, uint32(id), nil)
+		// the file skipped ends the run, which would delete it otherwise.
+		if errors.Is(err, ErrNotSegmentFile) {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		size := segment.Size()
+		if size >= options.MergeSmallSegmentsOnOpen {
+			_ = segment.Close()
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if runSize+size > options.SegmentSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		run = append(run, segment)
+		runSize += size
+	}
+	return flush()
+}
+
+// mergeRun writes the records of the segment files into a temporary segment file,
+// and replaces them with it.
+func mergeRun(options Options, run []*segment) (err error) {
+	tmpOptions := options
+	tmpOptions.DiskFileExtension = mergeFileExt(options.DiskFileExtension)
+	first, last := run[0].id, run[len(run)-1].id
+
+	merged, err := openSegmentFile(tmpOptions, first, nil)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if err != nil && !committed {
+			_ = merged.Remove()
+		}
+	}()
+	var moved []mergedRecord
+	for _, segment := range run {
+		reader := segment.NewReader()
+		for {
+			data, pos, meta, err := reader.nextWithMeta()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return segmentError("merge", segment.id, err)
+			}
+			newPos, err := merged.writeRecord(data, meta.Type, meta.Time)
+			if err != nil {
+				return segmentError("merge", first, err)
+			}
+			moved = append(moved, mergedRecord{oldPos: pos, newPos: newPos})
+		}
+	}
+	if err := merged.Sync(); err != nil {
+		return err
+	}
+	if err := merged.Close(); err != nil {
+		return err
+	}
+	// the merged segment files are renamed over and deleted, which fails on Windows if they are open.
+	for _, segment := range run {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+	if err := writeMergeManifest(options, first, last); err != nil {
+		return err
+	}
+	// the merge is committed, the next Open finishes it on a failure.
+	committed = true
+	if err := finishMerge(options, first, last); err != nil {
+		return err
+	}
+	if options.OnMergeRemap != nil {
+		for _, record := range moved {
+			options.OnMergeRemap(record.oldPos, record.newPos)
+		}
+	}
+	return nil
+}
+
+// writeMergeManifest writes the manifest of the merge of the segment files from first to last.
+func writeMergeManifest(options Options, first, last SegSerialID) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[:4], first)
+	binary.BigEndian.PutUint32(buf[4:], last)
+	return writeManifest(options, mergeManifestName, buf)
+}
+
+// writeManifest writes the manifest file of the name in the directory through a temporary file
+// renamed into place, so that it is never read partially written.
+func writeManifest(options Options, manifestName string, buf []byte) error {
+	fs := options.fs()
+	name := filepath.Join(options.DirPath, manifestName)
+	fd, err := fs.OpenFile(name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, options.filePerm())
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(buf); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return syncDir(fs, options.DirPath)
+}
+
+// recoverMerge finishes the merge recorded by the manifest, if any,
+// and deletes the temporary files of an uncommitted merge.
+func recoverMerge(options Options) error {
+	fs := options.fs()
+	name := filepath.Join(options.DirPath, mergeManifestName)
+	buf, err := readManifest(options, mergeManifestName)
+	if err != nil {
+		return err
+	}
+	if buf != nil {
+		if len(buf) < 8 {
+			return fmt.Errorf("read %s failed: %w", name, io.ErrUnexpectedEOF)
+		}
+		first, last := binary.BigEndian.Uint32(buf[:4]), binary.BigEndian.Uint32(buf[4:])
+		if err := finishMerge(options, first, last); err != nil {
+			return err
+		}
+	}
+
+	tmpExt := mergeFileExt(options.DiskFileExtension)
+	if err := removeSegmentFiles(options, tmpExt); err != nil {
+		return err
+	}
+	if options.MirrorDirPath != "" {
+		if err := removeSegmentFiles(options.mirrorOptions(), tmpExt); err != nil {
+			return err
+		}
+	}
+	_ = fs.Remove(name + ".tmp")
+	return nil
+}
+
+// readManifest returns the content of the manifest file of the name in the directory,
+// nil if there is none.
+func readManifest(options Options, manifestName string) ([]byte, error) {
+	fs := options.fs()
+	name := filepath.Join(options.DirPath, manifestName)
+	// the directory is listed rather than opening the manifest, which is rarely there.
+	entries, err := fs.ReadDir(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	var found bool
+	for _, entry := range entries {
+		if entry.Name() == manifestName {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	fd, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, info.Size())
+	if _, err := io.ReadFull(io.NewSectionReader(fd, 0, info.Size()), buf); err != nil {
+		return nil, fmt.Errorf("read %s failed: %w", name, err)
+	}
+	return buf, nil
+}
+
+// finishMerge replaces the segment files from first to last with the merged one,
+// and deletes the manifest. It is replayed after a crash, so every step may be done already.
+func finishMerge(options Options, first, last SegSerialID) error {
+	fs := options.fs()
+	ext := options.DiskFileExtension
+	tmpExt := mergeFileExt(ext)
+	err := fs.Rename(options.segmentFileName(tmpExt, first), options.segmentFileName(ext, first))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := options.renameMirror(first, tmpExt, ext); err != nil {
+		return err
+	}
+	// the checksum file is the one of the old content.
+	if err := removeIfExists(fs, options.segmentFileName(ext, first)+checksumFileExt); err != nil {
+		return err
+	}
+
+	segmentIDs, err := listSegmentIDs(options, ext)
+	if err != nil {
+		return err
+	}
+	for _, id := range segmentIDs {
+		if SegSerialID(id) <= first || SegSerialID(id) > last {
+			continue
+		}
+		name := options.segmentFileName(ext, uint32(id))
+		if err := removeIfExists(fs, name+checksumFileExt); err != nil {
+			return err
+		}
+		if options.MirrorDirPath != "" {
+			if err := removeIfExists(fs, options.mirrorOptions().segmentFileName(ext, uint32(id))); err != nil {
+				return err
+			}
+		}
+		if err := removeIfExists(fs, name); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(fs, options.DirPath); err != nil {
+		return err
+	}
+	if err := fs.Remove(filepath.Join(options.DirPath, mergeManifestName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(fs, options.DirPath)
+}
+
+// removeIfExists deletes the file, a missing file is ignored.
+func removeIfExists(fs FS, name string) error {
+	if err := fs.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
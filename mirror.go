@@ -0,0 +1,143 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mirroredFile is a segment file with a copy in MirrorDirPath, the writes, syncs and
+// truncations go to both files, while the reads are served by the segment file.
+type mirroredFile struct {
+	File
+	mirror File
+}
+
+func (f *mirroredFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := f.mirror.Write(p); err != nil {
+		return n, f.mirrorError(err)
+	}
+	return n, nil
+}
+
+func (f *mirroredFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	if _, err := f.mirror.WriteAt(p, off); err != nil {
+		return n, f.mirrorError(err)
+	}
+	return n, nil
+}
+
+func (f *mirroredFile) Sync() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	return f.mirrorError(f.mirror.Sync())
+}
+
+func (f *mirroredFile) Truncate(size int64) error {
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	return f.mirrorError(f.mirror.Truncate(size))
+}
+
+func (f *mirroredFile) Close() error {
+	err := f.File.Close()
+	if mirrorErr := f.mirror.Close(); err == nil {
+		err = f.mirrorError(mirrorErr)
+	}
+	return err
+}
+
+// mirrorError tells the errors of the mirror file from the ones of the segment file.
+func (f *mirroredFile) mirrorError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("mirror %s: %w", f.mirror.Name(), err)
+}
+
+// mirrorOptions returns the options of the segment files in MirrorDirPath.
+func (options Options) mirrorOptions() Options {
+	options.DirPath = options.MirrorDirPath
+	options.MirrorDirPath = ""
+	return options
+}
+
+// openMirror opens the mirror of the segment file with the flag, and copies the segment file
+// to it if their sizes differ, like a mirror added to an existing WAL or cut short by a crash.
+func openMirror(options Options, fd File, id SegSerialID, flag int) (File, error) {
+	name := options.mirrorOptions().segmentFileName(options.DiskFileExtension, id)
+	// the mirror is not read, the page cache is fine. A missing mirror is created, and copied below.
+	mirror, err := options.fs().OpenFile(name, flag&^oDirect|os.O_CREATE, options.filePerm())
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = mirror.Close()
+		return nil, err
+	}
+	mirrorStat, err := mirror.Stat()
+	if err != nil {
+		_ = mirror.Close()
+		return nil, err
+	}
+	if stat.Size() != mirrorStat.Size() {
+		if err := mirror.Truncate(0); err != nil {
+			_ = mirror.Close()
+			return nil, err
+		}
+		if _, err := io.Copy(mirror, io.NewSectionReader(fd, 0, stat.Size())); err != nil {
+			_ = mirror.Close()
+			return nil, err
+		}
+	}
+	return &mirroredFile{File: fd, mirror: mirror}, nil
+}
+
+// readMirror reads the block from the mirror of the segment file into buf,
+// it reports whether the segment file has a mirror and the block was read.
+func (seg *segment) readMirror(buf []byte, blockNumber uint32, size int64) bool {
+	f, ok := seg.fd.(*mirroredFile)
+	if !ok {
+		return false
+	}
+	n, err := f.mirror.ReadAt(buf[:size], int64(blockNumber)*seg.blockSize)
+	return int64(n) == size && (err == nil || err == io.EOF)
+}
+
+// removeMirror deletes the mirror of the segment file, if it has one.
+func (seg *segment) removeMirror() error {
+	f, ok := seg.fd.(*mirroredFile)
+	if !ok {
+		return nil
+	}
+	if err := seg.fs.Remove(f.mirror.Name()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// renameMirror renames the mirror of the segment file with the id from an extension to
+// another one, like the segment file itself. A missing mirror is ignored.
+func (options Options) renameMirror(id SegSerialID, from, to string) error {
+	if options.MirrorDirPath == "" {
+		return nil
+	}
+	mirror := options.mirrorOptions()
+	err := options.fs().Rename(mirror.segmentFileName(from, id), mirror.segmentFileName(to, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
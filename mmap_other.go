@@ -0,0 +1,13 @@
+//go:build !unix
+
+package wal
+
+import "errors"
+
+func mmapFile(fd uintptr, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package wal
+
+import "syscall"
+
+func mmapFile(fd uintptr, size int64) ([]byte, error) {
+	return syscall.Mmap(int(fd), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
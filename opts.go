@@ -1,22 +1,235 @@
 package wal
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 type Options struct {
 	//File Directory Path
 	DirPath string
 	// SegmentSize specifies the maximum size of each segment file in bytes.
+	// It must be at least the block size.
 	SegmentSize int64
+	// SegmentSizeFunc returns the size of every new segment file, overriding SegmentSize, with
+	// the id of the segment file before it, 0 for the first one. The size is recorded in the header
+	// of the segment file, so it is rotated at the same size after a reopen. SegmentSize still
+	// bounds the size of a record or a batch, and applies to the segment files written without it.
+	SegmentSizeFunc func(prevID SegSerialID) int64
+	// BlockSize is the size of the blocks the records are framed into, a power of two
+	// between 1KB and 64KB, 32KB if it is 0. It is recorded in the header of every segment file,
+	// Open returns ErrBlockSizeMismatch if the existing ones were written with another block size.
+	BlockSize uint32
 	// When Flush Disk Logic
 	// true is waits for disk flush, safe and slow
 	// false is only waits for buffer cache, non-safe and fast
 	DiskFlushSync bool
+	// The active segment file is synced before a new one replaces it because it is full.
+	// NoSyncOnRotate skips this sync, the tail of the old segment file is then only in the OS buffer
+	// cache after the rotation, and may be lost on a crash unless DiskFlushSync or BytesPerSync already synced it.
+	NoSyncOnRotate bool
+	// AsyncRotateSync makes the sync of the rotation run in a background goroutine, so the rotation
+	// returns right away and the writes go on in the new segment file. The tail of the old segment
+	// file may be lost on a crash until it is synced, and a failed sync is only returned by Close.
+	// A segment file is synced before it is deleted, and they are all synced before Close returns.
+	AsyncRotateSync bool
+	// MinFreeBytes makes the writes fail with ErrNoSpace before writing anything when the free
+	// disk space of DirPath is below it, it is read by statfs before every write, Linux and macOS only.
+	// The writes and the syncs failing because the disk is full return an error wrapping ErrNoSpace
+	// anyway. 0 means no check.
+	MinFreeBytes int64
+	// TruncatePartialTail makes Open truncate the last segment file, formerly the active one,
+	// at its first corrupted or incomplete chunk, like the one left by a crash in the middle
+	// of a write, so that it is read to the end and appended right after its last valid record.
+	// The other segment files are left untouched, see Repair. TruncatedTail returns the bytes
+	// truncated. It is ignored with ReadOnly.
+	TruncatePartialTail bool
+	// MergeSmallSegmentsOnOpen makes Open merge the runs of consecutive older segment files smaller
+	// than it into one segment file each, up to SegmentSize, which takes the id of the first one.
+	// The records keep their order, but move to new positions, reported by OnMergeRemap.
+	// A merge interrupted by a crash is finished or undone by the next Open. It is ignored with
+	// ReadOnly, and must not be set with Shards or RequireContiguousSegments. 0 disables it.
+	MergeSmallSegmentsOnOpen int64
+	// OnMergeRemap is called by Open with the old and the new position of every record
+	// moved by MergeSmallSegmentsOnOpen, once its segment files are merged.
+	OnMergeRemap func(oldPos, newPos *ChunkPosition)
+	// SyncDirOnCreate syncs the WAL directory after a new segment file is created, by Open,
+	// a rotation or OpenNewActiveSegment, so that the file itself survives a crash.
+	// It costs an extra sync per new segment file, and directories can't be synced on Windows.
+	SyncDirOnCreate bool
 	// Depending on the settings, the amount of data written at one time is determined. If set too high, there is a risk of collision.
 	BytesPerSync uint32
+	// SyncInterval syncs the active segment file every interval in a background goroutine,
+	// which is stopped by Close. It bounds the data lost on a crash by time
+	// without a sync per write. No goroutine is started if it is zero.
+	SyncInterval time.Duration
+	// MaxSyncDelay makes a write sync the active segment file if it was last synced more than
+	// MaxSyncDelay ago, without a background goroutine unlike SyncInterval. With BytesPerSync,
+	// it bounds the unsynced data by both size and time, as long as writes keep coming. 0 disables it.
+	MaxSyncDelay time.Duration
+	// MaxSegmentAge rotates the active segment file on write once it is older than it, even if it is not full.
+	// The age of a segment file reopened by Open is counted from its last modification. 0 means size-only rotation.
+	MaxSegmentAge time.Duration
+	// MaxSegments is the maximum number of segment files, the active one included.
+	// After a rotation, the oldest segment files beyond it are deleted. 0 means unlimited.
+	MaxSegments int
+	// MaxTotalSize is the maximum size in bytes of all the segment files, the active one included.
+	// After a rotation, the oldest segment files are deleted until the size is within it,
+	// the stricter of MaxSegments and MaxTotalSize applies. 0 means unlimited.
+	MaxTotalSize int64
+	// OnSegmentEvicted is called with the id of every segment file deleted because of MaxSegments or MaxTotalSize.
+	// It is called with the WAL locked, so it must not call the WAL methods.
+	OnSegmentEvicted func(id SegSerialID)
+	// OnRotate is called with the ids of the old and the new active segment after every rotation,
+	// including OpenNewActiveSegment. It is called with the WAL locked, so it must not call the WAL methods.
+	OnRotate func(oldID, newID SegSerialID)
+	// OnSyncLatency is called with the duration of every sync of a segment file by the WAL,
+	// by Sync, the writes and the rotations. It is called with the WAL locked, so it must not call the WAL methods.
+	OnSyncLatency func(d time.Duration)
+	// OnRotateLatency is called with the duration of every rotation, the sync of the old
+	// active segment file and the creation of the new one included.
+	// It is called with the WAL locked, so it must not call the WAL methods.
+	OnRotateLatency func(d time.Duration)
+	// OnWrite is called with the position and the data of every record written by Write,
+	// WriteWithType, WriteAll and Flush, once it is appended. WriteFrom calls it only if it reads
+	// the record into memory, with a Compressor or a Cipher. It is called with the WAL locked,
+	// so it must not call the WAL methods, and must not keep data after it returns.
+	OnWrite func(pos *ChunkPosition, data []byte)
+	// OnRead is called with the position and the data of every record read by Read and ReadInto,
+	// not by the readers. It must not keep data after it returns, which may be reused by the caller.
+	OnRead func(pos *ChunkPosition, data []byte)
+	// MirrorDirPath keeps a copy of every segment file in another directory, like on another disk,
+	// with the same ids and positions: the writes, syncs, truncations and deletions of a segment
+	// file are done on its copy too. The reads are served by DirPath, a chunk failing the checksum
+	// is read again from the copy. Open copies a segment file to MirrorDirPath if its copy has
+	// another size. The checksum files of SegmentFooterChecksum are not copied.
+	MirrorDirPath string
+	// DirectIO opens the segment files with O_DIRECT to bypass the page cache, Linux only.
+	// Every write rewrites the block it starts in and is padded with zeros to whole blocks,
+	// so writes are aligned to BlockSize in memory address, file offset and length.
+	// A segment file falls back to buffered I/O if its file system doesn't support O_DIRECT.
+	DirectIO bool
+	// Preallocate reserves SegmentSize bytes of disk space for every new segment file,
+	// to reduce the fragmentation and get ENOSPC early. It is done by fallocate with
+	// FALLOC_FL_KEEP_SIZE on Linux, and ignored on the other platforms and the file systems
+	// not supporting it. The file size still grows with the written chunks.
+	Preallocate bool
+	// TrimPreallocated frees the unused preallocated space of a segment file
+	// when it is rotated or closed.
+	TrimPreallocated bool
+	// VerifyOnRead reads every block from the segment file, bypassing BlockCache and MMapReads,
+	// so that the checksums are verified against the data on disk rather than a cached copy.
+	// The chunk checksums are always verified by reads, a mismatch returns a *ChecksumError.
+	VerifyOnRead bool
+	// AllowBatchSpanSegments writes a batch of WriteAll, Flush or Batch.Commit larger than SegmentSize
+	// across several segment files, rotating the active one as needed, instead of returning
+	// ErrPendingSizeTooLarge. Such a batch isn't atomic, a record alone still must fit in a segment file.
+	AllowBatchSpanSegments bool
+	// SegmentFooterChecksum writes the checksum of a segment file when it is rotated or closed, to a
+	// checksum file named after it with ".crc" appended, which VerifySegment compares it with.
+	// The active segment file has no checksum until it is closed.
+	SegmentFooterChecksum bool
+	// StoreTimestamps stores the write time of every record with it, it is returned
+	// in RecordMeta.Time and used by NewReaderFromTime. It takes 8 more bytes per record,
+	// the records written without it have a zero Time.
+	StoreTimestamps bool
+	// RequireContiguousSegments makes Open fail with ErrSegmentMissing, naming the missing id,
+	// if there is a gap between the ids of the segment files, like a file deleted by hand.
+	// The segment files before the oldest one, deleted by TruncateHead or MaxSegments, are not missing.
+	// The empty older segment files, with no chunk or not even a header, are kept rather than deleted
+	// by Open, which would leave a gap.
+	RequireContiguousSegments bool
+	// NoInitialSegment makes Open leave an empty directory without any segment file,
+	// the initial segment file is created by the first write, or OpenNewActiveSegment.
+	// Until then, ActiveSegmentID returns 0, IsEmpty returns true and Sync does nothing.
+	NoInitialSegment bool
+	// Shards is the number of active segment files written concurrently, each one with its own lock.
+	// Write picks a shard in round-robin order, WriteToShard by a key, and a batch is written to one shard.
+	// The shard i of n writes the segment files with the ids 1+i, 1+i+n..., the readers read the segment
+	// files of all shards by id. MaxSegments, MaxTotalSize and BlockCache apply to every shard. It must not change
+	// across reopens. OpenNewActiveSegment, TruncateTail, TruncateHead, Compact, RenameFileExt
+	// and LastPosition return ErrShardsUnsupported. 0 or 1 means a single active segment file.
+	Shards int
+	// shardIndex and shardCount are set for the shards of a sharded WAL.
+	shardIndex int
+	shardCount int
+	// ReadOnly opens the existing segment files read-only, without locking the directory,
+	// so that a WAL owned by another process can be read safely.
+	// Open returns ErrEmpty if there is no segment file, and the methods
+	// writing or deleting anything return ErrReadOnly.
+	ReadOnly bool
+	// MMapReads serves the reads of the older segment files from a read-only memory mapping
+	// instead of a pread per block, the active segment file is still read through BlockCache.
+	// A file is mapped on its first read and unmapped when it is closed, and read normally
+	// if it can't be mapped. The mapped segments must not be truncated while they are read.
+	MMapReads bool
+	// FileNameFunc returns the path of the segment file with the id and the extension,
+	// SegmentFileName is used if it is nil. The extension is not always DiskFileExtension,
+	// like the temporary files of Compact and the new extension of RenameFileExt.
+	// It must be set with ParseIDFunc, which must accept the names it returns.
+	FileNameFunc func(dirPath, ext string, id SegSerialID) string
+	// ParseIDFunc returns the id of a segment file from its name in the directory,
+	// false means the file is not a segment file with the extension.
+	// ParseSegmentID is used if it is nil.
+	ParseIDFunc func(name, ext string) (SegSerialID, bool)
+	// NextIDFunc returns the id of the segment file created after the one with the id prev,
+	// 0 for the first one, like a node prefix followed by a sequence number. It is prev+1
+	// if it is nil. The ids must increase, and fit in the 9 or 10 digits of the file names,
+	// RequireContiguousSegments follows it. It must not be set with Shards.
+	NextIDFunc func(prev SegSerialID) SegSerialID
+	// DirPerm is the permission of the WAL directory when Open creates it, 0755 if it is 0.
+	DirPerm os.FileMode
+	// FilePerm is the permission of the new segment files, 0644 if it is 0.
+	FilePerm os.FileMode
+	// FS is the file system of the WAL directory, OSFS is used if it is nil.
+	FS FS
 	// Split Seg File Extension
 	DiskFileExtension string
 	// add BlockCache
 	BlockCache uint32
+	// ReadAhead makes the readers prefetch up to ReadAhead blocks after their position into the
+	// block cache in the background, to speed up the sequential reads of Next. It needs BlockCache
+	// or BlockCacheEntries, at most half of the cache is prefetched by a reader. 0 means disabled.
+	ReadAhead int
+	// NoActiveSegmentCache keeps the blocks of the active segment file out of the block cache,
+	// only the older segment files are cached, so that the reads of the records just written
+	// don't evict the older blocks. The active segment file is cached by default.
+	NoActiveSegmentCache bool
+	// BlockCacheEntries sets the size of the block cache in blocks of BlockSize rather than bytes,
+	// it must not be set together with BlockCache.
+	BlockCacheEntries int
+	// MaxOpenSegments keeps at most MaxOpenSegments older segment files open, besides the active one,
+	// for the WALs with more segment files than file descriptors. The least recently read ones are
+	// closed, and opened again by the reads. The readers only hold the segment file they read, so a
+	// segment file deleted before a reader gets to it is not read. The reverse readers hold them all.
+	// Open still opens every segment file once. It applies to every shard. 0 means unlimited.
+	MaxOpenSegments int
+	// ChecksumType is the checksum algorithm of the chunks, CRC32 by default.
+	// It is recorded in the header of every new segment file, the existing ones are read with their own.
+	ChecksumType ChecksumType
+	// PipelineChecksums computes the checksums of the chunks of a write spanning several blocks, like
+	// a large record or a batch, in a background goroutine, and writes the blocks whose chunks are
+	// summed while the next ones are summed, so that the CPU work overlaps the I/O. The file gets the
+	// same bytes in the same order, so the durability is the same. A chunk is never written before its
+	// checksum is filled in, a reader or a crash would see it corrupted. It is ignored with DirectIO.
+	PipelineChecksums bool
+	// CompressColdSegments compresses the older segment files unread for ColdSegmentAge, in a background
+	// goroutine. Every block is compressed by gzip on its own, after an index of their offsets, so the
+	// positions stay valid and a read only decompresses the blocks it needs, once if the block cache
+	// keeps them. The compressed segment files are only read, Open reads them whether it is set or not.
+	// The active segment file is never compressed. It must not be set with DirectIO or MirrorDirPath.
+	CompressColdSegments bool
+	// ColdSegmentAge is how long an older segment file stays unread after its rotation before it is
+	// compressed by CompressColdSegments, it is checked every half of it. 1 hour if 0.
+	ColdSegmentAge time.Duration
+	// Compressor compresses every record before it is written, nil means no compression.
+	// Chunks are flagged when compressed, so a WAL can switch it on without rewriting old segments.
+	Compressor Compressor
+	// BufferPool provides the scratch buffers of the writes and the reads, nil means the WAL's own pools.
+	BufferPool BufferPool
+	// Cipher encrypts every record after compression, nil means no encryption.
+	// Chunks are flagged when encrypted, so the unencrypted segments written before still open.
+	Cipher Cipher
 }
 
 const (
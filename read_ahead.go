@@ -0,0 +1,40 @@
+package wal
+
+// prefetch reads the blocks after the position of the reader into the block cache in the
+// background, up to ReadAhead blocks ahead, so that the next reads hit the cache.
+// A reader prefetches once at a time, and only the full blocks which aren't cached yet,
+// at most half of the cache, so the prefetched blocks don't evict each other.
+func (segReader *segmentReader) prefetch() {
+	seg := segReader.segment
+	if seg.readAhead <= 0 || !seg.cached() || seg.verifyOnRead || seg.mapped() {
+		return
+	}
+	ahead := uint32(min(seg.readAhead, max(seg.cache.size/2, 1)))
+	fullBlocks := uint32(segReader.size / seg.blockSize)
+	start := max(segReader.blockNumber, segReader.prefetched)
+	end := min(segReader.blockNumber+ahead, fullBlocks)
+	if start >= end || !segReader.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+	if !seg.acquire() {
+		segReader.prefetching.Store(false)
+		return
+	}
+	segReader.prefetched = end
+
+	go func() {
+		defer segReader.prefetching.Store(false)
+		defer func() { _ = seg.release() }()
+		for blockNumber := start; blockNumber < end; blockNumber++ {
+			key := seg.getCacheKey(blockNumber)
+			if seg.cache.Contains(key) {
+				continue
+			}
+			block := alignedBuffer(int(seg.blockSize))
+			if err := seg.readFile(block, blockNumber, seg.blockSize); err != nil {
+				return
+			}
+			seg.cache.Add(key, block)
+		}
+	}()
+}
@@ -0,0 +1,154 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+var (
+	// ErrNegativeOffset is returned by the ReadAt of the reader returned by ReaderAt for a negative offset.
+	ErrNegativeOffset = errors.New("negative offset")
+	// ErrRecordNotSeekable is returned by ReaderAt for a compressed or encrypted record.
+	ErrRecordNotSeekable = errors.New("the compressed or encrypted record can't be read in part, read it whole")
+)
+
+// recordFragment is the payload of a chunk of a record, at the offset start of the stored record.
+type recordFragment struct {
+	blockNumber uint32
+	chunkOffset int64
+	start       int64
+	size        int64
+}
+
+// recordReader is the io.ReaderAt of a record, which reads its chunks from the segment file
+// on demand, one block at a time.
+type recordReader struct {
+	segment   *segment
+	segSize   int64
+	fragments []recordFragment
+	// prefix is the size of the write time and the record type stored before the data.
+	prefix int64
+	size   int64
+}
+
+// ReaderAt returns an io.ReaderAt over the data at the given position and its size, for the
+// records too large to be read at once. The chunks are verified when it is returned, then
+// every ReadAt reads the blocks it needs again, through the block cache if there is one.
+// The compressed or encrypted records can't be read in part, ErrRecordNotSeekable is returned
+// for them, they are read whole by Read.
+//
+// The reader fails with ErrClosed once the segment file is closed, and reads garbage
+// after the record is discarded by TruncateTail, like the position itself.
+func (wal *WAL) ReaderAt(pos *ChunkPosition) (io.ReaderAt, int64, error) {
+	if wal.shards != nil {
+		return wal.shardOf(pos.SegmentId).ReaderAt(pos)
+	}
+	wal.mu.RLock()
+	segment := wal.getSegment(pos.SegmentId)
+	if segment == nil {
+		wal.mu.RUnlock()
+		return nil, 0, wal.segmentNotFound(pos.SegmentId)
+	}
+	segSize := segment.Size()
+	if !segment.acquire() {
+		wal.mu.RUnlock()
+		return nil, 0, segmentError("read", pos.SegmentId, ErrClosed)
+	}
+	wal.mu.RUnlock()
+	defer segment.release()
+
+	reader, err := segment.newRecordReader(pos.BlockNumber, pos.ChunkOffset, segSize)
+	if err != nil {
+		return nil, 0, segmentError("read", pos.SegmentId, err)
+	}
+	return reader, reader.size, nil
+}
+
+// newRecordReader reads the chunks of the record at the position, and returns their fragments,
+// ErrRecordNotSeekable if the record is compressed or encrypted.
+func (seg *segment) newRecordReader(blockNumber uint32, chunkOffset, segSize int64) (*recordReader, error) {
+	bh := seg.getBlock()
+	defer seg.putBlock(bh)
+
+	reader := &recordReader{segment: seg, segSize: segSize}
+	var flags ChunkType
+	var stored int64
+	for {
+		data, typeByte, err := seg.readChunk(bh, blockNumber, chunkOffset, segSize)
+		// the file ends in the middle of a record spanning several blocks.
+		if err == io.EOF && len(reader.fragments) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		flags |= typeByte &^ chunkTypeMask
+		reader.fragments = append(reader.fragments, recordFragment{
+			blockNumber: blockNumber,
+			chunkOffset: chunkOffset,
+			start:       stored,
+			size:        int64(len(data)),
+		})
+		stored += int64(len(data))
+
+		chunkType := typeByte & chunkTypeMask
+		if chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
+			break
+		}
+		blockNumber += 1
+		chunkOffset = 0
+	}
+
+	if flags&(chunkFlagCompressed|chunkFlagEncrypted) != 0 {
+		return nil, ErrRecordNotSeekable
+	}
+	if flags&chunkFlagTimestamp != 0 {
+		reader.prefix += timestampSize
+	}
+	if flags&chunkFlagTyped != 0 {
+		reader.prefix++
+	}
+	if stored < reader.prefix {
+		return nil, io.ErrUnexpectedEOF
+	}
+	reader.size = stored - reader.prefix
+	return reader, nil
+}
+
+// ReadAt reads the data of the record at the offset off into p.
+func (r *recordReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if !r.segment.acquire() {
+		return 0, segmentError("read", r.segment.id, ErrClosed)
+	}
+	defer r.segment.release()
+	bh := r.segment.getBlock()
+	defer r.segment.putBlock(bh)
+
+	// the offset in the stored record, after the prefix.
+	stored := off + r.prefix
+	i := sort.Search(len(r.fragments), func(i int) bool {
+		return r.fragments[i].start+r.fragments[i].size > stored
+	})
+	n := 0
+	for ; n < len(p) && i < len(r.fragments); i++ {
+		fragment := r.fragments[i]
+		data, _, err := r.segment.readChunk(bh, fragment.blockNumber, fragment.chunkOffset, r.segSize)
+		if err != nil {
+			return n, segmentError("read", r.segment.id, err)
+		}
+		copied := copy(p[n:], data[stored-fragment.start:])
+		n += copied
+		stored += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,142 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Repair scans the segment files in options.DirPath in order and truncates the
+// first segment file where a corrupted or incomplete chunk is found right before
+// that chunk, usually the tail of the last segment after an unclean shutdown.
+// The segment files before it are left untouched, the ones after it are removed,
+// since the log can't be read past the truncated chunk.
+// It returns the position of the last valid chunk left, nil if there is none.
+//
+// Repair must not run while the WAL is opened, ErrDirLocked is returned in that case.
+func Repair(options Options) (*ChunkPosition, error) {
+	if !strings.HasPrefix(options.DiskFileExtension, ".") {
+		return nil, fmt.Errorf("invalid file extension")
+	}
+	lock, err := lockDir(options.fs(), options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockDir(lock)
+
+	segmentIDs, err := listSegmentIDs(options, options.DiskFileExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lastValid *ChunkPosition
+		corrupted bool
+	)
+	for _, segId := range segmentIDs {
+		segment, err := openSegmentFile(options, uint32(segId), nil)
+		if errors.Is(err, ErrNotSegmentFile) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the segment file is after the truncated chunk.
+		if corrupted {
+			if err := segment.Remove(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		last, truncated, err := repairSegment(segment)
+		_ = segment.Close()
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			lastValid = last
+		}
+		corrupted = truncated
+	}
+	if corrupted {
+		if err := syncDir(options.fs(), options.DirPath); err != nil {
+			return nil, err
+		}
+	}
+	return lastValid, nil
+}
+
+// repairSegment reads the chunks of the segment until the first corrupted one,
+// and truncates the segment file at it.
+func repairSegment(segment *segment) (*ChunkPosition, bool, error) {
+	var lastValid *ChunkPosition
+	reader := segment.NewReader()
+	for {
+		_, pos, err := reader.Next()
+		if err == io.EOF {
+			return lastValid, false, nil
+		}
+		if err != nil && isCorruption(err) {
+			if err := segment.truncate(reader.blockNumber, reader.chunkOffset); err != nil {
+				return nil, false, err
+			}
+			return lastValid, true, segment.Sync()
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		lastValid = pos
+	}
+}
+
+// isCorruption reports whether the read error comes from the content of the chunk,
+// rather than from the file system or the options.
+func isCorruption(err error) bool {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, ErrClosed), errors.Is(err, ErrNoCipher), errors.Is(err, ErrNoCompressor):
+		return false
+	case errors.As(err, &pathErr):
+		return false
+	}
+	return true
+}
+
+// Validate verifies the checksum of every chunk of the WAL, and returns the positions of all
+// the corrupted or incomplete chunks with an error wrapping ErrInvalidCRC if there are any.
+// It doesn't stop at a corrupted chunk, the scan of its segment file goes on at the next block,
+// so the other chunks of the block are not verified. The WAL is not modified, see Repair.
+func (wal *WAL) Validate() ([]*ChunkPosition, error) {
+	reader := wal.NewReader()
+	defer reader.Close()
+
+	var corrupted []*ChunkPosition
+	for _, segReader := range reader.segmentReaders {
+		for {
+			_, _, err := segReader.nextRawChunk()
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, ErrInvalidCRC) || errors.Is(err, io.ErrUnexpectedEOF) {
+				corrupted = append(corrupted, &ChunkPosition{
+					SegmentId:   segReader.segment.id,
+					BlockNumber: segReader.blockNumber,
+					ChunkOffset: segReader.chunkOffset,
+				})
+				// resynchronize at the start of the next block.
+				segReader.blockNumber++
+				segReader.chunkOffset = 0
+				continue
+			}
+			if err != nil {
+				return corrupted, segmentError("validate", segReader.segment.id, err)
+			}
+		}
+	}
+	if len(corrupted) > 0 {
+		return corrupted, fmt.Errorf("%w: %d corrupted chunks", ErrInvalidCRC, len(corrupted))
+	}
+	return nil, nil
+}
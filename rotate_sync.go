@@ -0,0 +1,71 @@
+package wal
+
+import "sync"
+
+// rotateSyncer syncs the segment files replaced by a rotation with AsyncRotateSync,
+// in a background goroutine, one at a time in the order of the rotations.
+type rotateSyncer struct {
+	wal    *WAL
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*segment // the segment files to sync, acquired by add.
+	closed bool
+	exited chan struct{}
+	err    error // the first failure, returned by Close.
+}
+
+func newRotateSyncer(wal *WAL) *rotateSyncer {
+	s := &rotateSyncer{wal: wal, exited: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// add hands the segment to the background goroutine, it is synced before it can be deleted.
+func (s *rotateSyncer) add(seg *segment) {
+	if !seg.acquire() {
+		return
+	}
+	seg.syncing = make(chan struct{})
+	s.mu.Lock()
+	s.queue = append(s.queue, seg)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *rotateSyncer) run() {
+	defer close(s.exited)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		seg := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		err := s.wal.syncSegment(seg)
+		s.mu.Lock()
+		if err != nil && s.err == nil {
+			s.err = segmentError("sync", seg.id, err)
+		}
+		s.mu.Unlock()
+		_ = seg.release()
+		close(seg.syncing)
+	}
+}
+
+// close waits for the segment files handed over to be synced, stops the goroutine
+// and returns the first failure.
+func (s *rotateSyncer) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Signal()
+	<-s.exited
+	return s.err
+}
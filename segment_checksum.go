@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// checksumFileExt is appended to the name of a segment file to name its checksum file,
+// written by SegmentFooterChecksum. The checksum file is the size of the segment file
+// covered, 8 bytes, followed by the CRC-32 (IEEE) of its content up to that size, 4 bytes.
+const (
+	checksumFileExt  = ".crc"
+	checksumFileSize = 12
+)
+
+var ErrNoSegmentChecksum = errors.New("the segment file has no checksum file")
+
+// checksumFileName returns the name of the checksum file of the segment.
+func (seg *segment) checksumFileName() string {
+	return seg.fd.Name() + checksumFileExt
+}
+
+// updateFileSum adds the bytes appended to the segment file to its running checksum.
+func (seg *segment) updateFileSum(b []byte) {
+	if seg.fileSumValid {
+		seg.fileSum = crc32.Update(seg.fileSum, crc32.IEEETable, b)
+	}
+}
+
+// fileChecksum returns the checksum of the segment file up to the given size,
+// it is read from the file unless the running checksum covers exactly that size.
+func (seg *segment) fileChecksum(size int64) (uint32, error) {
+	if seg.fileSumValid && size == seg.Size() {
+		return seg.fileSum, nil
+	}
+	var sum uint32
+	block := alignedBuffer(int(seg.blockSize))
+	for offset := int64(0); offset < size; offset += seg.blockSize {
+		n := min(size-offset, seg.blockSize)
+		if err := seg.readFile(block, uint32(offset/seg.blockSize), n); err != nil {
+			return 0, err
+		}
+		sum = crc32.Update(sum, crc32.IEEETable, block[:n])
+	}
+	return sum, nil
+}
+
+// writeChecksumFile writes the checksum file of the segment, covering all its chunks.
+func (seg *segment) writeChecksumFile() error {
+	size := seg.Size()
+	sum, err := seg.fileChecksum(size)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, checksumFileSize)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(size))
+	binary.LittleEndian.PutUint32(buf[8:], sum)
+
+	fd, err := seg.fs.OpenFile(seg.checksumFileName(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, seg.filePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(buf); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// verifyChecksumFile recomputes the checksum of the segment file,
+// and compares it with the one in its checksum file.
+func (seg *segment) verifyChecksumFile() error {
+	fd, err := seg.fs.OpenFile(seg.checksumFileName(), os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoSegmentChecksum
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	buf := make([]byte, checksumFileSize)
+	if _, err := fd.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint64(buf[:8]))
+	if size > seg.Size() {
+		return ErrInvalidCRC
+	}
+	sum, err := seg.fileChecksum(size)
+	if err != nil {
+		return err
+	}
+	if sum != binary.LittleEndian.Uint32(buf[8:]) {
+		return ErrInvalidCRC
+	}
+	return nil
+}
+
+// removeChecksumFile removes the checksum file of the segment if there is one.
+func (seg *segment) removeChecksumFile() error {
+	if err := seg.fs.Remove(seg.checksumFileName()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// VerifySegment recomputes the checksum of the segment file of the id, and compares it
+// with the one written by SegmentFooterChecksum when the segment file was rotated or closed.
+// ErrNoSegmentChecksum is returned if it has no checksum file, and an error wrapping
+// ErrInvalidCRC if the content doesn't match.
+func (wal *WAL) VerifySegment(id SegSerialID) error {
+	if wal.shards != nil {
+		return wal.shardOf(id).VerifySegment(id)
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	segment, err := wal.acquireSegment("verify", id)
+	if err != nil {
+		return err
+	}
+	defer segment.release()
+	return segmentError("verify", id, segment.verifyChecksumFile())
+}
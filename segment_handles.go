@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// segmentHandles keeps at most max older segment files open for MaxOpenSegments,
+// the least recently used ones are closed, and opened again by acquire.
+//
+// A closed segment file is parked: the WAL dropped its reference, so the file is closed
+// once the readers using it release it, and the segment itself stays in olderSegments.
+// The references dropping to 0 and the reopening are done under mu, so that the file
+// of a segment is only replaced once nobody uses it.
+type segmentHandles struct {
+	mu      sync.Mutex
+	options Options
+	max     int
+	lru     *list.List // the open older segments, the most recently used first.
+}
+
+func newSegmentHandles(options Options) *segmentHandles {
+	return &segmentHandles{options: options, max: options.MaxOpenSegments, lru: list.New()}
+}
+
+// add makes the sealed segment an older segment whose file may be closed.
+func (h *segmentHandles) add(seg *segment) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seg.handle = h.lru.PushFront(seg)
+	h.evict()
+}
+
+// pin keeps the file of the segment open, like when it becomes the active one again,
+// it must be acquired by the caller.
+func (h *segmentHandles) pin(seg *segment) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seg.handle != nil {
+		h.lru.Remove(seg.handle)
+		seg.handle = nil
+	}
+}
+
+// touch marks the segment as the most recently used one.
+func (h *segmentHandles) touch(seg *segment) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seg.handle != nil {
+		h.lru.MoveToFront(seg.handle)
+	}
+}
+
+// evict parks the least recently used segments beyond max. h.mu must be held.
+func (h *segmentHandles) evict() {
+	for h.lru.Len() > h.max {
+		seg := h.lru.Remove(h.lru.Back()).(*segment)
+		seg.handle = nil
+		seg.parked = true
+		_ = seg.releaseLocked()
+	}
+}
+
+// drop removes the segment closed or deleted by the WAL, and drops the reference
+// of the WAL unless it is parked.
+func (h *segmentHandles) drop(seg *segment) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seg.parked {
+		seg.parked = false
+		return nil
+	}
+	if seg.handle != nil {
+		h.lru.Remove(seg.handle)
+		seg.handle = nil
+	}
+	return seg.releaseLocked()
+}
+
+// reopen takes a reference on the segment, and opens its file again if it is parked.
+// It returns false if the segment was closed or deleted by the WAL, or its file fails to open.
+func (h *segmentHandles) reopen(seg *segment) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// opened again by another reader meanwhile.
+	if seg.tryAcquire() {
+		return true
+	}
+	if !seg.parked {
+		return false
+	}
+	// the file is not created again if it was deleted meanwhile.
+	fd, _, err := openSegmentFd(h.options, seg.id, segmentFileFlag(h.options, seg.directIO)&^os.O_CREATE)
+	if err != nil {
+		return false
+	}
+	seg.fd = fd
+	seg.unmap()
+	// the reference of the WAL and the one of the caller.
+	seg.refs.Store(2)
+	seg.parked = false
+	seg.handle = h.lru.PushFront(seg)
+	h.evict()
+	return true
+}
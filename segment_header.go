@@ -0,0 +1,129 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The header at the start of every segment file, the first chunk follows it in the block 0:
+//
+//	Magic       4 Bytes  index:0-3
+//	Version     1 Byte   index:4
+//	Checksum    1 Byte   index:5, the ChecksumType of the chunks
+//	Reserved    2 Bytes  index:6-7
+//	BlockSize   4 Bytes  index:8-11
+//	SegmentSize 8 Bytes  index:12-19, the size the segment file is rotated at
+//	CRC32       4 Bytes  index:20-23, over the bytes before it
+//
+// The version 1 headers have no SegmentSize, their CRC32 is at index:12-15.
+// The segment files written before the header have their first chunk at the offset 0.
+const (
+	segmentHeaderSize    = 24
+	segmentHeaderSizeV1  = 16
+	segmentFormatVersion = 2
+)
+
+var segmentMagic = []byte("KWAL")
+
+var (
+	ErrNotSegmentFile = errors.New("the file is not a segment file")
+	ErrSegmentVersion = errors.New("the segment file format is not supported")
+	// ErrBlockSizeMismatch is returned by Open if a segment file has another block size than Options.BlockSize.
+	ErrBlockSizeMismatch = errors.New("the segment file was written with another block size")
+)
+
+// segmentHeader is the content of the header of a segment file.
+type segmentHeader struct {
+	checksumType ChecksumType
+	blockSize    int64
+	segmentSize  int64 // 0 in the version 1 headers.
+	size         int64 // the size of the header itself, where the first chunk starts.
+}
+
+// encodeSegmentHeader returns the header of a new segment file.
+func encodeSegmentHeader(checksumType ChecksumType, blockSize, segmentSize int64) []byte {
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	header[4] = segmentFormatVersion
+	header[5] = byte(checksumType)
+	binary.LittleEndian.PutUint32(header[8:12], uint32(blockSize))
+	binary.LittleEndian.PutUint64(header[12:20], uint64(segmentSize))
+	binary.LittleEndian.PutUint32(header[20:24], crc32.ChecksumIEEE(header[:20]))
+	return header
+}
+
+// decodeSegmentHeader validates the header at the start of the content of a segment file.
+func decodeSegmentHeader(content []byte) (segmentHeader, error) {
+	if len(content) < segmentHeaderSizeV1 || !bytes.Equal(content[:4], segmentMagic) {
+		return segmentHeader{}, ErrNotSegmentFile
+	}
+	size := segmentHeaderLen(content[4])
+	if size == 0 {
+		return segmentHeader{}, fmt.Errorf("%w: version %d", ErrSegmentVersion, content[4])
+	}
+	if len(content) < size {
+		return segmentHeader{}, fmt.Errorf("segment header: %w", io.ErrUnexpectedEOF)
+	}
+	if binary.LittleEndian.Uint32(content[size-4:size]) != crc32.ChecksumIEEE(content[:size-4]) {
+		return segmentHeader{}, fmt.Errorf("segment header: %w", ErrInvalidCRC)
+	}
+	header := segmentHeader{
+		checksumType: ChecksumType(content[5]),
+		blockSize:    int64(binary.LittleEndian.Uint32(content[8:12])),
+		size:         int64(size),
+	}
+	if size == segmentHeaderSize {
+		header.segmentSize = int64(binary.LittleEndian.Uint64(content[12:20]))
+	}
+	if !validBlockSize(header.blockSize) {
+		return segmentHeader{}, fmt.Errorf("%w: block size %d", ErrSegmentVersion, header.blockSize)
+	}
+	if !header.checksumType.valid() {
+		return segmentHeader{}, fmt.Errorf("%w: checksum type %d", ErrSegmentVersion, header.checksumType)
+	}
+	return header, nil
+}
+
+// segmentHeaderLen returns the size of the segment header of the version, 0 if it is unknown.
+func segmentHeaderLen(version byte) int {
+	switch version {
+	case 1:
+		return segmentHeaderSizeV1
+	case segmentFormatVersion:
+		return segmentHeaderSize
+	}
+	return 0
+}
+
+// validBlockSize reports whether the block size is a power of two between minBlockSize and maxBlockSize.
+func validBlockSize(size int64) bool {
+	return size >= minBlockSize && size <= maxBlockSize && size&(size-1) == 0
+}
+
+// isTornSegmentHeader reports whether the content of a file shorter than the header
+// is the start of a header, left by a crash while a new segment file was created.
+func isTornSegmentHeader(content []byte) bool {
+	n := min(len(content), len(segmentMagic))
+	size := segmentHeaderSizeV1
+	if len(content) > 4 {
+		size = max(size, segmentHeaderLen(content[4]))
+	}
+	return len(content) < size && bytes.Equal(content[:n], segmentMagic[:n])
+}
+
+// isLegacySegment reports whether the content of a file without the header is the start of
+// a segment file written before it, whose first chunk starts a record in a block of the default size.
+// Only the chunk header is checked, a corrupted chunk is reported when it is read.
+func isLegacySegment(content []byte) bool {
+	// a chunk header torn by a crash, read as the end of the segment file.
+	if len(content) < chunkHeaderSize {
+		return true
+	}
+	length := int64(binary.LittleEndian.Uint16(content[4:6]))
+	chunkType := ChunkType(content[6])
+	return (chunkType == ChunkTypeFull || chunkType == ChunkTypeFirst) && length+chunkHeaderSize <= defaultBlockSize
+}
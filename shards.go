@@ -0,0 +1,104 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrShardsUnsupported = errors.New("the operation is not supported by a sharded WAL")
+
+// openShards opens the shards of a sharded WAL, each one is a WAL
+// in the same directory writing the segment files of its own ids.
+func (wal *WAL) openShards() error {
+	for i := 0; i < wal.options.Shards; i++ {
+		options := wal.options
+		options.Shards = 0
+		options.shardIndex = i
+		options.shardCount = wal.options.Shards
+		shard, err := Open(options)
+		if err != nil {
+			for _, opened := range wal.shards {
+				_ = opened.Close()
+			}
+			wal.shards = nil
+			return err
+		}
+		wal.shards = append(wal.shards, shard)
+	}
+	return nil
+}
+
+// ownsSegment reports whether the segment id belongs to the shard of the options,
+// the shard i of n owns the ids 1+i, 1+i+n, 1+i+2n...
+func (options Options) ownsSegment(id SegSerialID) bool {
+	if options.shardCount == 0 {
+		return true
+	}
+	// the modulo is done on the id, which overflows an int on 32-bit platforms.
+	return int((id-initialSegmentFileID)%SegSerialID(options.shardCount)) == options.shardIndex
+}
+
+// nextSegmentID returns the id of the segment file after prevID, 0 for the first one,
+// given by NextIDFunc, or the next id of the shard.
+func (options Options) nextSegmentID(prevID SegSerialID) (SegSerialID, error) {
+	if options.NextIDFunc == nil {
+		if prevID == 0 {
+			return SegSerialID(initialSegmentFileID + options.shardIndex), nil
+		}
+		return prevID + options.segmentIDStep(), nil
+	}
+	id := options.NextIDFunc(prevID)
+	if id <= prevID {
+		return 0, fmt.Errorf("NextIDFunc returned %d after %d, the segment ids must increase", id, prevID)
+	}
+	return id, nil
+}
+
+// segmentIDStep returns the difference between the ids of two consecutive segments.
+func (options Options) segmentIDStep() SegSerialID {
+	if options.shardCount == 0 {
+		return 1
+	}
+	return SegSerialID(options.shardCount)
+}
+
+// nextShard returns the shard receiving the next write in round-robin order.
+func (wal *WAL) nextShard() *WAL {
+	n := wal.shardCursor.Add(1)
+	return wal.shards[int(n%uint32(len(wal.shards)))]
+}
+
+// shardOf returns the shard owning the segment id.
+func (wal *WAL) shardOf(id SegSerialID) *WAL {
+	if id < initialSegmentFileID {
+		return wal.shards[0]
+	}
+	return wal.shards[(id-initialSegmentFileID)%SegSerialID(len(wal.shards))]
+}
+
+// WriteToShard writes the data to the shard chosen by the key, so that
+// the records with the same key are written in order to the same shard.
+// It is the same as Write if the WAL is not sharded.
+func (wal *WAL) WriteToShard(key uint64, data []byte) (*ChunkPosition, error) {
+	if wal.shards == nil {
+		return wal.Write(data)
+	}
+	shard := wal.shards[key%uint64(len(wal.shards))]
+	defer func() { wal.lastWriteRotated.Store(shard.LastWriteRotated()) }()
+	return shard.Write(data)
+}
+
+// shardedSegments returns the segments of all shards sorted by id.
+func (wal *WAL) shardedSegments() []*segment {
+	var segments []*segment
+	for _, shard := range wal.shards {
+		shard.mu.RLock()
+		segments = append(segments, shard.sortedSegments()...)
+		shard.mu.RUnlock()
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+	return segments
+}
@@ -0,0 +1,191 @@
+package wal
+
+import "io"
+
+// Stats is a point-in-time snapshot of the WAL internal state.
+type Stats struct {
+	// OlderSegments is the number of older (read-only) segment files.
+	OlderSegments int
+	// ActiveSegmentID is the id of the segment file receiving new writes.
+	ActiveSegmentID SegSerialID
+	// TotalBytes is the size of all segment files, the active one included.
+	TotalBytes int64
+	// PendingSize is the size reserved by PendingWrites and not yet written by WriteAll.
+	PendingSize int64
+	// CacheHits and CacheMisses count the block cache lookups, both stay 0 if BlockCache is disabled.
+	CacheHits   uint64
+	CacheMisses uint64
+	// PayloadBytes is the size of the records written since Open, as passed to the writes.
+	PayloadBytes uint64
+	// DiskBytes is the size their chunks take in the segment files, with the chunk headers,
+	// the prefixes of the records and the block padding. See WAL.WriteAmplification.
+	DiskBytes uint64
+}
+
+// Stats returns the current statistics of the WAL.
+// It is safe to call it concurrently with writes.
+func (wal *WAL) Stats() Stats {
+	// the sum of the shards, with the largest active segment id.
+	if wal.shards != nil {
+		var stats Stats
+		for _, shard := range wal.shards {
+			shardStats := shard.Stats()
+			stats.OlderSegments += shardStats.OlderSegments
+			stats.ActiveSegmentID = max(stats.ActiveSegmentID, shardStats.ActiveSegmentID)
+			stats.TotalBytes += shardStats.TotalBytes
+			stats.CacheHits += shardStats.CacheHits
+			stats.CacheMisses += shardStats.CacheMisses
+			stats.PayloadBytes += shardStats.PayloadBytes
+			stats.DiskBytes += shardStats.DiskBytes
+		}
+		wal.pendingWritesLock.Lock()
+		stats.PendingSize = wal.pendingSize
+		wal.pendingWritesLock.Unlock()
+		return stats
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	stats := Stats{
+		OlderSegments: len(wal.olderSegments),
+		PayloadBytes:  wal.payloadBytes,
+		DiskBytes:     wal.diskBytes,
+	}
+	if wal.activeSegment != nil {
+		stats.ActiveSegmentID = wal.activeSegment.id
+		stats.TotalBytes = wal.activeSegment.Size()
+	}
+	for _, segment := range wal.olderSegments {
+		stats.TotalBytes += segment.Size()
+	}
+
+	wal.pendingWritesLock.Lock()
+	stats.PendingSize = wal.pendingSize
+	wal.pendingWritesLock.Unlock()
+
+	if wal.blockCache != nil {
+		stats.CacheHits = wal.blockCache.hits.Load()
+		stats.CacheMisses = wal.blockCache.misses.Load()
+	}
+	return stats
+}
+
+// WriteAmplification returns the bytes written to the segment files for every byte of record
+// written since Open, Stats.DiskBytes divided by Stats.PayloadBytes, 0 before the first write.
+// The chunk header added for every block a record crosses makes it grow as the block size shrinks.
+func (wal *WAL) WriteAmplification() float64 {
+	stats := wal.Stats()
+	if stats.PayloadBytes == 0 {
+		return 0
+	}
+	return float64(stats.DiskBytes) / float64(stats.PayloadBytes)
+}
+
+// DiskSize returns the size of all segment files on disk, the active one included.
+// It may be larger than Stats.TotalBytes, like with the block padding of DirectIO.
+func (wal *WAL) DiskSize() (int64, error) {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	var size int64
+	for _, segment := range wal.sortedSegments() {
+		if !segment.acquire() {
+			return 0, segmentError("stat", segment.id, ErrClosed)
+		}
+		stat, err := segment.fd.Stat()
+		_ = segment.release()
+		if err != nil {
+			return 0, segmentError("stat", segment.id, err)
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
+// RecordCount returns the number of records in the WAL.
+// The records are counted as they are written, the segment files reopened by Open
+// or truncated are read once by the first call to count their records.
+func (wal *WAL) RecordCount() (int64, error) {
+	if wal.shards != nil {
+		var count int64
+		for _, shard := range wal.shards {
+			records, err := shard.RecordCount()
+			if err != nil {
+				return 0, err
+			}
+			count += records
+		}
+		return count, nil
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	var count int64
+	for _, segment := range wal.sortedSegments() {
+		records, err := segment.recordCount()
+		if err != nil {
+			return 0, segmentError("count", segment.id, err)
+		}
+		count += records
+	}
+	return count, nil
+}
+
+// SegInfo describes the layout of the chunks of a segment file, see SegmentInfo.
+type SegInfo struct {
+	ID SegSerialID
+	// Size is the size of the segment file, up to the end of its last chunk.
+	Size int64
+	// Blocks is the number of blocks, the last one included even if it is not full.
+	Blocks int64
+	// Chunks is the number of chunks, a record has one chunk per block it is written in.
+	Chunks int64
+	// Records is the number of records.
+	Records int64
+	// SpanningRecords is the number of records written in several chunks across blocks.
+	SpanningRecords int64
+}
+
+// SegmentInfo reads the chunks of the segment file with the id, and returns its layout.
+// ErrSegmentNotFound or ErrSegmentRemoved is returned if the WAL doesn't have it.
+// The chunks written while it reads are not counted.
+func (wal *WAL) SegmentInfo(id SegSerialID) (*SegInfo, error) {
+	if wal.shards != nil {
+		return wal.shardOf(id).SegmentInfo(id)
+	}
+	wal.mu.RLock()
+	segment := wal.getSegment(id)
+	if segment == nil || !segment.acquire() {
+		err := wal.segmentNotFound(id)
+		wal.mu.RUnlock()
+		return nil, err
+	}
+	wal.mu.RUnlock()
+	defer func() {
+		_ = segment.release()
+	}()
+
+	reader := segment.NewReader()
+	info := &SegInfo{
+		ID:     id,
+		Size:   reader.size,
+		Blocks: (reader.size + segment.blockSize - 1) / segment.blockSize,
+	}
+	for {
+		chunk, _, err := reader.nextRawChunk()
+		if err == io.EOF {
+			return info, nil
+		}
+		if err != nil {
+			return nil, segmentError("info", id, err)
+		}
+		info.Chunks++
+		switch chunk.Type {
+		case ChunkTypeFull:
+			info.Records++
+		case ChunkTypeFirst:
+			info.Records++
+			info.SpanningRecords++
+		}
+	}
+}
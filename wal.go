@@ -1,16 +1,20 @@
 package wal
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
-
-	lru "github.com/hashicorp/golang-lru/v2"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -20,236 +24,1109 @@ const (
 var (
 	ErrDataSizeTooLarge    = errors.New("the data size must smaller than segment file limit")
 	ErrPendingSizeTooLarge = errors.New("the upper bound of pending writes can't larger than segment size")
+	ErrEmpty               = errors.New("the WAL is empty")
+	ErrReadOnly            = errors.New("the WAL is opened in read-only mode")
+	ErrSegmentNotFound     = errors.New("segment file not found")
+	ErrSegmentRemoved      = errors.New("segment file removed")
+
+	// ErrPendingWritesDropped is returned by Close if there were pending writes, which are not written.
+	ErrPendingWritesDropped = errors.New("the WAL is closed with pending writes, they are dropped")
+	// ErrSegmentMissing is returned by Open with RequireContiguousSegments if a segment id is missing.
+	ErrSegmentMissing = errors.New("segment file missing")
+	// ErrActiveSegment is returned by DeleteSegment for the active segment file.
+	ErrActiveSegment = errors.New("the active segment file can't be deleted")
 )
 
+// SegmentError is returned when an operation on a segment file fails,
+// it records the operation, like "write", "read", "sync" or "rotate", and the segment id.
+// The cause is unwrapped by errors.Is and errors.As.
+type SegmentError struct {
+	Op        string
+	SegmentId SegSerialID
+	Err       error
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("wal: %s segment %d: %v", e.Op, e.SegmentId, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// segmentError wraps err into a *SegmentError, nil is returned if err is nil.
+func segmentError(op string, id SegSerialID, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SegmentError{Op: op, SegmentId: id, Err: noSpaceError(err)}
+}
+
 type WAL struct {
 	activeSegment     *segment                 // active segment file, used for new incoming writes.
 	olderSegments     map[SegSerialID]*segment // older segment files, only used for read.
 	options           Options
 	mu                sync.RWMutex
-	blockCache        *lru.Cache[uint64, []byte]
+	blockCache        *blockCache
+	handles           *segmentHandles // the open older segment files, with MaxOpenSegments.
 	bytesWrite        uint32
+	lastSync          time.Time // when the active segment file was last synced, see MaxSyncDelay.
 	renameIds         []SegSerialID
 	pendingWrites     [][]byte
 	pendingSize       int64
 	pendingWritesLock sync.Mutex
+	dirLock           File
+	lastPosition      *ChunkPosition // position of the last written chunk, nil if unknown yet.
+	syncDone          chan struct{}  // closed to stop the background goroutines, of SyncInterval and CompressColdSegments.
+	syncStopped       sync.WaitGroup
+	stopSyncOnce      sync.Once
+	rotateSync        *rotateSyncer // syncs the rotated segment files with AsyncRotateSync, nil otherwise.
+	shards            []*WAL        // the shards of a sharded WAL, nil if it is not sharded.
+	shardCursor       atomic.Uint32 // picks the shard of the next write in round-robin order.
+	rotations         uint64        // the number of rotations, the writes compare it to tell whether they rotated.
+	lastWriteRotated  atomic.Bool   // the last write rotated the active segment file.
+	truncatedTail     int64         // the bytes truncated by TruncatePartialTail at Open.
+	payloadBytes      uint64        // the bytes of the records written since Open, see WriteAmplification.
+	diskBytes         uint64        // the bytes their chunks take in the segment files, with headers and padding.
+	written           chan struct{} // closed and replaced by a write if followed, see Follow.
+	generation        uint64        // bumped when the records are removed or rewritten in place, see Follow.
+	writeFollowed     atomic.Bool   // a Follow waits on written.
 }
 
+// Reader reads the records of the segment files the WAL had when the reader was created.
+// It holds a reference on these files: the segments rotated in later are not visible to it,
+// while the ones closed or deleted by the WAL afterward stay readable until the reader is closed.
+// The records appended to the then active segment after its creation are not visible either.
+//
+// A Reader must not be used by several goroutines at once, but many readers can read concurrently.
 type Reader struct {
 	segmentReaders []*segmentReader
 	currentReader  int
+	closed         bool
+	peeked         *peekedRecord // the record returned by Peek, returned again by the next Next.
+	resilient      bool          // the corrupted chunks are skipped, see NewReaderResilient.
+	skipped        []*ChunkPosition
+}
+
+// peekedRecord is a record read by Peek.
+type peekedRecord struct {
+	data []byte
+	pos  *ChunkPosition
+	meta RecordMeta
+}
+
+// ReverseReader reads the WAL backward, from the newest record to the oldest one.
+type ReverseReader struct {
+	segments       []*segment       // segments to read, sorted by id.
+	currentSegment int              // index of the next segment to scan.
+	positions      []*ChunkPosition // positions of the scanned but not yet returned chunks.
+	reading        *segment         // the segment that positions belong to.
+	closed         bool
 }
 
-func Open(options Options) (*WAL, error) {
+func Open(options Options) (_ *WAL, err error) {
 	if !strings.HasPrefix(options.DiskFileExtension, ".") {
 		return nil, fmt.Errorf("invalid file extension")
 	}
+	if (options.FileNameFunc == nil) != (options.ParseIDFunc == nil) {
+		return nil, fmt.Errorf("FileNameFunc and ParseIDFunc must be set together")
+	}
+	blockSize := options.blockSize()
+	if !validBlockSize(blockSize) {
+		return nil, fmt.Errorf("BlockSize %d must be a power of two between %d and %d",
+			blockSize, minBlockSize, maxBlockSize)
+	}
+	if options.SegmentSize < blockSize {
+		return nil, fmt.Errorf("SegmentSize %d is too small, it must be at least the block size %d",
+			options.SegmentSize, blockSize)
+	}
 	if options.BlockCache > uint32(options.SegmentSize) {
 		return nil, fmt.Errorf("BlockCache must be smaller than SegmentSize")
 	}
+	if options.BlockCacheEntries < 0 {
+		return nil, fmt.Errorf("BlockCacheEntries must not be negative")
+	}
+	if options.BlockCache > 0 && options.BlockCacheEntries > 0 {
+		return nil, fmt.Errorf("BlockCache and BlockCacheEntries must not be set together")
+	}
+	// the segment files are only read, the page cache is fine.
+	if options.ReadOnly {
+		options.DirectIO = false
+	}
+	if options.DirectIO && !directIOSupported {
+		return nil, ErrDirectIOUnsupported
+	}
+	if options.MinFreeBytes < 0 {
+		return nil, fmt.Errorf("MinFreeBytes must not be negative")
+	}
+	if options.MinFreeBytes > 0 && !diskSpaceSupported {
+		return nil, ErrDiskSpaceUnsupported
+	}
+	if options.DirectIO && blockSize < directIOAlignment {
+		return nil, fmt.Errorf("BlockSize %d is too small for DirectIO, it must be at least %d",
+			blockSize, directIOAlignment)
+	}
+	if options.ReadAhead < 0 {
+		return nil, fmt.Errorf("ReadAhead must not be negative")
+	}
+	if options.Shards < 0 {
+		return nil, fmt.Errorf("Shards must not be negative")
+	}
+	if options.MirrorDirPath != "" && filepath.Clean(options.MirrorDirPath) == filepath.Clean(options.DirPath) {
+		return nil, fmt.Errorf("MirrorDirPath must not be DirPath")
+	}
+	if options.Shards > 1 && options.NextIDFunc != nil {
+		return nil, fmt.Errorf("NextIDFunc must not be set with Shards")
+	}
+	if options.MaxOpenSegments < 0 {
+		return nil, fmt.Errorf("MaxOpenSegments must not be negative")
+	}
+	if options.MergeSmallSegmentsOnOpen < 0 {
+		return nil, fmt.Errorf("MergeSmallSegmentsOnOpen must not be negative")
+	}
+	if options.MergeSmallSegmentsOnOpen > 0 && (options.Shards > 1 || options.RequireContiguousSegments) {
+		return nil, fmt.Errorf("MergeSmallSegmentsOnOpen must not be set with Shards or RequireContiguousSegments")
+	}
+	if options.ColdSegmentAge < 0 {
+		return nil, fmt.Errorf("ColdSegmentAge must not be negative")
+	}
+	if options.CompressColdSegments && (options.DirectIO || options.MirrorDirPath != "") {
+		return nil, fmt.Errorf("CompressColdSegments must not be set with DirectIO or MirrorDirPath")
+	}
+	if !options.ChecksumType.valid() {
+		return nil, fmt.Errorf("unknown ChecksumType %d", options.ChecksumType)
+	}
 	wal := &WAL{
 		options:       options,
 		olderSegments: make(map[SegSerialID]*segment),
 		pendingWrites: make([][]byte, 0),
+		written:       make(chan struct{}),
+		lastSync:      time.Now(),
 	}
 
-	// create the directory if not exists.
-	if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
-		return nil, err
+	// create the directory if not exists, and lock it, the lock is released by Close.
+	// a read-only WAL doesn't touch the directory, which may be owned by another process.
+	// the directory of a shard is locked by its sharded WAL.
+	if !options.ReadOnly && options.shardCount == 0 {
+		if err := options.fs().MkdirAll(options.DirPath, options.dirPerm()); err != nil {
+			return nil, err
+		}
+		if wal.dirLock, err = lockDir(options.fs(), options.DirPath); err != nil {
+			return nil, err
+		}
+		// an interrupted Compact is finished if it was committed, its temporary files are deleted.
+		if err := recoverCompact(options); err != nil {
+			_ = unlockDir(wal.dirLock)
+			return nil, err
+		}
+		// and so are the cold segment files being written.
+		if err := removeSegmentFiles(options, coldFileExt(options.DiskFileExtension)); err != nil {
+			_ = unlockDir(wal.dirLock)
+			return nil, err
+		}
+		if options.MirrorDirPath != "" {
+			if err := options.fs().MkdirAll(options.MirrorDirPath, options.dirPerm()); err != nil {
+				_ = unlockDir(wal.dirLock)
+				return nil, err
+			}
+			if err := removeCompactFiles(options.mirrorOptions()); err != nil {
+				_ = unlockDir(wal.dirLock)
+				return nil, err
+			}
+		}
+		if err := mergeSmallSegments(options); err != nil {
+			_ = unlockDir(wal.dirLock)
+			return nil, err
+		}
+	}
+	defer func() {
+		if err != nil {
+			_ = unlockDir(wal.dirLock)
+		}
+	}()
+	// every shard is a WAL with its own segment files, a sharded WAL only routes to them.
+	if options.Shards > 1 {
+		if err = wal.openShards(); err != nil {
+			return nil, err
+		}
+		return wal, nil
 	}
 	if options.BlockCache > 0 {
-		var lruSize = options.BlockCache / blockSize
-		if options.BlockCache%blockSize != 0 {
+		var lruSize = int64(options.BlockCache) / blockSize
+		if int64(options.BlockCache)%blockSize != 0 {
 			lruSize += 1
 		}
-		cache, err := lru.New[uint64, []byte](int(lruSize))
+		cache, err := newBlockCache(int(lruSize))
+		if err != nil {
+			return nil, err
+		}
+		wal.blockCache = cache
+	}
+	if options.BlockCacheEntries > 0 {
+		cache, err := newBlockCache(options.BlockCacheEntries)
 		if err != nil {
 			return nil, err
 		}
 		wal.blockCache = cache
 	}
-	// iterate the dir and open all segment files.
-	entries, err := os.ReadDir(options.DirPath)
+	if options.MaxOpenSegments > 0 {
+		wal.handles = newSegmentHandles(options)
+	}
+	// iterate the dir and get all segment file ids.
+	segmentIDs, err := listSegmentIDs(options, options.DiskFileExtension)
 	if err != nil {
 		return nil, err
 	}
-
-	// get all segment file ids.
-	var segmentIDs []int
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	// keep the segment files of the shard.
+	ownedIDs := segmentIDs[:0]
+	for _, id := range segmentIDs {
+		if options.ownsSegment(uint32(id)) {
+			ownedIDs = append(ownedIDs, id)
 		}
-		var id int
-		_, err := fmt.Sscanf(entry.Name(), "%d"+options.DiskFileExtension, &id)
-		if err != nil {
-			continue
+	}
+	segmentIDs = ownedIDs
+	if options.RequireContiguousSegments {
+		if err := checkContiguous(options, segmentIDs); err != nil {
+			return nil, err
 		}
-		segmentIDs = append(segmentIDs, id)
 	}
 
-	// empty directory, just initialize a new segment file.
+	// empty directory, just initialize a new segment file,
+	// or leave it to the first write if NoInitialSegment.
 	if len(segmentIDs) == 0 {
-		segment, err := openSegmentFile(options.DirPath, options.DiskFileExtension,
-			initialSegmentFileID, wal.blockCache)
-		if err != nil {
-			return nil, err
+		if options.ReadOnly {
+			return nil, ErrEmpty
+		}
+		if !options.NoInitialSegment {
+			if err := wal.openInitialSegment(); err != nil {
+				return nil, err
+			}
 		}
-		wal.activeSegment = segment
 	} else {
 		// open the segment files in order, get the max one as the active segment file.
-		sort.Ints(segmentIDs)
-
+		// the files which are not segment files are skipped.
 		for i, segId := range segmentIDs {
-			segment, err := openSegmentFile(options.DirPath, options.DiskFileExtension,
-				uint32(segId), wal.blockCache)
+			segment, err := openSegmentFile(options, uint32(segId), wal.blockCache)
+			if errors.Is(err, ErrNotSegmentFile) {
+				continue
+			}
 			if err != nil {
-				return nil, err
+				return nil, segmentError("open", uint32(segId), err)
 			}
-			if i == len(segmentIDs)-1 {
+			segment.handles = wal.handles
+			// an empty older segment file, like one created right before a crash, is deleted,
+			// unless it would leave a gap for RequireContiguousSegments. The last one is the active one.
+			if i < len(segmentIDs)-1 && segment.isEmpty() && !options.ReadOnly && !options.RequireContiguousSegments {
+				if err := segment.Remove(); err != nil {
+					return nil, segmentError("remove", segment.id, err)
+				}
+				continue
+			}
+			// a cold segment file is never written, a new active segment file is opened after it.
+			if i == len(segmentIDs)-1 && !segment.cold {
 				wal.activeSegment = segment
 			} else {
-				wal.olderSegments[segment.id] = segment
+				wal.sealSegment(segment)
+			}
+		}
+		// the last file is skipped, the new active segment file takes the id after it.
+		if wal.activeSegment == nil && !options.ReadOnly {
+			lastID := SegSerialID(segmentIDs[len(segmentIDs)-1])
+			if wal.activeSegment, err = wal.openNewSegment("open", lastID); err != nil {
+				return nil, err
+			}
+		}
+		// cut the incomplete chunks left by a crash at the end of the last segment file.
+		if options.TruncatePartialTail && !options.ReadOnly {
+			size := wal.activeSegment.Size()
+			if _, _, err := repairSegment(wal.activeSegment); err != nil {
+				return nil, segmentError("truncate", wal.activeSegment.id, err)
 			}
+			wal.truncatedTail = size - wal.activeSegment.Size()
 		}
 	}
 
+	if options.AsyncRotateSync && !options.NoSyncOnRotate && !options.ReadOnly && wal.shards == nil {
+		wal.rotateSync = newRotateSyncer(wal)
+	}
+	if (options.SyncInterval > 0 || options.CompressColdSegments) && !options.ReadOnly {
+		wal.syncDone = make(chan struct{})
+	}
+	if options.SyncInterval > 0 && !options.ReadOnly {
+		wal.syncStopped.Add(1)
+		go wal.syncPeriodically(options.SyncInterval)
+	}
+	if options.CompressColdSegments && !options.ReadOnly {
+		wal.syncStopped.Add(1)
+		go wal.compressPeriodically(options.coldSegmentAge() / 2)
+	}
+
 	return wal, nil
 }
 
+// checkContiguous returns an error naming the first missing segment id if there is a gap
+// between the sorted ids, according to nextSegmentID.
+func checkContiguous(options Options, segmentIDs []int) error {
+	for i := 1; i < len(segmentIDs); i++ {
+		next, err := options.nextSegmentID(SegSerialID(segmentIDs[i-1]))
+		if err != nil {
+			return err
+		}
+		if SegSerialID(segmentIDs[i]) != next {
+			return fmt.Errorf("%w: %d%s", ErrSegmentMissing, next, options.DiskFileExtension)
+		}
+	}
+	return nil
+}
+
+// syncPeriodically syncs the active segment file every interval until syncDone is closed.
+// The sync errors are dropped, the next tick syncs the file again.
+func (wal *WAL) syncPeriodically(interval time.Duration) {
+	defer wal.syncStopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wal.syncDone:
+			return
+		case <-ticker.C:
+			wal.mu.Lock()
+			if wal.activeSegment != nil && wal.activeSegment.refs.Load() > 0 {
+				if err := wal.syncSegment(wal.activeSegment); err == nil {
+					wal.markSynced()
+				}
+			}
+			wal.mu.Unlock()
+		}
+	}
+}
+
+// stopSync stops the background goroutines, and waits for them to exit.
+func (wal *WAL) stopSync() {
+	wal.stopSyncOnce.Do(func() {
+		if wal.syncDone != nil {
+			close(wal.syncDone)
+			wal.syncStopped.Wait()
+		}
+	})
+}
+
+// listSegmentIDs returns the sorted ids of all segment files with the extension in the directory.
+func listSegmentIDs(options Options, extName string) ([]int, error) {
+	entries, err := options.fs().ReadDir(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var segmentIDs []int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		id, ok := options.parseSegmentID(entry.Name(), extName)
+		if !ok {
+			continue
+		}
+		segmentIDs = append(segmentIDs, int(id))
+	}
+	// sorted as SegSerialID, the ids above 2^31 are negative ints on 32-bit platforms.
+	sort.Slice(segmentIDs, func(i, j int) bool {
+		return SegSerialID(segmentIDs[i]) < SegSerialID(segmentIDs[j])
+	})
+	return segmentIDs, nil
+}
+
+// segmentFileName returns the path of the segment file by FileNameFunc, SegmentFileName by default.
+func (options Options) segmentFileName(extName string, id SegSerialID) string {
+	if options.FileNameFunc != nil {
+		return options.FileNameFunc(options.DirPath, extName, id)
+	}
+	return SegmentFileName(options.DirPath, extName, id)
+}
+
+// parseSegmentID returns the id of the segment file name by ParseIDFunc, ParseSegmentID by default.
+func (options Options) parseSegmentID(name, extName string) (SegSerialID, bool) {
+	if options.ParseIDFunc != nil {
+		return options.ParseIDFunc(name, extName)
+	}
+	return ParseSegmentID(name, extName)
+}
+
+// ParseSegmentID returns the id of a segment file named by SegmentFileName,
+// false is returned if the name is not a segment file name with the extension.
+// The whole name must match, like the checksum file of a segment file doesn't.
+func ParseSegmentID(name, extName string) (SegSerialID, bool) {
+	digits, ok := strings.CutSuffix(name, extName)
+	if !ok || digits == "" {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	id, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return SegSerialID(id), true
+}
+
 func SegmentFileName(dirPath string, extName string, id SegSerialID) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d"+extName, id))
 }
 
+// OpenNewActiveSegment syncs the active segment file (unless NoSyncOnRotate is set)
+// and replaces it by a new empty one, even though it is not full.
 func (wal *WAL) OpenNewActiveSegment() error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return ErrShardsUnsupported
+	}
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
-	// sync the active segment file.
-	if err := wal.activeSegment.Sync(); err != nil {
-		return err
+
+	return wal.rotateActiveSegment()
+}
+
+// TruncatedTail returns the number of bytes truncated by Open from the end of the last
+// segment file with TruncatePartialTail, the sum of the shards for a sharded WAL.
+func (wal *WAL) TruncatedTail() int64 {
+	size := wal.truncatedTail
+	for _, shard := range wal.shards {
+		size += shard.TruncatedTail()
 	}
-	// create a new segment file and set it as the active one.
-	segment, err := openSegmentFile(wal.options.DirPath, wal.options.DiskFileExtension,
-		wal.activeSegment.id+1, wal.blockCache)
-	if err != nil {
-		return err
+	return size
+}
+
+// LastWriteRotated reports whether the last write, by Write, WriteAll, Flush or a batch,
+// rotated the active segment file before writing, so the record starts a new segment file.
+// Another writer may write in between, so it is only reliable with a single writer.
+func (wal *WAL) LastWriteRotated() bool {
+	return wal.lastWriteRotated.Load()
+}
+
+// SegmentIDs returns the ids of the older segment files and the active one, sorted,
+// the ones of all the shards if the WAL is sharded.
+func (wal *WAL) SegmentIDs() []SegSerialID {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	segments := wal.sortedSegments()
+	ids := make([]SegSerialID, 0, len(segments))
+	for _, segment := range segments {
+		ids = append(ids, segment.id)
 	}
-	wal.olderSegments[wal.activeSegment.id] = wal.activeSegment
-	wal.activeSegment = segment
-	return nil
+	return ids
+}
+
+// SegmentPath returns the path of the segment file with the id, with the current extension
+// set by RenameFileExt. ErrSegmentNotFound or ErrSegmentRemoved is returned if the WAL doesn't have it.
+// The file is only safe to copy as a whole once it is an older segment file, and may be
+// deleted meanwhile, like by MaxSegments.
+func (wal *WAL) SegmentPath(id SegSerialID) (string, error) {
+	if wal.shards != nil {
+		return wal.shardOf(id).SegmentPath(id)
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.getSegment(id) == nil {
+		return "", wal.segmentNotFound(id)
+	}
+	return wal.options.segmentFileName(wal.options.DiskFileExtension, id), nil
 }
 
 func (wal *WAL) ActiveSegmentID() SegSerialID {
+	// the largest id of the active segments of the shards.
+	if wal.shards != nil {
+		var id SegSerialID
+		for _, shard := range wal.shards {
+			id = max(id, shard.ActiveSegmentID())
+		}
+		return id
+	}
 	wal.mu.RLock()
 	defer wal.mu.RUnlock()
 
+	if wal.activeSegment == nil {
+		return 0
+	}
 	return wal.activeSegment.id
 }
 
+// IsActive reports whether the segment file of the id is the active one, or the active one
+// of a shard. Only the active segment files are written, the older ones are sealed.
+func (wal *WAL) IsActive(id SegSerialID) bool {
+	if wal.shards != nil {
+		return wal.shardOf(id).IsActive(id)
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	return wal.activeSegment != nil && wal.activeSegment.id == id
+}
+
 // IsEmpty returns whether the WAL is empty.
 // Only there is only one empty active segment file, which means the WAL is empty.
 func (wal *WAL) IsEmpty() bool {
+	if wal.shards != nil {
+		for _, shard := range wal.shards {
+			if !shard.IsEmpty() {
+				return false
+			}
+		}
+		return true
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	return len(wal.olderSegments) == 0 && (wal.activeSegment == nil || wal.activeSegment.isEmpty())
+}
+
+// RemainingSpace returns the number of bytes left in the active segment file before SegmentSize,
+// or the size SegmentSizeFunc returned for it.
+// For a sharded WAL, it is the smallest one of the shards.
+func (wal *WAL) RemainingSpace() int64 {
+	if wal.shards != nil {
+		space := wal.shards[0].RemainingSpace()
+		for _, shard := range wal.shards[1:] {
+			space = min(space, shard.RemainingSpace())
+		}
+		return space
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	if wal.activeSegment == nil {
+		return wal.options.SegmentSize
+	}
+	return wal.activeSegmentSize() - wal.activeSegment.Size()
+}
+
+// WillFit reports whether a record of dataLen bytes can be written to the active segment file
+// without a rotation, counting the chunk headers of the blocks it may span.
+func (wal *WAL) WillFit(dataLen int64) bool {
+	return wal.options.maxDataWriteSize(dataLen+wal.options.recordOverhead()) <= wal.RemainingSpace()
+}
+
+// NewReaderForSegment returns a new reader for the WAL, which only reads
+// the segment file with the given id, and returns io.EOF at its end.
+func (wal *WAL) NewReaderForSegment(segId SegSerialID) (*Reader, error) {
+	if wal.shards != nil {
+		return wal.shardOf(segId).NewReaderForSegment(segId)
+	}
 	wal.mu.RLock()
 	defer wal.mu.RUnlock()
 
-	return len(wal.olderSegments) == 0 && wal.activeSegment.Size() == 0
+	segment := wal.getSegment(segId)
+	if segment == nil || !segment.acquireForReader() {
+		return nil, wal.segmentNotFound(segId)
+	}
+
+	reader := &Reader{
+		segmentReaders: []*segmentReader{segment.NewReader()},
+		currentReader:  0,
+	}
+	// release the segment file if the reader is never closed.
+	runtime.SetFinalizer(reader, (*Reader).Close)
+	return reader, nil
 }
 
 // NewReaderWithMax returns a new reader for the WAL,
 func (wal *WAL) NewReaderWithMax(segId SegSerialID) *Reader {
 	wal.mu.RLock()
 	defer wal.mu.RUnlock()
+	return wal.newReaderLocked(segId)
+}
 
-	// get all segment readers.
+// newReaderLocked is NewReaderWithMax, with the WAL locked.
+func (wal *WAL) newReaderLocked(segId SegSerialID) *Reader {
+	// get all segment readers, sorted by segment id.
 	var segmentReaders []*segmentReader
-	for _, segment := range wal.olderSegments {
-		if segId == 0 || segment.id <= segId {
-			reader := segment.NewReader()
-			segmentReaders = append(segmentReaders, reader)
+	for _, segment := range wal.sortedSegments() {
+		if (segId == 0 || segment.id <= segId) && segment.acquireForReader() {
+			segmentReaders = append(segmentReaders, segment.NewReader())
 		}
 	}
-	if segId == 0 || wal.activeSegment.id <= segId {
-		reader := wal.activeSegment.NewReader()
-		segmentReaders = append(segmentReaders, reader)
+
+	reader := &Reader{
+		segmentReaders: segmentReaders,
+		currentReader:  0,
 	}
+	// release the segment files if the reader is never closed.
+	runtime.SetFinalizer(reader, (*Reader).Close)
+	return reader
+}
 
-	// sort the segment readers by segment id.
-	sort.Slice(segmentReaders, func(i, j int) bool {
-		return segmentReaders[i].segment.id < segmentReaders[j].segment.id
+// NewMultiReader returns a new reader reading the segment files of several WALs,
+// like the hot and cold tiers of a log, as one WAL in the order of their ids.
+// If several WALs have a segment file with the same id, the one of the first
+// WAL in the arguments is read and the others are skipped.
+func NewMultiReader(wals ...*WAL) *Reader {
+	var segments []*segment
+	seen := make(map[SegSerialID]bool)
+	for _, wal := range wals {
+		wal.mu.RLock()
+		for _, segment := range wal.sortedSegments() {
+			if !seen[segment.id] && segment.acquireForReader() {
+				seen[segment.id] = true
+				segments = append(segments, segment)
+			}
+		}
+		wal.mu.RUnlock()
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
 	})
 
-	return &Reader{
-		segmentReaders: segmentReaders,
-		currentReader:  0,
+	segmentReaders := make([]*segmentReader, 0, len(segments))
+	for _, segment := range segments {
+		segmentReaders = append(segmentReaders, segment.NewReader())
 	}
+	reader := &Reader{segmentReaders: segmentReaders}
+	// release the segment files if the reader is never closed.
+	runtime.SetFinalizer(reader, (*Reader).Close)
+	return reader
 }
 
 // NewReaderWithStart returns a new reader for the WAL,
 // and the reader will only read the data from the segment file
 // whose position is greater than or equal to the given position.
 func (wal *WAL) NewReaderWithStart(startPos *ChunkPosition) (*Reader, error) {
+	return wal.newReaderFrom(startPos, false)
+}
+
+// NewReaderAfter returns a new reader for the WAL, which reads the chunks
+// strictly after the given position, like the last chunk already consumed.
+func (wal *WAL) NewReaderAfter(pos *ChunkPosition) (*Reader, error) {
+	return wal.newReaderFrom(pos, true)
+}
+
+// NewReaderFromTime returns a new reader for the WAL, which starts at the first record
+// written at or after t, according to the write times stored by StoreTimestamps.
+// The records are read in order from there, the records without a write time are
+// read as written at the zero time, so they are skipped if they come first.
+func (wal *WAL) NewReaderFromTime(t time.Time) (*Reader, error) {
+	reader := wal.NewReader()
+	for {
+		_, pos, meta, err := reader.NextWithMeta()
+		if err == io.EOF {
+			return reader, nil
+		}
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		if !meta.Time.Before(t) {
+			if err := reader.Seek(pos); err != nil {
+				reader.Close()
+				return nil, err
+			}
+			return reader, nil
+		}
+	}
+}
+
+// newReaderFrom returns a new reader skipping the chunks before startPos,
+// and startPos itself if after is true.
+func (wal *WAL) newReaderFrom(startPos *ChunkPosition, after bool) (*Reader, error) {
 	if startPos == nil {
 		return nil, errors.New("start position is nil")
 	}
-	wal.mu.RLock()
-	defer wal.mu.RUnlock()
 
 	reader := wal.NewReader()
-	for {
+	if err := reader.skipTo(startPos, after); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// skipTo skips the chunks before startPos, and startPos itself if after is true.
+func (r *Reader) skipTo(startPos *ChunkPosition, after bool) error {
+	for r.Valid() {
 		// skip the segment readers whose id is less than the given position's segment id.
-		if reader.CurrentSegmentId() < startPos.SegmentId {
-			reader.SkipCurrentSegment()
+		if r.CurrentSegmentId() < startPos.SegmentId {
+			r.SkipCurrentSegment()
 			continue
 		}
 		// skip the chunk whose position is less than the given position.
-		currentPos := reader.CurrentChunkPosition()
-		if currentPos.BlockNumber >= startPos.BlockNumber &&
-			currentPos.ChunkOffset >= startPos.ChunkOffset {
+		currentPos := r.CurrentChunkPosition()
+		order := currentPos.Compare(startPos)
+		if order > 0 || (order == 0 && !after) {
 			break
 		}
+		// the rest of the segment is before the given position, calling Next
+		// would read the first chunk of the next segment.
+		reader := r.segmentReaders[r.currentReader]
+		if int64(currentPos.BlockNumber)*reader.segment.blockSize+currentPos.ChunkOffset >= reader.size {
+			r.SkipCurrentSegment()
+			continue
+		}
 		// call Next to find again.
-		if _, _, err := reader.Next(); err != nil {
+		if _, _, err := r.Next(); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			return err
 		}
 	}
-	return reader, nil
+	return nil
+}
+
+// Seek repositions the reader, so that the next call to Next returns the chunk
+// at or after the given position, it can move the reader forward or backward.
+// An error is returned if the position is after the segment files of the reader.
+func (r *Reader) Seek(pos *ChunkPosition) error {
+	if pos == nil {
+		return errors.New("seek position is nil")
+	}
+	if r.closed {
+		return ErrClosed
+	}
+	if len(r.segmentReaders) == 0 || pos.SegmentId > r.segmentReaders[len(r.segmentReaders)-1].segment.id {
+		return fmt.Errorf("seek position in segment file %d is beyond the segment files of the reader", pos.SegmentId)
+	}
+
+	// rewind all segment readers, and skip to the position again.
+	r.peeked = nil
+	r.currentReader = 0
+	for _, reader := range r.segmentReaders {
+		reader.blockNumber = 0
+		reader.chunkOffset = reader.segment.dataStart
+	}
+	return r.skipTo(pos, false)
 }
 
 // NewReader returns a new reader for the WAL.
 // It will iterate all segment files and read all data from them.
+// It reads a snapshot of the WAL, the records written after it is created are not read.
 func (wal *WAL) NewReader() *Reader {
 	return wal.NewReaderWithMax(0)
 }
 
-// Next returns the next chunk data and its position in the WAL.
-// If there is no data, io.EOF will be returned.
-//
-// The position can be used to read the data from the segment file.
-func (r *Reader) Next() ([]byte, *ChunkPosition, error) {
-	if r.currentReader >= len(r.segmentReaders) {
-		return nil, nil, io.EOF
-	}
+// NewReaderResilient returns a new reader for the WAL like NewReader, whose Next skips
+// the corrupted or incomplete records rather than returning an error: it goes on with the next
+// record starting after the block of the skipped one, whose position is then returned by
+// SkippedPositions. The records after it in its block are lost too. NextRawChunk doesn't skip.
+func (wal *WAL) NewReaderResilient() *Reader {
+	reader := wal.NewReader()
+	reader.resilient = true
+	return reader
+}
 
-	data, position, err := r.segmentReaders[r.currentReader].Next()
-	if err == io.EOF {
-		r.currentReader++
-		return r.Next()
-	}
-	return data, position, err
+// SkippedPositions returns the positions of the records skipped by a reader of NewReaderResilient,
+// and of the chunks failing to be read while it looked for the next record.
+func (r *Reader) SkippedPositions() []*ChunkPosition {
+	return r.skipped
 }
 
-func (r *Reader) SkipCurrentSegment() {
+// NewReverseReader returns a new reader that iterates the WAL from the
+// tail of the active segment back to the first chunk of the oldest segment.
+func (wal *WAL) NewReverseReader() *ReverseReader {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	var segments []*segment
+	for _, segment := range wal.sortedSegments() {
+		if segment.acquire() {
+			segments = append(segments, segment)
+		}
+	}
+
+	reader := &ReverseReader{
+		segments:       segments,
+		currentSegment: len(segments) - 1,
+	}
+	runtime.SetFinalizer(reader, (*ReverseReader).Close)
+	return reader
+}
+
+// Close releases the segment files held by the reader, it can't be used afterward.
+func (r *ReverseReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+
+	var err error
+	for _, segment := range r.segments {
+		if e := segment.release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	r.segments, r.positions, r.currentSegment = nil, nil, -1
+	return err
+}
+
+// Next returns the previous chunk data and its position in the WAL.
+// If the first chunk of the WAL has been returned, io.EOF will be returned.
+//
+// Chunks are variable length, so a segment is scanned forward once to
+// collect its chunk boundaries before its records are returned backward.
+func (r *ReverseReader) Next() ([]byte, *ChunkPosition, error) {
+	for len(r.positions) == 0 {
+		if r.currentSegment < 0 {
+			return nil, nil, io.EOF
+		}
+		segment := r.segments[r.currentSegment]
+		reader := segment.NewReader()
+		for {
+			_, pos, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			r.positions = append(r.positions, pos)
+		}
+		r.reading = segment
+		r.currentSegment--
+	}
+
+	pos := r.positions[len(r.positions)-1]
+	r.positions = r.positions[:len(r.positions)-1]
+	data, err := r.reading.Read(pos.BlockNumber, pos.ChunkOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, pos, nil
+}
+
+// FirstPosition returns the position of the first chunk of the WAL,
+// ErrEmpty is returned if there is no chunk.
+func (wal *WAL) FirstPosition() (*ChunkPosition, error) {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	for _, segment := range wal.sortedSegments() {
+		if segment.isEmpty() {
+			continue
+		}
+		_, pos, err := segment.NewReader().Next()
+		if err == io.EOF {
+			continue
+		}
+		return pos, err
+	}
+	return nil, ErrEmpty
+}
+
+// LastPosition returns the position of the most recently written chunk,
+// ErrEmpty is returned if there is no chunk.
+// After Open, the chunks of the last non-empty segment are scanned once to find it.
+func (wal *WAL) LastPosition() (*ChunkPosition, error) {
+	if wal.shards != nil {
+		return nil, ErrShardsUnsupported
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.lastPosition == nil {
+		segments := wal.sortedSegments()
+		for i := len(segments) - 1; i >= 0 && wal.lastPosition == nil; i-- {
+			reader := segments[i].NewReader()
+			for {
+				_, pos, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				wal.lastPosition = pos
+			}
+		}
+		if wal.lastPosition == nil {
+			return nil, ErrEmpty
+		}
+	}
+	pos := *wal.lastPosition
+	return &pos, nil
+}
+
+// Next returns the next chunk data and its position in the WAL.
+// If there is no data, io.EOF will be returned.
+//
+// The position can be used to read the data from the segment file.
+func (r *Reader) Next() ([]byte, *ChunkPosition, error) {
+	data, position, _, err := r.NextWithMeta()
+	return data, position, err
+}
+
+// NextWithType is like Next, and also returns the RecordType of the record,
+// 0 for the records written by Write and the logs written before types were supported.
+func (r *Reader) NextWithType() ([]byte, *ChunkPosition, RecordType, error) {
+	data, position, meta, err := r.NextWithMeta()
+	return data, position, meta.Type, err
+}
+
+// NextWithMeta is like Next, and also returns the RecordMeta describing
+// how the record is stored, like its on-disk size and the number of blocks it spans.
+func (r *Reader) NextWithMeta() ([]byte, *ChunkPosition, RecordMeta, error) {
+	if peeked := r.peeked; peeked != nil {
+		r.peeked = nil
+		return peeked.data, peeked.pos, peeked.meta, nil
+	}
+	if r.currentReader >= len(r.segmentReaders) {
+		return nil, nil, RecordMeta{}, io.EOF
+	}
+
+	reader := r.segmentReaders[r.currentReader]
+	blockNumber, chunkOffset := reader.blockNumber, reader.chunkOffset
+	data, position, meta, err := reader.nextWithMeta()
+	if err == io.EOF {
+		r.currentReader++
+		return r.NextWithMeta()
+	}
+	if r.resilient && isCorrupted(err) {
+		r.skipCorrupted(reader, blockNumber, chunkOffset)
+		return r.NextWithMeta()
+	}
+	return data, position, meta, err
+}
+
+// isCorrupted reports whether the error is the one of a corrupted or incomplete chunk.
+func isCorrupted(err error) bool {
+	return errors.Is(err, ErrInvalidCRC) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// skipCorrupted records the position of the record failing to be read, and moves the reader
+// to the next record starting after the block it starts in, past the chunks continuing a record.
+func (r *Reader) skipCorrupted(reader *segmentReader, blockNumber uint32, chunkOffset int64) {
+	for {
+		r.skipped = append(r.skipped, &ChunkPosition{
+			SegmentId:   reader.segment.id,
+			BlockNumber: blockNumber,
+			ChunkOffset: chunkOffset,
+		})
+		// resynchronize at the start of the next block.
+		reader.blockNumber, reader.chunkOffset = blockNumber+1, 0
+		var err error
+		for {
+			blockNumber, chunkOffset = reader.blockNumber, reader.chunkOffset
+			var chunk RawChunk
+			chunk, _, err = reader.nextRawChunk()
+			if err != nil || chunk.Type == ChunkTypeFull || chunk.Type == ChunkTypeFirst {
+				break
+			}
+		}
+		if !isCorrupted(err) {
+			// the record starting here, the end of the segment file or another error is read by Next.
+			reader.blockNumber, reader.chunkOffset = blockNumber, chunkOffset
+			return
+		}
+	}
+}
+
+// NextRawChunk returns the next physical chunk, one at a time, with its type and position,
+// instead of the records reassembled from them by Next. The ChunkSize of the position is
+// the size of the chunk with its header. Next must only be called again at a record boundary,
+// after a chunk of the type ChunkTypeFull or ChunkTypeLast.
+// It returns io.EOF if there is no chunk left.
+func (r *Reader) NextRawChunk() (RawChunk, *ChunkPosition, error) {
+	// go back to the record returned by Peek, to return its chunks.
+	if peeked := r.peeked; peeked != nil {
+		r.peeked = nil
+		reader := r.segmentReaders[r.currentReader]
+		reader.blockNumber = peeked.pos.BlockNumber
+		reader.chunkOffset = peeked.pos.ChunkOffset
+	}
+	if r.currentReader >= len(r.segmentReaders) {
+		return RawChunk{}, nil, io.EOF
+	}
+
+	chunk, position, err := r.segmentReaders[r.currentReader].nextRawChunk()
+	if err == io.EOF {
+		r.currentReader++
+		return r.NextRawChunk()
+	}
+	return chunk, position, err
+}
+
+// NextPosition returns the position of the next record like Next, without reading its data:
+// only the headers of its chunks are read, to find where it ends, which is much faster
+// to index the records. The checksums are not verified, the corrupted records are only
+// found by Next. It returns io.EOF if there is no record left.
+func (r *Reader) NextPosition() (*ChunkPosition, error) {
+	if peeked := r.peeked; peeked != nil {
+		r.peeked = nil
+		return peeked.pos, nil
+	}
+	if r.currentReader >= len(r.segmentReaders) {
+		return nil, io.EOF
+	}
+
+	position, err := r.segmentReaders[r.currentReader].nextPosition()
+	if err == io.EOF {
+		r.currentReader++
+		return r.NextPosition()
+	}
+	return position, err
+}
+
+// Close releases the segment files held by the reader, it can't be used afterward.
+// A reader that is not closed releases them when it is garbage collected.
+func (r *Reader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+
+	var err error
+	for _, reader := range r.segmentReaders {
+		if e := reader.segment.releaseForReader(); e != nil && err == nil {
+			err = e
+		}
+	}
+	r.segmentReaders = nil
+	return err
+}
+
+func (r *Reader) SkipCurrentSegment() {
+	r.peeked = nil
 	r.currentReader++
 }
 
+// Valid reports whether the reader still has segments to read,
+// CurrentSegmentId and CurrentChunkPosition are only meaningful when it is true.
+func (r *Reader) Valid() bool {
+	return r.currentReader < len(r.segmentReaders)
+}
+
+// CurrentSegmentId returns the id of the segment being read, 0 if the reader is exhausted.
 func (r *Reader) CurrentSegmentId() SegSerialID {
+	if !r.Valid() {
+		return 0
+	}
 	return r.segmentReaders[r.currentReader].segment.id
 }
 
+// Peek returns the record which the next call to Next returns, without advancing the reader.
+// It returns io.EOF if there is no record left, and the reader is not changed either.
+func (r *Reader) Peek() ([]byte, *ChunkPosition, error) {
+	if r.peeked == nil {
+		data, pos, meta, err := r.NextWithMeta()
+		if err != nil {
+			return nil, nil, err
+		}
+		r.peeked = &peekedRecord{data: data, pos: pos, meta: meta}
+	}
+	return r.peeked.data, r.peeked.pos, nil
+}
+
+// CurrentChunkPosition returns the position of the next chunk to read, nil if the reader is exhausted.
 func (r *Reader) CurrentChunkPosition() *ChunkPosition {
+	if r.peeked != nil {
+		return r.peeked.pos
+	}
+	if !r.Valid() {
+		return nil
+	}
 	reader := r.segmentReaders[r.currentReader]
 	return &ChunkPosition{
 		SegmentId:   reader.segment.id,
@@ -270,55 +1147,368 @@ func (wal *WAL) PendingWrites(data []byte) {
 	wal.pendingWritesLock.Lock()
 	defer wal.pendingWritesLock.Unlock()
 
-	size := wal.maxDataWriteSize(int64(len(data)))
+	size := wal.options.maxDataWriteSize(int64(len(data)) + wal.options.recordOverhead())
 	wal.pendingSize += size
 	wal.pendingWrites = append(wal.pendingWrites, data)
 }
 
+// PendingSize returns the maximum size the pending writes take in a segment file,
+// it is compared with SegmentSize by WriteAll.
+func (wal *WAL) PendingSize() int64 {
+	wal.pendingWritesLock.Lock()
+	defer wal.pendingWritesLock.Unlock()
+	return wal.pendingSize
+}
+
+// PendingCount returns the number of pending writes.
+func (wal *WAL) PendingCount() int {
+	wal.pendingWritesLock.Lock()
+	defer wal.pendingWritesLock.Unlock()
+	return len(wal.pendingWrites)
+}
+
+// PendingWritesSnapshot returns a copy of the pending writes, in the order they are written by
+// WriteAll, to inspect them while debugging. It copies every record, O(n) in their total size,
+// so the returned slices never alias the buffers of the pending writes.
+func (wal *WAL) PendingWritesSnapshot() [][]byte {
+	wal.pendingWritesLock.Lock()
+	defer wal.pendingWritesLock.Unlock()
+
+	snapshot := make([][]byte, len(wal.pendingWrites))
+	for i, data := range wal.pendingWrites {
+		snapshot[i] = bytes.Clone(data)
+	}
+	return snapshot
+}
+
 func (wal *WAL) rotateActiveSegment() error {
-	if err := wal.activeSegment.Sync(); err != nil {
+	if wal.activeSegment == nil {
+		return wal.openInitialSegment()
+	}
+	start := time.Now()
+	// synced after the rotation by rotateSync.
+	if !wal.options.NoSyncOnRotate && wal.rotateSync == nil {
+		if err := wal.syncSegment(wal.activeSegment); err != nil {
+			return segmentError("sync", wal.activeSegment.id, err)
+		}
+	}
+	wal.markSynced()
+	segment, err := wal.openNewSegment("rotate", wal.activeSegment.id)
+	if err != nil {
 		return err
 	}
-	wal.bytesWrite = 0
-	segment, err := openSegmentFile(wal.options.DirPath, wal.options.DiskFileExtension,
-		wal.activeSegment.id+1, wal.blockCache)
+	// the new segment file is removed if the active one can't be sealed,
+	// the next rotation creates it again.
+	if err := wal.activeSegment.trim(); err != nil {
+		_ = segment.Remove()
+		return segmentError("trim", wal.activeSegment.id, err)
+	}
+	if wal.options.SegmentFooterChecksum {
+		if err := wal.activeSegment.writeChecksumFile(); err != nil {
+			_ = segment.Remove()
+			return segmentError("checksum", wal.activeSegment.id, err)
+		}
+	}
+	oldID := wal.activeSegment.id
+	// the age of CompressColdSegments counts from the rotation.
+	wal.activeSegment.lastAccess.Store(time.Now().UnixNano())
+	if wal.rotateSync != nil {
+		wal.rotateSync.add(wal.activeSegment)
+	}
+	wal.sealSegment(wal.activeSegment)
+	wal.activeSegment = segment
+	wal.rotations++
+	if wal.options.OnRotateLatency != nil {
+		wal.options.OnRotateLatency(time.Since(start))
+	}
+	if wal.options.OnRotate != nil {
+		wal.options.OnRotate(oldID, segment.id)
+	}
+
+	return wal.evictOldSegments()
+}
+
+// syncSegment syncs the segment file, and reports how long it took to OnSyncLatency.
+func (wal *WAL) syncSegment(segment *segment) error {
+	start := time.Now()
+	err := segment.Sync()
+	if wal.options.OnSyncLatency != nil {
+		wal.options.OnSyncLatency(time.Since(start))
+	}
+	return err
+}
+
+// openInitialSegment opens the first segment file of an empty WAL as the active one.
+func (wal *WAL) openInitialSegment() error {
+	segment, err := wal.openNewSegment("open", 0)
 	if err != nil {
 		return err
 	}
-	wal.olderSegments[wal.activeSegment.id] = wal.activeSegment
 	wal.activeSegment = segment
 	return nil
 }
 
+// openNewSegment creates the segment file after prevID, 0 for the first one,
+// with the id given by NextIDFunc and the size given by SegmentSizeFunc.
+// The errors are reported as a SegmentError of op.
+func (wal *WAL) openNewSegment(op string, prevID SegSerialID) (*segment, error) {
+	id, err := wal.options.nextSegmentID(prevID)
+	if err != nil {
+		return nil, segmentError(op, prevID, err)
+	}
+	options := wal.options
+	if options.SegmentSize, err = options.segmentSize(prevID); err != nil {
+		return nil, segmentError(op, id, err)
+	}
+	segment, err := openSegmentFile(options, id, wal.blockCache)
+	if err != nil {
+		return nil, segmentError(op, id, err)
+	}
+	segment.handles = wal.handles
+	return segment, nil
+}
+
+// sealSegment makes the segment an older segment file, whose file may be closed by MaxOpenSegments.
+func (wal *WAL) sealSegment(segment *segment) {
+	segment.seal()
+	wal.olderSegments[segment.id] = segment
+	if wal.handles != nil {
+		wal.handles.add(segment)
+	}
+}
+
+// ensureActiveSegment opens the initial segment file if there is no active one yet,
+// which is left to the first write by NoInitialSegment.
+func (wal *WAL) ensureActiveSegment() error {
+	if wal.activeSegment != nil {
+		return nil
+	}
+	return wal.openInitialSegment()
+}
+
+// evictOldSegments deletes the oldest segment files while there are more than MaxSegments,
+// or their total size is larger than MaxTotalSize.
+func (wal *WAL) evictOldSegments() error {
+	if wal.options.MaxSegments <= 0 && wal.options.MaxTotalSize <= 0 {
+		return nil
+	}
+	totalSize := wal.activeSegment.Size()
+	for _, segment := range wal.olderSegments {
+		totalSize += segment.Size()
+	}
+	// the stricter of the two limits applies, the active segment file is always kept.
+	for len(wal.olderSegments) > 0 {
+		overCount := wal.options.MaxSegments > 0 && len(wal.olderSegments)+1 > wal.options.MaxSegments
+		overSize := wal.options.MaxTotalSize > 0 && totalSize > wal.options.MaxTotalSize
+		if !overCount && !overSize {
+			break
+		}
+		oldest := wal.activeSegment.id
+		for id := range wal.olderSegments {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		totalSize -= wal.olderSegments[oldest].Size()
+		if err := wal.olderSegments[oldest].Remove(); err != nil {
+			return segmentError("remove", oldest, err)
+		}
+		delete(wal.olderSegments, oldest)
+		if wal.options.OnSegmentEvicted != nil {
+			wal.options.OnSegmentEvicted(oldest)
+		}
+	}
+	return nil
+}
+
+// WriteAll writes the pending writes to the active segment file,
+// and syncs it according to DiskFlushSync and BytesPerSync like Write.
 func (wal *WAL) WriteAll() ([]*ChunkPosition, error) {
+	return wal.WriteAllContext(context.Background())
+}
+
+// Flush is like WriteAll, but it never syncs the active segment file,
+// the written data is only in the OS buffer cache until Sync is called.
+// The flushed bytes still count for BytesPerSync, so the next Write syncs when it is reached.
+func (wal *WAL) Flush() ([]*ChunkPosition, error) {
 	if len(wal.pendingWrites) == 0 {
 		return make([]*ChunkPosition, 0), nil
 	}
 
 	wal.mu.Lock()
-	defer func() {
+	defer wal.mu.Unlock()
+
+	positions, _, err := wal.writeBatch(context.Background(), wal.pendingWrites, wal.pendingSize)
+	if err == nil {
+		wal.notifyWrite(positions, wal.pendingWrites)
+	}
+	wal.ClearPendingWrites()
+	return positions, err
+}
+
+// WriteAllContext is like WriteAll, but it gives up once ctx is done.
+// ctx is checked after the lock is acquired and again after a rotation
+// (which syncs the old segment file), right before the batch is appended.
+// When ctx.Err() is returned nothing of the batch has been appended and the
+// pending writes are kept, so they can be written by a later call.
+// Note a rotation may already have happened at that point.
+func (wal *WAL) WriteAllContext(ctx context.Context) ([]*ChunkPosition, error) {
+	positions, _, err := wal.writeAllContext(ctx)
+	return positions, err
+}
+
+// WriteResult describes the pending writes written by WriteAllResult.
+type WriteResult struct {
+	Positions []*ChunkPosition
+	// SegmentIDs are the ids of the segment files the records were written to, in order.
+	// There is only one, unless the batch spans segment files with AllowBatchSpanSegments.
+	SegmentIDs []SegSerialID
+	// Rotated reports whether the active segment file was rotated by the write.
+	Rotated bool
+}
+
+// WriteAllResult is like WriteAll, and also returns the segment files written and whether
+// the active segment file was rotated, as seen by the write itself, unlike LastWriteRotated
+// and ActiveSegmentID which may already reflect another writer.
+func (wal *WAL) WriteAllResult() (WriteResult, error) {
+	positions, rotated, err := wal.writeAllContext(context.Background())
+	result := WriteResult{Positions: positions, Rotated: rotated}
+	for _, pos := range positions {
+		if n := len(result.SegmentIDs); n == 0 || result.SegmentIDs[n-1] != pos.SegmentId {
+			result.SegmentIDs = append(result.SegmentIDs, pos.SegmentId)
+		}
+	}
+	return result, err
+}
+
+// writeAllContext writes the pending writes like WriteAllContext, and also returns whether
+// the active segment file was rotated.
+func (wal *WAL) writeAllContext(ctx context.Context) ([]*ChunkPosition, bool, error) {
+	if len(wal.pendingWrites) == 0 {
+		return make([]*ChunkPosition, 0), false, nil
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	positions, rotated, err := wal.writeBatch(ctx, wal.pendingWrites, wal.pendingSize)
+	if err == nil {
+		wal.notifyWrite(positions, wal.pendingWrites)
+	}
+	// keep the pending writes if cancelled, so they can be written later.
+	if err == nil || err != ctx.Err() {
 		wal.ClearPendingWrites()
-		wal.mu.Unlock()
+	}
+	if err != nil {
+		return positions, rotated, err
+	}
+	if err := wal.syncIfNeeded(); err != nil {
+		return nil, rotated, err
+	}
+	return positions, rotated, nil
+}
+
+// writeBatch writes the records to the active segment file at once, rotating it first if needed,
+// and reports whether it rotated. size is the sum of maxDataWriteSize of the records.
+// ctx is checked before and after the rotation. The caller must hold wal.mu.
+func (wal *WAL) writeBatch(ctx context.Context, data [][]byte, size int64) (positions []*ChunkPosition, rotated bool, err error) {
+	if wal.options.ReadOnly {
+		return nil, false, ErrReadOnly
+	}
+	// the whole batch is written to one shard.
+	if wal.shards != nil {
+		shard := wal.nextShard()
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		positions, rotated, err = shard.writeBatch(ctx, data, size)
+		wal.lastWriteRotated.Store(rotated)
+		return positions, rotated, err
+	}
+	rotations := wal.rotations
+	defer func() {
+		rotated = wal.rotations != rotations
+		wal.lastWriteRotated.Store(rotated)
 	}()
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
 
 	// if the pending size is still larger than segment size, return error
-	if wal.pendingSize > wal.options.SegmentSize {
-		return nil, ErrPendingSizeTooLarge
+	if size > wal.options.SegmentSize {
+		if wal.options.AllowBatchSpanSegments {
+			positions, err = wal.writeSpanningBatch(ctx, data)
+			return positions, false, err
+		}
+		return nil, false, ErrPendingSizeTooLarge
+	}
+	if err := wal.checkFreeSpace(); err != nil {
+		return nil, false, err
 	}
 
-	// if the active segment file is full, sync it and create a new one.
-	if wal.activeSegment.Size()+wal.pendingSize > wal.options.SegmentSize {
+	if err := wal.ensureActiveSegment(); err != nil {
+		return nil, false, err
+	}
+	// if the active segment file is full or too old, sync it and create a new one.
+	if wal.activeSegment.Size()+size > wal.activeSegmentSize() || wal.isExpired() {
 		if err := wal.rotateActiveSegment(); err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
 		}
 	}
 
 	// write all data to the active segment file.
-	positions, err := wal.activeSegment.writeAll(wal.pendingWrites)
+	start := wal.activeSegment.Size()
+	positions, err = wal.activeSegment.writeAll(data)
 	if err != nil {
-		return nil, err
+		return nil, false, segmentError("write", wal.activeSegment.id, err)
+	}
+	wal.lastPosition = positions[len(positions)-1]
+	wal.notifyWritten()
+	for i, pos := range positions {
+		wal.bytesWrite += pos.ChunkSize
+		wal.payloadBytes += uint64(len(data[i]))
+	}
+	wal.diskBytes += uint64(wal.activeSegment.Size() - start)
+	return positions, false, nil
+}
+
+// writeSpanningBatch writes a batch larger than a segment file with AllowBatchSpanSegments,
+// the records fill the active segment file, which is rotated as many times as needed.
+// ctx is only checked before the first records are written. If writing fails, the records
+// written before stay in the segment files, and their positions are returned with the error.
+// The caller must hold wal.mu.
+func (wal *WAL) writeSpanningBatch(ctx context.Context, data [][]byte) ([]*ChunkPosition, error) {
+	sizes := make([]int64, len(data))
+	for i, record := range data {
+		sizes[i] = wal.options.maxDataWriteSize(int64(len(record)) + wal.options.recordOverhead())
+		if sizes[i] > wal.options.SegmentSize {
+			return nil, ErrDataSizeTooLarge
+		}
 	}
 
+	var positions []*ChunkPosition
+	for len(data) > 0 {
+		if err := wal.ensureActiveSegment(); err != nil {
+			return positions, err
+		}
+		// the records fitting in the rest of the active segment file, at least one,
+		// writeBatch rotates it first if even the first record doesn't fit.
+		room := min(wal.activeSegmentSize()-wal.activeSegment.Size(), wal.options.SegmentSize)
+		n, size := 1, sizes[0]
+		for n < len(data) && size+sizes[n] <= room {
+			size += sizes[n]
+			n++
+		}
+		written, _, err := wal.writeBatch(ctx, data[:n], size)
+		positions = append(positions, written...)
+		if err != nil {
+			return positions, err
+		}
+		data, sizes = data[n:], sizes[n:]
+		ctx = context.Background()
+	}
 	return positions, nil
 }
 
@@ -326,134 +1516,782 @@ func (wal *WAL) WriteAll() ([]*ChunkPosition, error) {
 // Actually, it writes the data to the active segment file.
 // It returns the position of the data in the WAL, and an error if any.
 func (wal *WAL) Write(data []byte) (*ChunkPosition, error) {
+	return wal.WriteWithType(0, data)
+}
+
+// WriteWithType is like Write, and also stores the type of the record, which
+// is returned by Reader.NextWithType without decoding the payload.
+// A non-zero type takes one more byte on disk, the type 0 is the same as Write.
+func (wal *WAL) WriteWithType(recordType RecordType, data []byte) (*ChunkPosition, error) {
+	if wal.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if wal.shards != nil {
+		shard := wal.nextShard()
+		defer func() { wal.lastWriteRotated.Store(shard.LastWriteRotated()) }()
+		return shard.WriteWithType(recordType, data)
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	// the size of the payload, with the type prefix and the record overhead.
+	size := int64(len(data)) + wal.options.recordOverhead()
+	if recordType != 0 {
+		size++
+	}
+	pos, err := wal.writeRecord(int64(len(data)), size, func(segment *segment) (*ChunkPosition, error) {
+		return segment.writeWithType(data, recordType)
+	})
+	if err != nil {
+		return nil, err
+	}
+	wal.notifyWrite([]*ChunkPosition{pos}, [][]byte{data})
+	return pos, nil
+}
+
+// notifyWrite calls OnWrite with every record written at the positions.
+func (wal *WAL) notifyWrite(positions []*ChunkPosition, data [][]byte) {
+	if wal.options.OnWrite == nil {
+		return
+	}
+	for i, pos := range positions {
+		wal.options.OnWrite(pos, data[i])
+	}
+}
+
+// WriteFrom is like Write, and reads the record of size bytes from r. The record
+// is written to the segment file block by block, rather than read into memory first,
+// unless a Compressor or a Cipher needs the whole record. If r fails before size bytes,
+// the chunks already written are discarded and the error is returned.
+func (wal *WAL) WriteFrom(r io.Reader, size int64) (*ChunkPosition, error) {
+	if wal.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("negative record size %d", size)
+	}
+	if wal.shards != nil {
+		shard := wal.nextShard()
+		defer func() { wal.lastWriteRotated.Store(shard.LastWriteRotated()) }()
+		return shard.WriteFrom(r, size)
+	}
+	if wal.options.Compressor != nil || wal.options.Cipher != nil {
+		if wal.options.maxDataWriteSize(size+wal.options.recordOverhead()) > wal.options.SegmentSize {
+			return nil, ErrDataSizeTooLarge
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return wal.Write(data)
+	}
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
-	if int64(len(data))+chunkHeaderSize > wal.options.SegmentSize {
+	return wal.writeRecord(size, size+wal.options.recordOverhead(), func(segment *segment) (*ChunkPosition, error) {
+		return segment.writeFrom(r, size)
+	})
+}
+
+// writeRecord writes a record of payload bytes, size bytes with its prefixes, to the active
+// segment file by calling write, after rotating it if needed. The WAL must be locked.
+func (wal *WAL) writeRecord(payload, size int64, write func(segment *segment) (*ChunkPosition, error)) (*ChunkPosition, error) {
+	if wal.options.maxDataWriteSize(size) > wal.options.SegmentSize {
 		return nil, ErrDataSizeTooLarge
 	}
-	// if the active segment file is full, sync it and create a new one.
-	if wal.isFull(int64(len(data))) {
+	if err := wal.checkFreeSpace(); err != nil {
+		return nil, err
+	}
+	if err := wal.ensureActiveSegment(); err != nil {
+		return nil, err
+	}
+	rotations := wal.rotations
+	defer func() { wal.lastWriteRotated.Store(wal.rotations != rotations) }()
+	// if the active segment file is full or too old, sync it and create a new one.
+	if wal.isFull(size) || wal.isExpired() {
 		if err := wal.rotateActiveSegment(); err != nil {
 			return nil, err
 		}
 	}
 
 	// write the data to the active segment file.
-	position, err := wal.activeSegment.Write(data)
+	start := wal.activeSegment.Size()
+	position, err := write(wal.activeSegment)
 	if err != nil {
-		return nil, err
+		return nil, segmentError("write", wal.activeSegment.id, err)
 	}
+	wal.lastPosition = position
+	wal.notifyWritten()
+	wal.payloadBytes += uint64(payload)
+	wal.diskBytes += uint64(wal.activeSegment.Size() - start)
 
 	// update the bytesWrite field.
 	wal.bytesWrite += position.ChunkSize
 
 	// sync the active segment file if needed.
+	if err := wal.syncIfNeeded(); err != nil {
+		return nil, err
+	}
+
+	return position, nil
+}
+
+// syncIfNeeded syncs the active segment file according to DiskFlushSync and BytesPerSync.
+func (wal *WAL) syncIfNeeded() error {
+	for _, shard := range wal.shards {
+		shard.mu.Lock()
+		err := shard.syncIfNeeded()
+		shard.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if wal.activeSegment == nil {
+		return nil
+	}
 	var needSync = wal.options.DiskFlushSync
 	if !needSync && wal.options.BytesPerSync > 0 {
 		needSync = wal.bytesWrite >= wal.options.BytesPerSync
 	}
+	if !needSync && wal.options.MaxSyncDelay > 0 {
+		needSync = time.Since(wal.lastSync) > wal.options.MaxSyncDelay
+	}
 	if needSync {
-		if err := wal.activeSegment.Sync(); err != nil {
-			return nil, err
+		if err := wal.syncSegment(wal.activeSegment); err != nil {
+			return segmentError("sync", wal.activeSegment.id, err)
 		}
-		wal.bytesWrite = 0
+		wal.markSynced()
 	}
+	return nil
+}
 
-	return position, nil
+// markSynced records that the active segment file has nothing left to sync. The WAL must be locked.
+func (wal *WAL) markSynced() {
+	wal.bytesWrite = 0
+	wal.lastSync = time.Now()
 }
 
 // Read reads the data from the WAL according to the given position.
 func (wal *WAL) Read(pos *ChunkPosition) ([]byte, error) {
+	data, err := wal.readAppend(nil, pos)
+	if err != nil {
+		return nil, err
+	}
+	if wal.options.OnRead != nil {
+		wal.options.OnRead(pos, data)
+	}
+	return data, nil
+}
+
+// ReadInto reads the data at the given position into buf and returns its size, so that a
+// buffer is reused across reads. If buf is too small, the size it needs is returned with
+// io.ErrShortBuffer, and the content of buf is undefined.
+// The compressed or encrypted records are decoded into buf too, but it still allocates.
+func (wal *WAL) ReadInto(pos *ChunkPosition, buf []byte) (int, error) {
+	data, err := wal.readAppend(buf[:0], pos)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > len(buf) {
+		return len(data), io.ErrShortBuffer
+	}
+	n := copy(buf, data)
+	if wal.options.OnRead != nil {
+		wal.options.OnRead(pos, buf[:n])
+	}
+	return n, nil
+}
+
+// ReadMeta describes the segment file a record was read from, see ReadWithMeta.
+type ReadMeta struct {
+	// ModTime is the modification time of the segment file.
+	ModTime time.Time
+	// CreatedAt is when the segment file was created, or its modification time
+	// when it was opened if it was created before Open.
+	CreatedAt time.Time
+}
+
+// ReadWithMeta is like Read, and also returns the times of the segment file of the record,
+// which bound the age of the records written without StoreTimestamps.
+// It takes one more stat of the segment file than Read.
+func (wal *WAL) ReadWithMeta(pos *ChunkPosition) ([]byte, ReadMeta, error) {
+	var meta ReadMeta
+	data, err := wal.readSegment(nil, pos, &meta)
+	if err != nil {
+		return nil, ReadMeta{}, err
+	}
+	if wal.options.OnRead != nil {
+		wal.options.OnRead(pos, data)
+	}
+	return data, meta, nil
+}
+
+// readAppend reads the data at the given position and appends it to dst.
+func (wal *WAL) readAppend(dst []byte, pos *ChunkPosition) ([]byte, error) {
+	return wal.readSegment(dst, pos, nil)
+}
+
+// readSegment is readAppend, which also fills meta with the times of the segment file if it is not nil.
+func (wal *WAL) readSegment(dst []byte, pos *ChunkPosition, meta *ReadMeta) ([]byte, error) {
+	if wal.shards != nil {
+		return wal.shardOf(pos.SegmentId).readSegment(dst, pos, meta)
+	}
 	wal.mu.RLock()
 	defer wal.mu.RUnlock()
 
 	// find the segment file according to the position.
-	var segment *segment
-	if pos.SegmentId == wal.activeSegment.id {
-		segment = wal.activeSegment
-	} else {
-		segment = wal.olderSegments[pos.SegmentId]
+	segment, err := wal.acquireSegment("read", pos.SegmentId)
+	if err != nil {
+		return nil, err
 	}
+	defer segment.release()
 
-	if segment == nil {
-		return nil, fmt.Errorf("segment file %d%s not found", pos.SegmentId, wal.options.DiskFileExtension)
+	// read the data from the segment file.
+	data, err := segment.readAppend(dst, pos.BlockNumber, pos.ChunkOffset)
+	if err != nil {
+		return nil, segmentError("read", pos.SegmentId, err)
+	}
+	if meta != nil {
+		stat, err := segment.fd.Stat()
+		if err != nil {
+			return nil, segmentError("stat", pos.SegmentId, err)
+		}
+		meta.ModTime = stat.ModTime()
+		meta.CreatedAt = segment.createdAt
 	}
+	return data, nil
+}
 
-	// read the data from the segment file.
-	return segment.Read(pos.BlockNumber, pos.ChunkOffset)
+// TruncateTail discards all the data at and after the given position.
+// The segment files whose id is greater than pos.SegmentId are deleted,
+// and the segment file containing pos is truncated and becomes the active segment,
+// so the subsequent writes are appended right at pos.
+func (wal *WAL) TruncateTail(pos *ChunkPosition) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return ErrShardsUnsupported
+	}
+	if pos == nil {
+		return errors.New("truncate position is nil")
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	// find the segment file containing the position.
+	segment, err := wal.acquireSegment("truncate", pos.SegmentId)
+	if err != nil {
+		return err
+	}
+	defer segment.release()
+
+	if err := segment.truncate(pos.BlockNumber, pos.ChunkOffset); err != nil {
+		return segmentError("truncate", segment.id, err)
+	}
+	if err := wal.syncSegment(segment); err != nil {
+		return segmentError("sync", segment.id, err)
+	}
+
+	// delete the segment files after the truncated one.
+	for id, older := range wal.olderSegments {
+		if id > pos.SegmentId {
+			if err := older.Remove(); err != nil {
+				return segmentError("remove", id, err)
+			}
+			delete(wal.olderSegments, id)
+		}
+	}
+	if wal.activeSegment != segment {
+		if err := wal.activeSegment.Remove(); err != nil {
+			return segmentError("remove", wal.activeSegment.id, err)
+		}
+		delete(wal.olderSegments, segment.id)
+		segment.unseal()
+		// the active segment file stays open.
+		if wal.handles != nil {
+			wal.handles.pin(segment)
+		}
+		wal.activeSegment = segment
+	}
+
+	// everything left in the active segment file has been synced.
+	wal.markSynced()
+	// the last chunk is looked up again by LastPosition.
+	wal.lastPosition = nil
+	wal.generation++
+	return nil
+}
+
+// TruncateHead deletes the older segment files whose id is less than pos.SegmentId.
+// The segment file containing pos is kept as a whole, so its records stay readable.
+func (wal *WAL) TruncateHead(pos *ChunkPosition) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return ErrShardsUnsupported
+	}
+	if pos == nil {
+		return errors.New("truncate position is nil")
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.removeSegmentsBefore(pos.SegmentId)
+}
+
+// DeleteSegment deletes the older segment file with the id, the ones around it are kept.
+// The reads of its positions then fail with ErrSegmentRemoved, the readers skip it,
+// but the readers created before keep reading it. The active segment file is refused with
+// ErrActiveSegment, and a segment file the WAL doesn't have returns the error of Read.
+func (wal *WAL) DeleteSegment(id SegSerialID) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return wal.shardOf(id).DeleteSegment(id)
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.activeSegment != nil && id == wal.activeSegment.id {
+		return ErrActiveSegment
+	}
+	segment, ok := wal.olderSegments[id]
+	if !ok {
+		return wal.segmentNotFound(id)
+	}
+	if err := segment.Remove(); err != nil {
+		return segmentError("remove", id, err)
+	}
+	delete(wal.olderSegments, id)
+	return nil
+}
+
+// KeepLastN keeps the last n records of the WAL, the older segment files are deleted like by
+// TruncateHead. The segment file holding the n-th record from the end is kept as a whole,
+// so more than n records may remain, and nothing is deleted if there are at most n records.
+// The records are counted per segment file from the end, the counts are kept as records
+// are written, but the segment files reopened by Open or truncated are scanned once,
+// so the first call may read all their records, O(n) in the number of records.
+func (wal *WAL) KeepLastN(n int) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return ErrShardsUnsupported
+	}
+	if n < 0 {
+		return errors.New("the number of records to keep must not be negative")
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	segments := wal.sortedSegments()
+	left := int64(n)
+	for i := len(segments) - 1; i >= 0; i-- {
+		records, err := segments[i].recordCount()
+		if err != nil {
+			return segmentError("count", segments[i].id, err)
+		}
+		// the segment file holds the oldest record to keep, or it is the active one if n is 0.
+		if records >= left {
+			return wal.removeSegmentsBefore(segments[i].id)
+		}
+		left -= records
+	}
+	return nil
+}
+
+// removeSegmentsBefore deletes the older segment files whose id is less than the id.
+// The caller must hold wal.mu.
+func (wal *WAL) removeSegmentsBefore(id SegSerialID) error {
+	for olderID, segment := range wal.olderSegments {
+		if olderID < id {
+			if err := segment.Remove(); err != nil {
+				return segmentError("remove", olderID, err)
+			}
+			delete(wal.olderSegments, olderID)
+		}
+	}
+	return nil
 }
 
-// Close closes the WAL.
+// CloseWithFlush writes the pending writes like WriteAll, then closes the WAL.
+// The WAL is closed even if the pending writes fail to be written.
+func (wal *WAL) CloseWithFlush() error {
+	if _, err := wal.WriteAll(); err != nil {
+		return errors.Join(err, wal.Close())
+	}
+	return wal.Close()
+}
+
+// Close closes the WAL. It doesn't write the pending writes, they are dropped
+// and ErrPendingWritesDropped is returned once the WAL is closed, see CloseWithFlush.
 func (wal *WAL) Close() error {
+	// the goroutine takes the lock, stop it before.
+	wal.stopSync()
+	var syncErr error
+	if wal.rotateSync != nil {
+		syncErr = wal.rotateSync.close()
+	}
+
+	dropped := wal.PendingCount() > 0
+	wal.ClearPendingWrites()
+
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
+	// everything is closed even if something fails, the first error is returned.
+	var err error
+	keepFirst := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	for _, shard := range wal.shards {
+		keepFirst(shard.Close())
+	}
+
 	// close all segment files.
 	for _, segment := range wal.olderSegments {
-		if err := segment.Close(); err != nil {
-			return err
-		}
+		keepFirst(segmentError("close", segment.id, segment.Close()))
 		wal.renameIds = append(wal.renameIds, segment.id)
 	}
 	wal.olderSegments = nil
 
-	wal.renameIds = append(wal.renameIds, wal.activeSegment.id)
 	// close the active segment file.
-	return wal.activeSegment.Close()
+	if wal.activeSegment != nil {
+		if wal.options.SegmentFooterChecksum && !wal.options.ReadOnly {
+			keepFirst(segmentError("checksum", wal.activeSegment.id, wal.activeSegment.writeChecksumFile()))
+		}
+		wal.renameIds = append(wal.renameIds, wal.activeSegment.id)
+		keepFirst(segmentError("close", wal.activeSegment.id, wal.activeSegment.Close()))
+	}
+
+	// release the directory lock, whatever failed before.
+	keepFirst(unlockDir(wal.dirLock))
+	wal.dirLock = nil
+	keepFirst(syncErr)
+	if err == nil && dropped {
+		return ErrPendingWritesDropped
+	}
+	return err
 }
 
 // Delete deletes all segment files of the WAL.
 func (wal *WAL) Delete() error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
+	for _, shard := range wal.shards {
+		if err := shard.Delete(); err != nil {
+			return err
+		}
+	}
+
 	// delete all segment files.
 	for _, segment := range wal.olderSegments {
 		if err := segment.Remove(); err != nil {
-			return err
+			return segmentError("remove", segment.id, err)
 		}
 	}
 	wal.olderSegments = nil
 
 	// delete the active segment file.
-	return wal.activeSegment.Remove()
+	if wal.activeSegment == nil {
+		return nil
+	}
+	return segmentError("remove", wal.activeSegment.id, wal.activeSegment.Remove())
+}
+
+// Reset removes all the records of the WAL and keeps it open, the segment files are
+// removed and the initial segment file is created again, unless NoInitialSegment.
+// The segment ids start again from the initial one, so the positions returned
+// before Reset are invalid after it. The pending writes are cleared.
+func (wal *WAL) Reset() error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	for _, shard := range wal.shards {
+		if err := shard.Reset(); err != nil {
+			return err
+		}
+	}
+	wal.ClearPendingWrites()
+	if wal.shards != nil {
+		return nil
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	for id, segment := range wal.olderSegments {
+		if err := segment.Remove(); err != nil {
+			return segmentError("remove", id, err)
+		}
+		delete(wal.olderSegments, id)
+	}
+	if wal.activeSegment != nil {
+		if err := wal.activeSegment.Remove(); err != nil {
+			return segmentError("remove", wal.activeSegment.id, err)
+		}
+		wal.activeSegment = nil
+	}
+	if wal.blockCache != nil {
+		wal.blockCache.Purge()
+	}
+	wal.markSynced()
+	wal.lastPosition = nil
+	wal.generation++
+	if wal.options.NoInitialSegment {
+		return nil
+	}
+	return wal.openInitialSegment()
 }
 
 // Sync syncs the active segment file to stable storage like disk.
 func (wal *WAL) Sync() error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	for _, shard := range wal.shards {
+		if err := shard.Sync(); err != nil {
+			return err
+		}
+	}
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
-	return wal.activeSegment.Sync()
+	if wal.activeSegment == nil {
+		return nil
+	}
+	if err := wal.syncSegment(wal.activeSegment); err != nil {
+		return segmentError("sync", wal.activeSegment.id, err)
+	}
+	wal.markSynced()
+	return nil
+}
+
+// SyncSegment syncs the segment file of the id to stable storage, an older one or the active one,
+// unlike Sync which only syncs the active segment file. ErrSegmentNotFound or ErrSegmentRemoved
+// is returned if the WAL doesn't have it.
+func (wal *WAL) SyncSegment(id SegSerialID) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return wal.shardOf(id).SyncSegment(id)
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	segment, err := wal.acquireSegment("sync", id)
+	if err != nil {
+		return err
+	}
+	defer segment.release()
+	return segmentError("sync", id, wal.syncSegment(segment))
 }
 
+// RenameFileExt renames the segment files of the closed WAL to the extension, with their checksum files.
+// If a rename fails, the files already renamed are renamed back, so that the directory keeps the
+// old extension, and the error is returned. The directory is read again after the renames, an error
+// wrapping ErrSegmentMissing is returned if a segment file is not found with the new extension.
 func (wal *WAL) RenameFileExt(ext string) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if wal.shards != nil {
+		return ErrShardsUnsupported
+	}
 	if !strings.HasPrefix(ext, ".") {
 		return fmt.Errorf("file extension must start with '.'")
 	}
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
-	renameFile := func(id SegSerialID) error {
-		oldName := SegmentFileName(wal.options.DirPath, wal.options.DiskFileExtension, id)
-		newName := SegmentFileName(wal.options.DirPath, ext, id)
-		return os.Rename(oldName, newName)
+	oldExt := wal.options.DiskFileExtension
+	renameFile := func(id SegSerialID, from, to string) error {
+		oldName := wal.options.segmentFileName(from, id)
+		newName := wal.options.segmentFileName(to, id)
+		if err := wal.options.fs().Rename(oldName, newName); err != nil {
+			return err
+		}
+		if err := wal.options.renameMirror(id, from, to); err != nil {
+			return err
+		}
+		// the checksum file follows the name of its segment file.
+		err := wal.options.fs().Rename(oldName+checksumFileExt, newName+checksumFileExt)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	// rename back in reverse order, the last one may be renamed or not.
+	rollback := func(ids []SegSerialID) {
+		for i := len(ids) - 1; i >= 0; i-- {
+			_ = renameFile(ids[i], ext, oldExt)
+		}
 	}
 
+	for i, id := range wal.renameIds {
+		if err := renameFile(id, oldExt, ext); err != nil {
+			rollback(wal.renameIds[:i+1])
+			return segmentError("rename", id, err)
+		}
+	}
+
+	// check that every segment file is found with the new extension.
+	ids, err := listSegmentIDs(wal.options, ext)
+	if err != nil {
+		rollback(wal.renameIds)
+		return err
+	}
+	found := make(map[SegSerialID]bool, len(ids))
+	for _, id := range ids {
+		found[SegSerialID(id)] = true
+	}
 	for _, id := range wal.renameIds {
-		if err := renameFile(id); err != nil {
-			return err
+		if !found[id] {
+			rollback(wal.renameIds)
+			return fmt.Errorf("%w: %d%s after the rename", ErrSegmentMissing, id, ext)
 		}
 	}
+	if err := syncDir(wal.options.fs(), wal.options.DirPath); err != nil {
+		return err
+	}
 
 	wal.options.DiskFileExtension = ext
 	return nil
 }
 
+// sortedSegments returns the older segments and the active one sorted by id.
+// The caller must hold wal.mu.
+func (wal *WAL) sortedSegments() []*segment {
+	if wal.shards != nil {
+		return wal.shardedSegments()
+	}
+	segments := make([]*segment, 0, len(wal.olderSegments)+1)
+	for _, segment := range wal.olderSegments {
+		segments = append(segments, segment)
+	}
+	if wal.activeSegment != nil {
+		segments = append(segments, wal.activeSegment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+	return segments
+}
+
+// acquireSegment returns the segment file of the id with a reference taken by acquire,
+// so that it stays open with MaxOpenSegments until it is released. The WAL must be locked.
+func (wal *WAL) acquireSegment(op string, id SegSerialID) (*segment, error) {
+	segment := wal.getSegment(id)
+	if segment == nil {
+		return nil, wal.segmentNotFound(id)
+	}
+	if !segment.acquire() {
+		return nil, segmentError(op, id, ErrClosed)
+	}
+	return segment, nil
+}
+
+// getSegment returns the active or older segment of the given id, nil if there is none.
+// The caller must hold wal.mu.
+func (wal *WAL) getSegment(id SegSerialID) *segment {
+	if wal.activeSegment != nil && id == wal.activeSegment.id {
+		return wal.activeSegment
+	}
+	return wal.olderSegments[id]
+}
+
+// segmentNotFound returns the error for a segment file the WAL doesn't have, which wraps
+// ErrSegmentRemoved if its id is before the active segment file, like a segment file
+// evicted or truncated, and ErrSegmentNotFound otherwise. The WAL must be locked.
+func (wal *WAL) segmentNotFound(id SegSerialID) error {
+	err := ErrSegmentNotFound
+	if wal.activeSegment != nil && id >= initialSegmentFileID && id < wal.activeSegment.id {
+		err = ErrSegmentRemoved
+	}
+	return fmt.Errorf("%w: %d%s", err, id, wal.options.DiskFileExtension)
+}
+
 func (wal *WAL) isFull(delta int64) bool {
-	return wal.activeSegment.Size()+wal.maxDataWriteSize(delta) > wal.options.SegmentSize
+	return wal.activeSegment.Size()+wal.options.maxDataWriteSize(delta) > wal.activeSegmentSize()
+}
+
+// activeSegmentSize returns the size the active segment file is rotated at,
+// the one recorded in its header with SegmentSizeFunc, SegmentSize otherwise.
+func (wal *WAL) activeSegmentSize() int64 {
+	if wal.options.SegmentSizeFunc == nil || wal.activeSegment.segmentSize == 0 {
+		return wal.options.SegmentSize
+	}
+	return wal.activeSegment.segmentSize
+}
+
+// segmentSize returns the size the new segment file after prevID is rotated at,
+// given by SegmentSizeFunc.
+func (options Options) segmentSize(prevID SegSerialID) (int64, error) {
+	if options.SegmentSizeFunc == nil {
+		return options.SegmentSize, nil
+	}
+	size := options.SegmentSizeFunc(prevID)
+	if size < options.blockSize() {
+		return 0, fmt.Errorf("SegmentSizeFunc returned %d, it must be at least the block size %d",
+			size, options.blockSize())
+	}
+	return size, nil
+}
+
+// isExpired reports whether the active segment file is non-empty and older than MaxSegmentAge.
+func (wal *WAL) isExpired() bool {
+	return wal.options.MaxSegmentAge > 0 && !wal.activeSegment.isEmpty() &&
+		time.Since(wal.activeSegment.createdAt) > wal.options.MaxSegmentAge
+}
+
+// maxDataWriteSize returns the upper bound of the bytes a record payload of size bytes
+// takes in a segment file, with the headers of all the chunks it may be split into.
+func (options Options) maxDataWriteSize(size int64) int64 {
+	return chunkHeaderSize + size + (size/options.blockSize()+1)*chunkHeaderSize
+}
+
+// coldSegmentAge returns ColdSegmentAge, defaultColdSegmentAge if it is 0.
+func (options Options) coldSegmentAge() time.Duration {
+	if options.ColdSegmentAge == 0 {
+		return defaultColdSegmentAge
+	}
+	return options.ColdSegmentAge
+}
+
+// blockSize returns the block size of the segment files, defaultBlockSize if BlockSize is 0.
+func (options Options) blockSize() int64 {
+	if options.BlockSize == 0 {
+		return defaultBlockSize
+	}
+	return int64(options.BlockSize)
+}
+
+// recordOverhead returns the bytes added to every record payload by the options,
+// the nonce and the overhead of the Cipher, and the timestamp of StoreTimestamps.
+func (options Options) recordOverhead() int64 {
+	var overhead int64
+	if options.Cipher != nil {
+		overhead += int64(cipherNonceSize + options.Cipher.Overhead())
+	}
+	if options.StoreTimestamps {
+		overhead += timestampSize
+	}
+	return overhead
 }
 
-func (wal *WAL) maxDataWriteSize(size int64) int64 {
-	return chunkHeaderSize + size + (size/blockSize+1)*chunkHeaderSize
+// EstimateSize returns the upper bound of the bytes a record of dataLen bytes takes
+// in a segment file, with the headers of all the chunks it may be split into.
+// It is the size accounted by Write, WriteAll and WriteBatch to decide whether
+// the record fits in the active segment file, or in a segment file at all,
+// with the BlockSize, the Cipher overhead and StoreTimestamps of the WAL options.
+func (wal *WAL) EstimateSize(dataLen int) int64 {
+	return wal.options.maxDataWriteSize(int64(dataLen) + wal.options.recordOverhead())
 }
@@ -1,8 +1,24 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -41,3 +57,4495 @@ func TestWalWrite(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "hello3", string(val))
 }
+
+func TestWalWriteCompressed(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-compress")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	raw := bytes.Repeat([]byte("raw record "), 100)
+	pos1, err := wal.Write(raw)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	// reopen with compression, the old chunks must stay readable.
+	opts.Compressor = SnappyCompressor{}
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	big := bytes.Repeat([]byte("compressible json event "), 4*KB)
+	pos2, err := wal.Write(big)
+	assert.Nil(t, err)
+	assert.Less(t, pos2.ChunkSize, uint32(len(big)))
+
+	val, err := wal.Read(pos1)
+	assert.Nil(t, err)
+	assert.Equal(t, raw, val)
+	val, err = wal.Read(pos2)
+	assert.Nil(t, err)
+	assert.Equal(t, big, val)
+
+	reader := wal.NewReader()
+	val, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, raw, val)
+	val, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, big, val)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalReaderNextWithMeta(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-next-with-meta")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = wal.Write(make([]byte, 40*KB))
+	assert.Nil(t, err)
+
+	reader := wal.NewReader()
+	data, _, meta, err := reader.NextWithMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	assert.Equal(t, RecordMeta{Size: chunkHeaderSize + 5, Blocks: 1, ChunkType: ChunkTypeFull}, meta)
+
+	data, _, meta, err = reader.NextWithMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, 40*KB, len(data))
+	assert.Equal(t, uint32(2), meta.Blocks)
+	assert.Equal(t, ChunkTypeFirst, meta.ChunkType)
+	assert.Equal(t, uint32(40*KB+2*chunkHeaderSize), meta.Size)
+
+	_, _, _, err = reader.NextWithMeta()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalNewReaderForSegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-for-segment")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	_, err = wal.Write([]byte("hello1"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	_, err = wal.Write([]byte("hello2"))
+	assert.Nil(t, err)
+
+	reader, err := wal.NewReaderForSegment(1)
+	assert.Nil(t, err)
+	defer reader.Close()
+	data, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello1"), data)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = wal.NewReaderForSegment(3)
+	assert.NotNil(t, err)
+}
+
+func TestWalWriteWithType(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-with-type")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		Compressor:        SnappyCompressor{},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	_, err = wal.Write([]byte("untyped"))
+	assert.Nil(t, err)
+	pos, err := wal.WriteWithType(3, bytes.Repeat([]byte("typed"), 10*KB))
+	assert.Nil(t, err)
+
+	reader := wal.NewReader()
+	data, _, recordType, err := reader.NextWithType()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("untyped"), data)
+	assert.Equal(t, RecordType(0), recordType)
+	data, _, recordType, err = reader.NextWithType()
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("typed"), 10*KB), data)
+	assert.Equal(t, RecordType(3), recordType)
+
+	data, err = wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("typed"), 10*KB), data)
+}
+
+func TestWalCipher(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-cipher")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	pos1, err := wal.Write([]byte("plain record"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	// reopen with encryption, the old chunks must stay readable.
+	opts.Cipher, err = NewAESGCMCipher(bytes.Repeat([]byte("k"), 32))
+	assert.Nil(t, err)
+	opts.Compressor = SnappyCompressor{}
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	secret := bytes.Repeat([]byte("secret record "), 4*KB)
+	pos2, err := wal.WriteWithType(7, secret)
+	assert.Nil(t, err)
+
+	val, err := wal.Read(pos1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain record"), val)
+	reader, err := wal.NewReaderWithStart(pos2)
+	assert.Nil(t, err)
+	data, _, recordType, err := reader.NextWithType()
+	assert.Nil(t, err)
+	assert.Equal(t, secret, data)
+	assert.Equal(t, RecordType(7), recordType)
+	assert.Nil(t, wal.Close())
+
+	// the payload is not readable without the key.
+	raw, err := os.ReadFile(SegmentFileName(dir, ".SDF", 1))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret record")))
+	opts.Cipher = nil
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Read(pos2)
+	assert.ErrorIs(t, err, ErrNoCipher)
+	assert.Nil(t, wal.Close())
+
+	opts.Cipher, _ = NewAESGCMCipher(bytes.Repeat([]byte("x"), 32))
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	_, err = wal.Read(pos2)
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+}
+
+func TestWalExportImport(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-export")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d %s", i, strings.Repeat("x", 10*KB))))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, wal.Export(&buf))
+
+	importDir, _ := os.MkdirTemp("", "test-import")
+	importOpts := opts
+	importOpts.DirPath = importDir
+	assert.Nil(t, Import(importOpts, bytes.NewReader(buf.Bytes())))
+	assert.Equal(t, ErrImportNotEmpty, Import(importOpts, bytes.NewReader(buf.Bytes())))
+
+	restored, err := Open(importOpts)
+	assert.Nil(t, err)
+	defer CloseWal(restored)
+	for i, pos := range positions {
+		data, err := restored.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d %s", i, strings.Repeat("x", 10*KB))), data)
+	}
+
+	otherDir, _ := os.MkdirTemp("", "test-import-invalid")
+	importOpts.DirPath = otherDir
+	defer os.RemoveAll(otherDir)
+	assert.ErrorIs(t, Import(importOpts, bytes.NewReader(buf.Bytes()[:100])), ErrInvalidExport)
+	ids, err := listSegmentIDs(importOpts, ".SDF")
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestWalReadSegmentRange(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-range")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d %s", i, strings.Repeat("x", 10*KB))))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	head, err := wal.ReadSegmentRange(1, 0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*defaultBlockSize, len(head))
+	tail, err := wal.ReadSegmentRange(1, 2, 100)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(SegmentFileName(dir, ".SDF", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, content, append(head, tail...))
+	empty, err := wal.ReadSegmentRange(1, 100, 200)
+	assert.Nil(t, err)
+	assert.Empty(t, empty)
+
+	// the ranges written verbatim on a peer are read back.
+	peerDir, _ := os.MkdirTemp("", "test-segment-range-peer")
+	assert.Nil(t, os.WriteFile(SegmentFileName(peerDir, ".SDF", 1), append(head, tail...), 0644))
+	peerOpts := opts
+	peerOpts.DirPath = peerDir
+	peer, err := Open(peerOpts)
+	assert.Nil(t, err)
+	defer CloseWal(peer)
+	for i, pos := range positions {
+		data, err := peer.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d %s", i, strings.Repeat("x", 10*KB))), data)
+	}
+
+	_, err = wal.ReadSegmentRange(1, 2, 1)
+	assert.NotNil(t, err)
+	_, err = wal.ReadSegmentRange(5, 0, 1)
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestWalNewMultiReader(t *testing.T) {
+	coldDir, _ := os.MkdirTemp("", "test-multi-reader-cold")
+	cold, err := Open(Options{DirPath: coldDir, DiskFileExtension: ".SDF", SegmentSize: MB})
+	assert.Nil(t, err)
+	defer CloseWal(cold)
+	_, err = cold.Write([]byte("cold 1"))
+	assert.Nil(t, err)
+	assert.Nil(t, cold.OpenNewActiveSegment())
+	_, err = cold.Write([]byte("cold 2"))
+	assert.Nil(t, err)
+
+	// the hot WAL has the newer segment files, and stale copies of the segment files 1 and 2.
+	hotDir, _ := os.MkdirTemp("", "test-multi-reader-hot")
+	hot, err := Open(Options{DirPath: hotDir, DiskFileExtension: ".SDF", SegmentSize: MB})
+	assert.Nil(t, err)
+	defer CloseWal(hot)
+	assert.Nil(t, hot.OpenNewActiveSegment())
+	_, err = hot.Write([]byte("stale 2"))
+	assert.Nil(t, err)
+	assert.Nil(t, hot.OpenNewActiveSegment())
+	_, err = hot.Write([]byte("hot 3"))
+	assert.Nil(t, err)
+
+	reader := NewMultiReader(cold, hot)
+	defer reader.Close()
+	var got []string
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		got = append(got, string(data))
+	}
+	assert.Equal(t, []string{"cold 1", "cold 2", "hot 3"}, got)
+}
+
+func TestWalStoreTimestamps(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-timestamps")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte("legacy"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	// reopen with timestamps, the old chunks must stay readable with a zero time.
+	opts.StoreTimestamps = true
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	before := time.Now()
+	_, err = wal.WriteWithType(2, []byte("first"))
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	_, err = wal.Write([]byte("second"))
+	assert.Nil(t, err)
+
+	reader := wal.NewReader()
+	data, _, meta, err := reader.NextWithMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("legacy"), data)
+	assert.True(t, meta.Time.IsZero())
+	data, _, meta, err = reader.NextWithMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first"), data)
+	assert.Equal(t, RecordType(2), meta.Type)
+	assert.False(t, meta.Time.Before(before))
+
+	reader, err = wal.NewReaderFromTime(middle)
+	assert.Nil(t, err)
+	data, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("second"), data)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	reader, err = wal.NewReaderFromTime(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalWriteFrom(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-from")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		StoreTimestamps:   true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	small := []byte("hello")
+	pos1, err := wal.WriteFrom(bytes.NewReader(small), int64(len(small)))
+	assert.Nil(t, err)
+	big := bytes.Repeat([]byte("streamed "), 10*KB)
+	pos2, err := wal.WriteFrom(bytes.NewReader(big), int64(len(big)))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(len(big)+timestampSize+3*chunkHeaderSize), pos2.ChunkSize)
+
+	// a failing reader leaves nothing behind.
+	failing := io.MultiReader(bytes.NewReader(big[:40*KB]), iotest.ErrReader(io.ErrClosedPipe))
+	_, err = wal.WriteFrom(failing, int64(len(big)))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	_, err = wal.WriteFrom(bytes.NewReader(small), int64(len(small))+1)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	pos3, err := wal.Write([]byte("after"))
+	assert.Nil(t, err)
+
+	_, err = wal.WriteFrom(bytes.NewReader(nil), 2*MB)
+	assert.Equal(t, ErrDataSizeTooLarge, err)
+
+	reader := wal.NewReader()
+	for _, expected := range []struct {
+		data []byte
+		pos  *ChunkPosition
+	}{{small, pos1}, {big, pos2}, {[]byte("after"), pos3}} {
+		data, pos, meta, err := reader.NextWithMeta()
+		assert.Nil(t, err)
+		assert.Equal(t, expected.data, data)
+		assert.Equal(t, expected.pos.BlockNumber, pos.BlockNumber)
+		assert.Equal(t, expected.pos.ChunkOffset, pos.ChunkOffset)
+		assert.False(t, meta.Time.IsZero())
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+// poisonPool is a BufferPool overwriting the buffers given back, to catch the pooled
+// memory escaping to the caller.
+type poisonPool struct {
+	mu   sync.Mutex
+	bufs [][]byte
+	gets int
+	puts int
+}
+
+func (p *poisonPool) Get() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gets++
+	if len(p.bufs) == 0 {
+		return nil
+	}
+	buf := p.bufs[len(p.bufs)-1]
+	p.bufs = p.bufs[:len(p.bufs)-1]
+	return buf
+}
+
+func (p *poisonPool) Put(buf []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.puts++
+	buf = buf[:cap(buf)]
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	p.bufs = append(p.bufs, buf)
+}
+
+func TestWalBufferPool(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-buffer-pool")
+	pool := &poisonPool{}
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		BufferPool:        pool,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	big := bytes.Repeat([]byte("pooled "), 10*KB)
+	pos1, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	pos2, err := wal.Write(big)
+	assert.Nil(t, err)
+
+	val1, err := wal.Read(pos1)
+	assert.Nil(t, err)
+	val2, err := wal.Read(pos2)
+	assert.Nil(t, err)
+	// reuse the pooled buffers, the records read before must not change.
+	_, err = wal.Write(big)
+	assert.Nil(t, err)
+	_, err = wal.Read(pos2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), val1)
+	assert.Equal(t, big, val2)
+	assert.True(t, pool.gets > 0)
+	assert.Equal(t, pool.gets, pool.puts)
+}
+
+func TestWalReverseReader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reverse")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	// big records force rotations, so the reader has to cross segments.
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Greater(t, wal.ActiveSegmentID(), SegSerialID(initialSegmentFileID))
+
+	reader := wal.NewReverseReader()
+	for i := 9; i >= 0; i-- {
+		val, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), val)
+		assert.Equal(t, positions[i].SegmentId, pos.SegmentId)
+		assert.Equal(t, positions[i].BlockNumber, pos.BlockNumber)
+		assert.Equal(t, positions[i].ChunkOffset, pos.ChunkOffset)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalStats(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-stats")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       64 * KB,
+		BlockCache:        32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 4; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 20*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	wal.PendingWrites([]byte("pending"))
+
+	stats := wal.Stats()
+	assert.Equal(t, 1, stats.OlderSegments)
+	assert.Equal(t, wal.ActiveSegmentID(), stats.ActiveSegmentID)
+	assert.Greater(t, stats.TotalBytes, int64(4*20*KB))
+	assert.Greater(t, stats.PendingSize, int64(0))
+
+	// the first read misses and caches the now full block, the second one hits.
+	_, err = wal.Read(positions[0])
+	assert.Nil(t, err)
+	_, err = wal.Read(positions[0])
+	assert.Nil(t, err)
+	stats = wal.Stats()
+	assert.Equal(t, uint64(1), stats.CacheHits)
+	assert.Equal(t, uint64(1), stats.CacheMisses)
+}
+
+func TestWalWriteAmplification(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-amplification")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       64 * KB,
+		BlockSize:         4 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	assert.Equal(t, float64(0), wal.WriteAmplification())
+
+	_, err = wal.Write(make([]byte, 100))
+	assert.Nil(t, err)
+	// the record crosses two blocks, it takes three chunk headers.
+	pos, err := wal.Write(make([]byte, 10*KB))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10*KB+3*chunkHeaderSize), pos.ChunkSize)
+	wal.PendingWrites(make([]byte, 10))
+	wal.PendingWrites(make([]byte, 10))
+	_, err = wal.WriteAll()
+	assert.Nil(t, err)
+
+	stats := wal.Stats()
+	assert.Equal(t, uint64(100+10*KB+20), stats.PayloadBytes)
+	assert.Equal(t, stats.PayloadBytes+6*chunkHeaderSize, stats.DiskBytes)
+	assert.Equal(t, float64(stats.DiskBytes)/float64(stats.PayloadBytes), wal.WriteAmplification())
+}
+
+func TestWalDiskSizeRecordCount(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-disk-size")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	for i := 0; i < 50; i++ {
+		_, err := wal.Write(make([]byte, 1024))
+		assert.Nil(t, err)
+	}
+	size, err := wal.DiskSize()
+	assert.Nil(t, err)
+	assert.Equal(t, wal.Stats().TotalBytes, size)
+	count, err := wal.RecordCount()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50), count)
+
+	// the records are counted again after reopening.
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Write(make([]byte, 1024))
+	assert.Nil(t, err)
+	count, err = wal.RecordCount()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(51), count)
+}
+
+func TestWalBlockCacheEntries(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-block-cache-entries")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		BlockCache:        defaultBlockSize,
+		BlockCacheEntries: 3,
+	}
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+
+	opts.BlockCache = 0
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	assert.Equal(t, 3, wal.blockCache.size)
+}
+
+func TestWalReset(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reset")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		BlockCache:        32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	for i := 0; i < 5; i++ {
+		_, err := wal.Write(make([]byte, 20*KB))
+		assert.Nil(t, err)
+	}
+	wal.PendingWrites([]byte("pending"))
+	assert.Nil(t, wal.Reset())
+	assert.True(t, wal.IsEmpty())
+	assert.Equal(t, SegSerialID(initialSegmentFileID), wal.ActiveSegmentID())
+	_, _, err = wal.NewReader().Next()
+	assert.Equal(t, io.EOF, err)
+	positions, err := wal.WriteAll()
+	assert.Nil(t, err)
+	assert.Empty(t, positions)
+
+	pos, err := wal.Write([]byte("after reset"))
+	assert.Nil(t, err)
+	data, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after reset"), data)
+	ids, err := listSegmentIDs(opts, ".SDF")
+	assert.Nil(t, err)
+	assert.Len(t, ids, 1)
+}
+
+func TestWalWarmCache(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-warm-cache")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		BlockCache:        2 * defaultBlockSize,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	var positions []*ChunkPosition
+	for i := 0; i < 4; i++ {
+		pos, err := wal.Write(make([]byte, 30*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+
+	// only the last two full blocks fit in the cache.
+	assert.Nil(t, wal.WarmCache(1))
+	assert.Equal(t, 2, wal.blockCache.Len())
+	_, err = wal.Read(positions[2])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), wal.Stats().CacheMisses)
+}
+
+func TestWalRemainingSpace(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-remaining-space")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	assert.Equal(t, int64(64*KB-segmentHeaderSize), wal.RemainingSpace())
+	_, err = wal.Write(make([]byte, 40*KB))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(64*KB-segmentHeaderSize-40*KB-2*chunkHeaderSize), wal.RemainingSpace())
+
+	assert.True(t, wal.WillFit(10*KB))
+	assert.False(t, wal.WillFit(30*KB))
+	activeID := wal.ActiveSegmentID()
+	_, err = wal.Write(make([]byte, 30*KB))
+	assert.Nil(t, err)
+	assert.Equal(t, activeID+1, wal.ActiveSegmentID())
+}
+
+func TestWalEstimateSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-estimate-size")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       40000,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	// a record filling a block exactly, and one more byte crossing into the next block.
+	for _, size := range []int{defaultBlockSize - chunkHeaderSize, defaultBlockSize - chunkHeaderSize + 1} {
+		assert.Nil(t, wal.OpenNewActiveSegment())
+		pos, err := wal.Write(make([]byte, size))
+		assert.Nil(t, err)
+		assert.True(t, int64(pos.ChunkSize) <= wal.EstimateSize(size))
+		assert.True(t, wal.activeSegment.Size() <= opts.SegmentSize)
+	}
+
+	// it would take 40004 bytes with the header of its second chunk.
+	_, err = wal.Write(make([]byte, 39990))
+	assert.Equal(t, ErrDataSizeTooLarge, err)
+}
+
+func TestWalEstimateSizeOptions(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-estimate-size-options")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		BlockSize:         4 * KB,
+		StoreTimestamps:   true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	// the timestamp and the headers of the 4KB blocks are counted.
+	size := 3 * 4 * KB
+	pos, err := wal.Write(make([]byte, size))
+	assert.Nil(t, err)
+	assert.True(t, int64(pos.ChunkSize) <= wal.EstimateSize(size))
+	assert.Equal(t, int64(chunkHeaderSize+size+timestampSize+4*chunkHeaderSize), wal.EstimateSize(size))
+
+	// the largest record accepted by Write is the largest one estimated to fit.
+	size = 32 * KB
+	for wal.EstimateSize(size) > opts.SegmentSize {
+		size--
+	}
+	_, err = wal.Write(make([]byte, size+1))
+	assert.Equal(t, ErrDataSizeTooLarge, err)
+	_, err = wal.Write(make([]byte, size))
+	assert.Nil(t, err)
+}
+
+func TestWalSegmentSizeTooSmall(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-size")
+	defer os.RemoveAll(dir)
+	for _, size := range []int64{-1, 0, defaultBlockSize - 1} {
+		_, err := Open(Options{
+			DirPath:           dir,
+			DiskFileExtension: ".SDF",
+			SegmentSize:       size,
+		})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestWalTruncateTail(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-truncate-tail")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		BlockCache:        32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 6; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 12*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Greater(t, wal.ActiveSegmentID(), positions[3].SegmentId)
+
+	// drop positions[3] and everything after it.
+	assert.Nil(t, wal.TruncateTail(positions[3]))
+	assert.Equal(t, positions[3].SegmentId, wal.ActiveSegmentID())
+	val, err := wal.Read(positions[2])
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 12*KB), val)
+
+	reader := wal.NewReader()
+	for i := 0; i < 3; i++ {
+		val, _, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 12*KB), val)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// new writes are appended right at the truncation point.
+	pos, err := wal.Write([]byte("after truncate"))
+	assert.Nil(t, err)
+	assert.Equal(t, positions[3].SegmentId, pos.SegmentId)
+	assert.Equal(t, positions[3].BlockNumber, pos.BlockNumber)
+	assert.Equal(t, positions[3].ChunkOffset, pos.ChunkOffset)
+	val, err = wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, "after truncate", string(val))
+}
+
+func TestWalTruncateHead(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-truncate-head")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 6; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 12*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+
+	assert.Nil(t, wal.TruncateHead(positions[3]))
+	_, err = wal.Read(positions[0])
+	assert.NotNil(t, err)
+
+	// the reader starts from the first record of the segment containing positions[3].
+	first := 3
+	for first > 0 && positions[first-1].SegmentId == positions[3].SegmentId {
+		first--
+	}
+	reader := wal.NewReader()
+	val, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, positions[first], pos)
+	assert.Equal(t, bytes.Repeat([]byte{byte(first)}, 12*KB), val)
+}
+
+func TestWalWriteAllContext(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-writeall-ctx")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	wal.PendingWrites([]byte("hello1"))
+	wal.PendingWrites([]byte("hello2"))
+
+	// a cancelled context appends nothing and keeps the pending writes.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = wal.WriteAllContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, wal.IsEmpty())
+	assert.Equal(t, 2, wal.PendingCount())
+	assert.Equal(t, 2*wal.EstimateSize(6), wal.PendingSize())
+
+	positions, err := wal.WriteAllContext(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, positions, 2)
+	assert.Equal(t, 0, wal.PendingCount())
+	assert.Equal(t, int64(0), wal.PendingSize())
+	val, err := wal.Read(positions[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "hello2", string(val))
+}
+
+func TestWalPendingWritesSnapshot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-pending-snapshot")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	assert.Empty(t, wal.PendingWritesSnapshot())
+	data := []byte("hello1")
+	wal.PendingWrites(data)
+	wal.PendingWrites([]byte("hello2"))
+	snapshot := wal.PendingWritesSnapshot()
+	assert.Equal(t, [][]byte{[]byte("hello1"), []byte("hello2")}, snapshot)
+
+	// the snapshot doesn't alias the pending writes.
+	snapshot[0][0] = 'j'
+	data[1] = 'a'
+	assert.Equal(t, "jello1", string(snapshot[0]))
+	positions, err := wal.WriteAll()
+	assert.Nil(t, err)
+	val, err := wal.Read(positions[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "hallo1", string(val))
+	assert.Empty(t, wal.PendingWritesSnapshot())
+}
+
+func TestWalFlush(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-flush")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		BytesPerSync:      1 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	wal.PendingWrites([]byte("hello1"))
+	wal.PendingWrites([]byte("hello2"))
+	positions, err := wal.Flush()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(positions))
+	assert.Equal(t, uint32(2*(chunkHeaderSize+6)), wal.bytesWrite)
+
+	data, err := wal.Read(positions[1])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello2"), data)
+
+	assert.Nil(t, wal.Sync())
+	assert.Equal(t, uint32(0), wal.bytesWrite)
+}
+
+func TestWalNoInitialSegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-no-initial-segment")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		NoInitialSegment:  true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	ids, err := listSegmentIDs(opts, opts.DiskFileExtension)
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, SegSerialID(0), wal.ActiveSegmentID())
+	assert.True(t, wal.IsEmpty())
+	assert.Nil(t, wal.Sync())
+	_, _, err = wal.NewReader().Next()
+	assert.Equal(t, io.EOF, err)
+
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(initialSegmentFileID), pos.SegmentId)
+	assert.False(t, wal.IsEmpty())
+}
+
+func TestWalReadOnly(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-read-only")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		ReadOnly:          true,
+	}
+	_, err := Open(opts)
+	assert.Equal(t, ErrEmpty, err)
+
+	opts.ReadOnly = false
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	// the directory is still owned by the writable WAL.
+	opts.ReadOnly = true
+	roWal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(roWal)
+	assert.Nil(t, wal.Close())
+
+	data, err := roWal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	_, err = roWal.Write([]byte("world"))
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, roWal.Sync())
+	assert.Equal(t, ErrReadOnly, roWal.Delete())
+}
+
+func TestWalPreallocate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-preallocate")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		Preallocate:       true,
+		TrimPreallocated:  true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	stat, err := wal.activeSegment.fd.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, wal.activeSegment.Size(), stat.Size())
+
+	data, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+}
+
+func TestWalCompact(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-compact")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	for i := 0; i < 100; i++ {
+		_, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1024))
+		assert.Nil(t, err)
+	}
+	activeID := wal.ActiveSegmentID()
+	err = wal.Compact(func(pos *ChunkPosition, data []byte) bool {
+		return data[0]%2 == 0
+	})
+	assert.Nil(t, err)
+	assert.True(t, wal.ActiveSegmentID() > activeID)
+
+	// the kept records are read in order, also after reopening.
+	for round := 0; round < 2; round++ {
+		reader := wal.NewReader()
+		for i := 0; i < 100; i += 2 {
+			data, _, err := reader.Next()
+			assert.Nil(t, err)
+			assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1024), data)
+		}
+		_, _, err = reader.Next()
+		assert.Equal(t, io.EOF, err)
+		reader.Close()
+
+		assert.Nil(t, wal.Close())
+		wal, err = Open(opts)
+		assert.Nil(t, err)
+	}
+}
+
+// failingRemoveFS fails to delete the file named fail.
+type failingRemoveFS struct {
+	OSFS
+	fail string
+}
+
+func (fs *failingRemoveFS) Remove(name string) error {
+	if name == fs.fail {
+		return errors.New("remove failed")
+	}
+	return fs.OSFS.Remove(name)
+}
+
+func TestWalCompactFailure(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-compact-failure")
+	renameFS, removeFS := &failingRenameFS{}, &failingRemoveFS{}
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		FS:                renameFS,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	for i := 0; i < 100; i++ {
+		_, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1024))
+		assert.Nil(t, err)
+	}
+	keep := func(pos *ChunkPosition, data []byte) bool {
+		return data[0]%2 == 0
+	}
+	readAll := func() [][]byte {
+		reader := wal.NewReader()
+		defer reader.Close()
+		var records [][]byte
+		for {
+			data, _, err := reader.Next()
+			if err == io.EOF {
+				return records
+			}
+			assert.Nil(t, err)
+			records = append(records, data)
+		}
+	}
+	manifest := filepath.Join(dir, compactManifestName)
+
+	// the new segment files fail to be renamed, the Compact is rolled back.
+	activeID := wal.ActiveSegmentID()
+	renameFS.fail = SegmentFileName(dir, ".SDF", activeID+1)
+	assert.NotNil(t, wal.Compact(keep))
+	assert.Equal(t, activeID, wal.ActiveSegmentID())
+	assert.Equal(t, 100, len(readAll()))
+	_, err = os.Stat(manifest)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", activeID+1))
+	assert.True(t, os.IsNotExist(err))
+
+	// the old segment files fail to be deleted after the commit point,
+	// the WAL uses the new ones and the next Open deletes the old ones.
+	renameFS.fail = ""
+	assert.Nil(t, wal.Close())
+	opts.FS = removeFS
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	removeFS.fail = SegmentFileName(dir, ".SDF", 1)
+	assert.NotNil(t, wal.Compact(keep))
+	assert.True(t, wal.ActiveSegmentID() > activeID)
+	assert.Equal(t, 50, len(readAll()))
+	_, err = os.Stat(manifest)
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte("after compact"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, wal.Close())
+	removeFS.fail = ""
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	records := readAll()
+	assert.Equal(t, 51, len(records))
+	assert.Equal(t, []byte("after compact"), records[50])
+	_, err = os.Stat(manifest)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", 1))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWalFileNameFunc(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-file-name-func")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		FileNameFunc: func(dirPath, ext string, id SegSerialID) string {
+			return filepath.Join(dirPath, fmt.Sprintf("wal-%06d%s", id, ext))
+		},
+		ParseIDFunc: func(name, ext string) (SegSerialID, bool) {
+			var id SegSerialID
+			if _, err := fmt.Sscanf(name, "wal-%d"+ext, &id); err != nil {
+				return 0, false
+			}
+			return id, true
+		},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	_, err = os.Stat(filepath.Join(dir, "wal-000001.SDF"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(2), wal.ActiveSegmentID())
+	data, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+}
+
+func TestWalSyncInterval(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-sync-interval")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		SyncInterval:      5 * time.Millisecond,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		wal.mu.RLock()
+		defer wal.mu.RUnlock()
+		return wal.bytesWrite == 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Nil(t, wal.Close())
+}
+
+func TestWalMaxSyncDelay(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-max-sync-delay")
+	syncs := 0
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		MaxSyncDelay:      time.Hour,
+		OnSyncLatency:     func(d time.Duration) { syncs++ },
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, syncs)
+
+	// the last sync is too old, the next write syncs.
+	wal.mu.Lock()
+	wal.lastSync = time.Now().Add(-2 * time.Hour)
+	wal.mu.Unlock()
+	_, err = wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, syncs)
+	assert.Equal(t, uint32(0), wal.bytesWrite)
+
+	_, err = wal.Write([]byte("again"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, syncs)
+}
+
+func TestWalSegmentError(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-error")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	_, err = wal.Read(pos)
+	assert.ErrorIs(t, err, ErrClosed)
+	var segErr *SegmentError
+	assert.ErrorAs(t, err, &segErr)
+	assert.Equal(t, "read", segErr.Op)
+	assert.Equal(t, pos.SegmentId, segErr.SegmentId)
+}
+
+// countingFS counts the files opened through it.
+type countingFS struct {
+	OSFS
+	opened int
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.opened++
+	return fs.OSFS.OpenFile(name, flag, perm)
+}
+
+func TestWalFS(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-fs")
+	fs := &countingFS{}
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		FS:                fs,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	// the lock file and the first segment file.
+	assert.Equal(t, 2, fs.opened)
+
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	assert.Equal(t, 3, fs.opened)
+}
+
+func TestShardOfLargeID(t *testing.T) {
+	wal := &WAL{shards: []*WAL{{}, {}, {}}}
+	options := Options{shardCount: 3, shardIndex: 2}
+	// the ids above 2^31 don't overflow on 32-bit platforms.
+	id := SegSerialID(1<<31 + 1)
+	assert.Same(t, wal.shards[2], wal.shardOf(id))
+	assert.True(t, options.ownsSegment(id))
+	assert.False(t, options.ownsSegment(id+1))
+	assert.Same(t, wal.shards[2], wal.shardOf(math.MaxUint32))
+}
+
+func TestWalShards(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-shards")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		Shards:            3,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	var wg sync.WaitGroup
+	positions := make([][]*ChunkPosition, 4)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				pos, err := wal.WriteToShard(uint64(g), []byte(fmt.Sprintf("%d-%d", g, i)))
+				assert.Nil(t, err)
+				positions[g] = append(positions[g], pos)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := range positions {
+		for i, pos := range positions[g] {
+			data, err := wal.Read(pos)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("%d-%d", g, i)), data)
+		}
+	}
+
+	// the records are read by position after reopening.
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	count, err := wal.RecordCount()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), count)
+	reader := wal.NewReader()
+	var last *ChunkPosition
+	for {
+		_, pos, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if last != nil {
+			assert.True(t, last.Compare(pos) < 0)
+		}
+		last = pos
+	}
+	_, err = wal.LastPosition()
+	assert.Equal(t, ErrShardsUnsupported, err)
+}
+
+func TestRepair(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-repair")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var last *ChunkPosition
+	for i := 0; i < 3; i++ {
+		last, err = wal.Write([]byte("hello"))
+		assert.Nil(t, err)
+	}
+	// the WAL is still opened.
+	_, err = Repair(opts)
+	assert.Equal(t, ErrDirLocked, err)
+	assert.Nil(t, wal.Close())
+
+	// simulate a torn write at the tail of the active segment.
+	fd, err := os.OpenFile(SegmentFileName(dir, ".SDF", last.SegmentId), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = fd.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	pos, err := Repair(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, last, pos)
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	reader := wal.NewReader()
+	for i := 0; i < 3; i++ {
+		_, _, err := reader.Next()
+		assert.Nil(t, err)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRepairMiddleSegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-repair-middle")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var positions []*ChunkPosition
+	for i := 0; i < 100; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1000))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Close())
+	last := positions[len(positions)-1]
+	assert.True(t, last.SegmentId > 2)
+
+	// corrupt the first record of the second segment.
+	var first int
+	for first = range positions {
+		if positions[first].SegmentId == 2 {
+			break
+		}
+	}
+	corrupt := positions[first]
+	fd, err := os.OpenFile(SegmentFileName(dir, ".SDF", 2), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte{0xff}, int64(corrupt.BlockNumber)*defaultBlockSize+corrupt.ChunkOffset+chunkHeaderSize)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	pos, err := Repair(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, positions[first-1], pos)
+	for id := SegSerialID(3); id <= last.SegmentId; id++ {
+		_, err := os.Stat(SegmentFileName(dir, ".SDF", id))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	reader := wal.NewReader()
+	for i := 0; i < first; i++ {
+		_, _, err := reader.Next()
+		assert.Nil(t, err)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalNewReaderAfter(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-after")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 60; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1000))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	for _, i := range []int{0, 30, 58} {
+		reader, err := wal.NewReaderAfter(positions[i])
+		assert.Nil(t, err)
+		data, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i + 1)}, 1000), data)
+		assert.Equal(t, *positions[i+1], *pos)
+		reader.Close()
+	}
+
+	reader, err := wal.NewReaderAfter(positions[59])
+	assert.Nil(t, err)
+	defer reader.Close()
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalNewReaderWithStartLaterBlock(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-start-block")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+
+	// find a chunk followed by one in a later block at a smaller offset.
+	i := 0
+	for positions[i+1].SegmentId != positions[i].SegmentId ||
+		positions[i+1].BlockNumber == positions[i].BlockNumber ||
+		positions[i+1].ChunkOffset >= positions[i].ChunkOffset {
+		i++
+	}
+
+	// a start position between the two chunks.
+	start := &ChunkPosition{
+		SegmentId:   positions[i].SegmentId,
+		BlockNumber: positions[i].BlockNumber,
+		ChunkOffset: positions[i].ChunkOffset + 1,
+	}
+	reader, err := wal.NewReaderWithStart(start)
+	assert.Nil(t, err)
+	defer reader.Close()
+	data, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, *positions[i+1], *pos)
+	assert.Equal(t, bytes.Repeat([]byte{byte(i + 1)}, 10*KB), data)
+
+	// a start position at a large offset of an earlier segment.
+	last := positions[len(positions)-1]
+	assert.True(t, last.SegmentId > positions[0].SegmentId)
+	start = &ChunkPosition{SegmentId: last.SegmentId - 1, BlockNumber: 1, ChunkOffset: defaultBlockSize - 1}
+	reader2, err := wal.NewReaderWithStart(start)
+	assert.Nil(t, err)
+	defer reader2.Close()
+	_, pos, err = reader2.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, last.SegmentId, pos.SegmentId)
+	assert.Equal(t, uint32(0), pos.BlockNumber)
+	assert.Equal(t, int64(segmentHeaderSize), pos.ChunkOffset)
+}
+
+func TestWalReaderPeek(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-peek")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	pos1, err := wal.Write([]byte("hello1"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	pos2, err := wal.Write([]byte("hello2"))
+	assert.Nil(t, err)
+
+	reader := wal.NewReader()
+	defer reader.Close()
+	for i := 0; i < 2; i++ {
+		data, pos, err := reader.Peek()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello1"), data)
+		assert.Equal(t, pos1, pos)
+	}
+	data, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello1"), data)
+	assert.Equal(t, pos1, pos)
+
+	// the peek crosses into the next segment file.
+	_, pos, err = reader.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, pos2, pos)
+	assert.Equal(t, pos2, reader.CurrentChunkPosition())
+	data, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello2"), data)
+
+	_, _, err = reader.Peek()
+	assert.Equal(t, io.EOF, err)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// Seek drops the peeked record.
+	_, _, err = reader.Peek()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, reader.Seek(pos1))
+	data, _, err = reader.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello1"), data)
+	assert.Nil(t, reader.Seek(pos2))
+	data, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello2"), data)
+}
+
+func TestWalReaderSeek(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-seek")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 60; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1000))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+
+	reader := wal.NewReader()
+	defer reader.Close()
+	for _, i := range []int{40, 5, 59, 0} {
+		assert.Nil(t, reader.Seek(positions[i]))
+		data, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, *positions[i], *pos)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1000), data)
+	}
+
+	err = reader.Seek(&ChunkPosition{SegmentId: positions[59].SegmentId + 1})
+	assert.NotNil(t, err)
+}
+
+func TestWalNewReaderWithStartExhausted(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-exhausted")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	// the start position is after all the segments.
+	reader, err := wal.NewReaderWithStart(&ChunkPosition{SegmentId: 5})
+	assert.Nil(t, err)
+	assert.False(t, reader.Valid())
+	assert.Nil(t, reader.CurrentChunkPosition())
+	assert.Equal(t, SegSerialID(0), reader.CurrentSegmentId())
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalReaderSnapshotAfterClose(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-snapshot")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 12*KB))
+		assert.Nil(t, err)
+	}
+
+	reader := wal.NewReader()
+	CloseWal(wal)
+
+	// the reader keeps reading its snapshot after the WAL is closed.
+	for i := 0; i < 4; i++ {
+		val, _, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 12*KB), val)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, reader.Close())
+	assert.Empty(t, wal.NewReader().segmentReaders)
+}
+
+func TestWalMaxSegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-max-segments")
+	var evicted []SegSerialID
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MaxSegments:       2,
+		OnSegmentEvicted: func(id SegSerialID) {
+			evicted = append(evicted, id)
+		},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 4; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 20*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	// every record fills a segment, only the last two segments are kept.
+	assert.Equal(t, []SegSerialID{1, 2}, evicted)
+	_, err = wal.Read(positions[1])
+	assert.NotNil(t, err)
+	val, err := wal.Read(positions[2])
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 20*KB), val)
+}
+
+func TestWalMaxTotalSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-max-total-size")
+	var evicted []SegSerialID
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MaxTotalSize:      50 * KB,
+		OnSegmentEvicted: func(id SegSerialID) {
+			evicted = append(evicted, id)
+		},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	for i := 0; i < 4; i++ {
+		_, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 20*KB))
+		assert.Nil(t, err)
+	}
+	// every record fills a segment, three full segments are over the budget at the last rotation.
+	assert.Equal(t, []SegSerialID{1}, evicted)
+
+	// MaxSegments is stricter.
+	assert.Nil(t, wal.Close())
+	opts.MaxSegments = 2
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Write(make([]byte, 20*KB))
+	assert.Nil(t, err)
+	assert.Equal(t, []SegSerialID{1, 2, 3}, evicted)
+}
+
+func TestWalSegmentRemoved(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-removed")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MaxSegments:       2,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 3; i++ {
+		pos, err := wal.Write(make([]byte, 20*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.False(t, wal.IsActive(positions[1].SegmentId))
+	assert.True(t, wal.IsActive(positions[2].SegmentId))
+
+	_, err = wal.Read(positions[0])
+	assert.ErrorIs(t, err, ErrSegmentRemoved)
+	_, err = wal.Read(&ChunkPosition{SegmentId: positions[2].SegmentId + 1})
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+
+	// the older segments are never written.
+	_, err = wal.getSegment(positions[1].SegmentId).Write([]byte("stale"))
+	assert.Equal(t, ErrSegmentSealed, err)
+}
+
+func TestWalReadBatch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-read-batch")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       64 * KB,
+		BlockCache:        64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 20; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 5*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	// read them scattered, the results follow the input order.
+	batch := []*ChunkPosition{positions[17], positions[2], positions[9], positions[2], positions[0]}
+	results, err := wal.ReadBatch(batch)
+	assert.Nil(t, err)
+	for i, data := range results {
+		expected, err := wal.Read(batch[i])
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+	}
+	assert.Equal(t, bytes.Repeat([]byte{17}, 5*KB), results[0])
+
+	batch[3] = &ChunkPosition{SegmentId: 100}
+	_, err = wal.ReadBatch(batch)
+	var batchErr *ReadBatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 3, batchErr.Index)
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestWalReadBatchShards(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-read-batch-shards")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       64 * KB,
+		Shards:            3,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 9; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	batch := []*ChunkPosition{positions[5], positions[1], positions[2], positions[0]}
+	results, err := wal.ReadBatch(batch)
+	assert.Nil(t, err)
+	for i, data := range results {
+		expected, err := wal.Read(batch[i])
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+	}
+
+	// the index is the one in the batch, of the first failing position of all the shards.
+	second := positions[0].SegmentId + 1
+	assert.Equal(t, second, positions[1].SegmentId)
+	batch = append(batch, &ChunkPosition{SegmentId: second + 2}, &ChunkPosition{SegmentId: second, BlockNumber: 9})
+	_, err = wal.ReadBatch(batch)
+	var batchErr *ReadBatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 5, batchErr.Index)
+}
+
+func TestWalOnRotate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-on-rotate")
+	var rotations [][2]SegSerialID
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		OnRotate: func(oldID, newID SegSerialID) {
+			rotations = append(rotations, [2]SegSerialID{oldID, newID})
+		},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	for i := 0; i < 40; i++ {
+		_, err := wal.Write(make([]byte, 1024))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, [][2]SegSerialID{{1, 2}, {2, 3}}, rotations)
+}
+
+func TestWalMaxSegmentAge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-age")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MaxSegmentAge:     10 * time.Millisecond,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	pos1, err := wal.Write([]byte("hello1"))
+	assert.Nil(t, err)
+	pos2, err := wal.Write([]byte("hello2"))
+	assert.Nil(t, err)
+	assert.Equal(t, pos1.SegmentId, pos2.SegmentId)
+
+	time.Sleep(20 * time.Millisecond)
+	pos3, err := wal.Write([]byte("hello3"))
+	assert.Nil(t, err)
+	assert.Equal(t, pos1.SegmentId+1, pos3.SegmentId)
+}
+
+func TestWalChecksumXXHash(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-xxhash")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		ChecksumType:      ChecksumXXHash,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("x"), 100*KB)
+	pos, err := wal.Write(data)
+	assert.Nil(t, err)
+	val, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, data, val)
+	assert.Nil(t, wal.Close())
+
+	// the checksum type is recorded in the segment header, so it can change across reopens.
+	opts.ChecksumType = ChecksumCRC32
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, data, val)
+	assert.Nil(t, wal.Close())
+
+	// a corrupted chunk is reported with its position.
+	fd, err := os.OpenFile(SegmentFileName(dir, ".SDF", pos.SegmentId), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte("y"), pos.ChunkOffset+chunkHeaderSize+10)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	_, err = wal.Read(pos)
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+	var checksumErr *ChecksumError
+	assert.ErrorAs(t, err, &checksumErr)
+	assert.Equal(t, *pos, ChunkPosition{
+		SegmentId:   checksumErr.SegmentId,
+		BlockNumber: checksumErr.BlockNumber,
+		ChunkOffset: checksumErr.ChunkOffset,
+		ChunkSize:   pos.ChunkSize,
+	})
+}
+
+func TestWalPipelineChecksums(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-pipeline-checksums")
+	pipelinedDir, _ := os.MkdirTemp("", "test-pipeline-checksums")
+	defer os.RemoveAll(pipelinedDir)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		ChecksumType:      ChecksumXXHash,
+	}
+	pipelinedOpts := opts
+	pipelinedOpts.DirPath = pipelinedDir
+	pipelinedOpts.PipelineChecksums = true
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	pipelined, err := Open(pipelinedOpts)
+	assert.Nil(t, err)
+
+	var records [][]byte
+	write := func(w *WAL) []*ChunkPosition {
+		var positions []*ChunkPosition
+		for _, data := range [][]byte{[]byte("small"), bytes.Repeat([]byte("x"), 200*KB)} {
+			pos, err := w.Write(data)
+			assert.Nil(t, err)
+			positions = append(positions, pos)
+		}
+		for i := 0; i < 100; i++ {
+			w.PendingWrites([]byte(fmt.Sprintf("record %d %s", i, strings.Repeat("y", i*100))))
+		}
+		batch, err := w.WriteAll()
+		assert.Nil(t, err)
+		return append(positions, batch...)
+	}
+	records = append(records, []byte("small"), bytes.Repeat([]byte("x"), 200*KB))
+	for i := 0; i < 100; i++ {
+		records = append(records, []byte(fmt.Sprintf("record %d %s", i, strings.Repeat("y", i*100))))
+	}
+	write(wal)
+	positions := write(pipelined)
+	assert.Nil(t, wal.Close())
+	assert.Nil(t, pipelined.Close())
+
+	// the same bytes are written.
+	content, err := os.ReadFile(SegmentFileName(dir, ".SDF", 1))
+	assert.Nil(t, err)
+	pipelinedContent, err := os.ReadFile(SegmentFileName(pipelinedDir, ".SDF", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, content, pipelinedContent)
+
+	pipelined, err = Open(pipelinedOpts)
+	assert.Nil(t, err)
+	defer CloseWal(pipelined)
+	for i, pos := range positions {
+		data, err := pipelined.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], data)
+	}
+	os.RemoveAll(dir)
+}
+
+// failingCompressor fails to compress the records starting with "fail".
+type failingCompressor struct {
+	SnappyCompressor
+}
+
+func (c failingCompressor) Compress(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("fail")) {
+		return nil, errors.New("compress failed")
+	}
+	return c.SnappyCompressor.Compress(data)
+}
+
+func TestWalPipelineChecksumsFailedWrite(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-pipeline-checksums-failed")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		PipelineChecksums: true,
+		Compressor:        failingCompressor{},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	// the chunks framed before the failure are dropped with their checksums.
+	for i := 0; i < 20; i++ {
+		wal.PendingWrites(bytes.Repeat([]byte{byte(i)}, 4*KB))
+	}
+	wal.PendingWrites([]byte("fail"))
+	_, err = wal.WriteAll()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(wal.activeSegment.unsummed))
+
+	var records [][]byte
+	for i := 0; i < 20; i++ {
+		record := []byte(fmt.Sprintf("record %d %s", i, strings.Repeat("y", i*1000)))
+		records = append(records, record)
+		wal.PendingWrites(record)
+	}
+	positions, err := wal.WriteAll()
+	assert.Nil(t, err)
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], data)
+	}
+}
+
+func TestWalCompressColdSegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-cold-segments")
+	opts := Options{
+		DirPath:              dir,
+		DiskFileExtension:    ".SDF",
+		SegmentSize:          64 * KB,
+		BlockCache:           32 * KB,
+		CompressColdSegments: true,
+		ColdSegmentAge:       time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d %s", i, strings.Repeat("x", 5*KB))))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Equal(t, 4, len(wal.SegmentIDs()))
+	before, err := wal.DiskSize()
+	assert.Nil(t, err)
+
+	// the segment files rotated an hour ago, except the second one which was read since.
+	wal.mu.Lock()
+	for _, segment := range wal.olderSegments {
+		segment.createdAt = segment.createdAt.Add(-2 * time.Hour)
+		segment.lastAccess.Store(0)
+	}
+	wal.mu.Unlock()
+	for _, pos := range positions {
+		if pos.SegmentId == 2 {
+			_, err = wal.Read(pos)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, wal.compressColdSegments())
+	isCold := func(id SegSerialID) bool {
+		content, err := os.ReadFile(SegmentFileName(dir, ".SDF", id))
+		assert.Nil(t, err)
+		return bytes.HasPrefix(content, coldMagic)
+	}
+	assert.True(t, isCold(1))
+	assert.False(t, isCold(2))
+	assert.True(t, isCold(3))
+	assert.False(t, isCold(4))
+	after, err := wal.DiskSize()
+	assert.Nil(t, err)
+	assert.Less(t, after, before)
+
+	// the positions stay valid, through Read and the readers.
+	check := func(wal *WAL) {
+		for i, pos := range positions {
+			data, err := wal.Read(pos)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("record %d %s", i, strings.Repeat("x", 5*KB))), data)
+		}
+		reader := wal.NewReader()
+		defer reader.Close()
+		count := 0
+		for {
+			_, _, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			count++
+		}
+		assert.Equal(t, len(positions), count)
+	}
+	check(wal)
+	assert.Nil(t, wal.Close())
+
+	// the cold segment files are read by Open without the option.
+	opts.CompressColdSegments = false
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	check(wal)
+	assert.Nil(t, wal.Close())
+
+	// the background goroutine compresses the older segment files once they are cold.
+	opts.CompressColdSegments = true
+	opts.ColdSegmentAge = 20 * time.Millisecond
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return isCold(2) }, 5*time.Second, 10*time.Millisecond)
+	check(wal)
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(4), pos.SegmentId)
+	assert.False(t, isCold(4))
+}
+
+func TestWalSegmentHeader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-header")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte("legacy"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	// strip the header, like a segment file written before it.
+	name := SegmentFileName(dir, ".SDF", 1)
+	content, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, segmentMagic, content[:4])
+	assert.Nil(t, os.WriteFile(name, content[segmentHeaderSize:], 0644))
+	// a file which is not a segment file is skipped.
+	assert.Nil(t, os.WriteFile(SegmentFileName(dir, ".SDF", 2), []byte("not a segment file"), 0644))
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(3), wal.ActiveSegmentID())
+	pos, err := wal.Write([]byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(segmentHeaderSize), pos.ChunkOffset)
+	reader := wal.NewReader()
+	data, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("legacy"), data)
+	data, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), data)
+	reader.Close()
+	assert.Nil(t, wal.Close())
+
+	// an unknown format version is an error.
+	name = SegmentFileName(dir, ".SDF", 3)
+	content, err = os.ReadFile(name)
+	assert.Nil(t, err)
+	content[4] = segmentFormatVersion + 1
+	binary.LittleEndian.PutUint32(content[12:16], crc32.ChecksumIEEE(content[:12]))
+	assert.Nil(t, os.WriteFile(name, content, 0644))
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, ErrSegmentVersion)
+	os.RemoveAll(dir)
+}
+
+func TestWalCorruptedLegacySegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-corrupted-legacy")
+	defer os.RemoveAll(dir)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 90; i++ {
+		if i > 0 && i%30 == 0 {
+			assert.Nil(t, wal.OpenNewActiveSegment())
+		}
+		_, err = wal.Write(bytes.Repeat([]byte{byte(i)}, 100))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, wal.Close())
+
+	// strip the headers, like segment files written before them, and corrupt a record of the second one.
+	for id := SegSerialID(1); id <= 3; id++ {
+		name := SegmentFileName(dir, ".SDF", id)
+		content, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		content = content[segmentHeaderSize:]
+		if id == 2 {
+			content[10] ^= 0xff
+		}
+		assert.Nil(t, os.WriteFile(name, content, 0644))
+	}
+
+	// the corrupted segment file is not taken for another file.
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Equal(t, []SegSerialID{1, 2, 3}, wal.SegmentIDs())
+	reader := wal.NewReader()
+	defer reader.Close()
+	count := 0
+	for {
+		_, _, err = reader.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+	assert.Equal(t, 30, count)
+}
+
+func TestWalSegmentSizeFunc(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-size-func")
+	var prevIDs []SegSerialID
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		SegmentSizeFunc: func(prevID SegSerialID) int64 {
+			prevIDs = append(prevIDs, prevID)
+			return int64(prevID+1) * 32 * KB
+		},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	// 3 records fit in the first segment file, and the next 3 in the second one.
+	assert.Equal(t, []SegSerialID{0, 1}, prevIDs)
+	assert.Equal(t, SegSerialID(2), wal.ActiveSegmentID())
+	remaining := wal.RemainingSpace()
+	assert.True(t, remaining > 30*KB)
+	assert.Nil(t, wal.Close())
+
+	// the active segment file keeps its size after a reopen.
+	opts.SegmentSizeFunc = func(prevID SegSerialID) int64 {
+		return 32 * KB
+	}
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, remaining, wal.RemainingSpace())
+	assert.Nil(t, wal.Close())
+
+	// a size smaller than a block is an error.
+	smallDir, _ := os.MkdirTemp("", "test-segment-size-func-small")
+	defer os.RemoveAll(smallDir)
+	_, err = Open(Options{
+		DirPath:           smallDir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		SegmentSizeFunc: func(prevID SegSerialID) int64 {
+			return KB
+		},
+	})
+	assert.NotNil(t, err)
+
+	// a segment file with a version 1 header is still read.
+	name := SegmentFileName(dir, ".SDF", 1)
+	content, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	header := make([]byte, segmentHeaderSizeV1)
+	copy(header, content[:12])
+	header[4] = 1
+	binary.LittleEndian.PutUint32(header[12:16], crc32.ChecksumIEEE(header[:12]))
+	assert.Nil(t, os.WriteFile(name, append(header, content[segmentHeaderSize:segmentHeaderSize+10*KB+chunkHeaderSize]...), 0644))
+	opts.SegmentSizeFunc = nil
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	data, err := wal.Read(&ChunkPosition{SegmentId: 1, ChunkOffset: segmentHeaderSizeV1})
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("x"), 10*KB), data)
+}
+
+// openSegments returns the number of older segment files of the WAL whose file is open.
+func openSegments(wal *WAL) int {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	var n int
+	for _, segment := range wal.olderSegments {
+		if segment.refs.Load() > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWalMaxOpenSegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-max-open-segments")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		BlockCache:        16 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var positions []*ChunkPosition
+	for i := 0; i < 30; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Close())
+
+	opts.MaxOpenSegments = 2
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Equal(t, 10, len(wal.SegmentIDs()))
+	assert.Equal(t, 2, openSegments(wal))
+
+	// the reads open the segment files again, the least recently used ones are closed.
+	for _, i := range []int{0, 29, 3, 12, 0, 27, 6} {
+		data, err := wal.Read(positions[i])
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), data)
+		assert.LessOrEqual(t, openSegments(wal), 2)
+	}
+
+	// the readers open them as they go.
+	reader := wal.NewReader()
+	var count int
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(count)}, 10*KB), data)
+		assert.LessOrEqual(t, openSegments(wal), 2)
+		count++
+	}
+	assert.Equal(t, 30, count)
+	assert.Nil(t, reader.Close())
+
+	// a closed segment file is deleted and truncated to.
+	assert.Nil(t, wal.DeleteSegment(positions[9].SegmentId))
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", positions[9].SegmentId))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, wal.TruncateTail(positions[4]))
+	assert.Equal(t, positions[4].SegmentId, wal.ActiveSegmentID())
+	pos, err := wal.Write([]byte("after"))
+	assert.Nil(t, err)
+	data, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after"), data)
+	data, err = wal.Read(positions[0])
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0}, 10*KB), data)
+
+	// the reads from several goroutines.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 4*10; i++ {
+				data, err := wal.Read(positions[i%4])
+				assert.Nil(t, err)
+				assert.Equal(t, bytes.Repeat([]byte{byte(i % 4)}, 10*KB), data)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestWalReaderNextPosition(t *testing.T) {
+	for _, opts := range []Options{
+		{SegmentSize: 256 * KB},
+		{SegmentSize: 256 * KB, BlockCache: 64 * KB},
+		{SegmentSize: 256 * KB, MMapReads: true},
+	} {
+		dir, _ := os.MkdirTemp("", "test-next-position")
+		opts.DirPath = dir
+		opts.DiskFileExtension = ".SDF"
+		wal, err := Open(opts)
+		assert.Nil(t, err)
+
+		var positions []*ChunkPosition
+		for i := 0; i < 50; i++ {
+			size := 100 * i
+			if i%10 == 9 {
+				size = 70 * KB
+			}
+			pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, size))
+			assert.Nil(t, err)
+			positions = append(positions, pos)
+		}
+		assert.True(t, len(wal.SegmentIDs()) > 1)
+
+		// the positions are the ones returned by Next.
+		var expected []*ChunkPosition
+		reader := wal.NewReader()
+		for {
+			_, pos, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			expected = append(expected, pos)
+		}
+		reader = wal.NewReader()
+		var got []*ChunkPosition
+		for {
+			pos, err := reader.NextPosition()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			got = append(got, pos)
+		}
+		assert.Equal(t, expected, got)
+		for i, pos := range got {
+			assert.Equal(t, positions[i].SegmentId, pos.SegmentId)
+			assert.Equal(t, positions[i].BlockNumber, pos.BlockNumber)
+			assert.Equal(t, positions[i].ChunkOffset, pos.ChunkOffset)
+		}
+
+		// a peeked record is returned again, and Next goes on after the position.
+		reader = wal.NewReader()
+		_, peeked, err := reader.Peek()
+		assert.Nil(t, err)
+		pos, err := reader.NextPosition()
+		assert.Nil(t, err)
+		assert.Equal(t, peeked, pos)
+		data, _, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{1}, 100), data)
+		CloseWal(wal)
+	}
+}
+
+func TestWalReaderResilient(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-resilient")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	var positions []*ChunkPosition
+	for i := 0; i < 100; i++ {
+		size := KB
+		// a record spanning 3 blocks.
+		if i == 80 {
+			size = 80 * KB
+		}
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, size))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Sync())
+
+	// corrupt a record in the block 1, and the middle chunk of the spanning record.
+	name := SegmentFileName(dir, ".SDF", 1)
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	corrupted := positions[40]
+	assert.Equal(t, uint32(1), corrupted.BlockNumber)
+	_, err = fd.WriteAt([]byte("corrupted"), int64(corrupted.BlockNumber)*defaultBlockSize+corrupted.ChunkOffset+chunkHeaderSize)
+	assert.Nil(t, err)
+	middle := int64(positions[80].BlockNumber+1) * defaultBlockSize
+	_, err = fd.WriteAt([]byte("corrupted"), middle+chunkHeaderSize)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	reader := wal.NewReader()
+	for err == nil {
+		_, _, err = reader.Next()
+	}
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+
+	reader = wal.NewReaderResilient()
+	var read []byte
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		read = append(read, data[0])
+	}
+	// the records after the corrupted one in its block are skipped too.
+	for i := 0; i < 100; i++ {
+		lost := i >= 40 && positions[i].BlockNumber == 1 || i == 80
+		assert.Equal(t, !lost, bytes.IndexByte(read, byte(i)) >= 0, i)
+	}
+	skipped := reader.SkippedPositions()
+	assert.Equal(t, 3, len(skipped))
+	assert.Equal(t, corrupted.BlockNumber, skipped[0].BlockNumber)
+	assert.Equal(t, corrupted.ChunkOffset, skipped[0].ChunkOffset)
+	assert.Equal(t, positions[80].ChunkOffset, skipped[1].ChunkOffset)
+	assert.Equal(t, positions[80].BlockNumber+1, skipped[2].BlockNumber)
+}
+
+func TestChunkPositionEncode(t *testing.T) {
+	positions := []*ChunkPosition{
+		{SegmentId: 1},
+		{SegmentId: 1, BlockNumber: 0, ChunkOffset: 24, ChunkSize: 17},
+		{SegmentId: 1, BlockNumber: 3, ChunkOffset: 100, ChunkSize: 1 << 20},
+		{SegmentId: math.MaxUint32, BlockNumber: math.MaxUint32, ChunkOffset: math.MaxInt64, ChunkSize: math.MaxUint32},
+	}
+	for i, pos := range positions {
+		decoded, err := DecodeChunkPosition(pos.Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, pos, decoded)
+		decoded, err = DecodeChunkPosition(pos.EncodeFixedSize())
+		assert.Nil(t, err)
+		assert.Equal(t, pos, decoded)
+		assert.Equal(t, len(positions[0].EncodeFixedSize()), len(pos.EncodeFixedSize()))
+
+		assert.Equal(t, 0, pos.Compare(pos))
+		if i > 0 {
+			assert.Equal(t, -1, positions[i-1].Compare(pos))
+			assert.Equal(t, 1, pos.Compare(positions[i-1]))
+		}
+	}
+	// the block number is compared before the chunk offset.
+	assert.Equal(t, -1, (&ChunkPosition{SegmentId: 2, BlockNumber: 1}).Compare(&ChunkPosition{SegmentId: 2, BlockNumber: 2, ChunkOffset: -1}))
+
+	// the positions encoded before the version are still decoded.
+	legacy := binary.AppendUvarint(nil, 5)
+	legacy = binary.AppendUvarint(legacy, 2)
+	legacy = binary.AppendUvarint(legacy, 300)
+	legacy = binary.AppendUvarint(legacy, 40)
+	decoded, err := DecodeChunkPosition(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, &ChunkPosition{SegmentId: 5, BlockNumber: 2, ChunkOffset: 300, ChunkSize: 40}, decoded)
+
+	encoded := positions[2].Encode()
+	for _, invalid := range [][]byte{nil, {0}, {0, 2, 1, 0, 0, 0}, encoded[:len(encoded)-1]} {
+		_, err := DecodeChunkPosition(invalid)
+		assert.ErrorIs(t, err, ErrInvalidPosition)
+	}
+}
+
+func TestWalDeleteSegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-delete-segment")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	var positions []*ChunkPosition
+	for i := 0; i < 9; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Equal(t, SegSerialID(3), wal.ActiveSegmentID())
+
+	assert.ErrorIs(t, wal.DeleteSegment(3), ErrActiveSegment)
+	assert.Nil(t, wal.DeleteSegment(2))
+	assert.ErrorIs(t, wal.DeleteSegment(2), ErrSegmentRemoved)
+	assert.Equal(t, []SegSerialID{1, 3}, wal.SegmentIDs())
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", 2))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = wal.Read(positions[4])
+	assert.ErrorIs(t, err, ErrSegmentRemoved)
+	data, err := wal.Read(positions[0])
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0}, 10*KB), data)
+
+	// the readers skip the deleted segment file.
+	reader := wal.NewReader()
+	var count int
+	for {
+		_, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 6, count)
+}
+
+func TestWalRequireContiguousSegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-contiguous-segments")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 12; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, SegSerialID(4), wal.ActiveSegmentID())
+	// the head is not a gap.
+	assert.Nil(t, wal.TruncateHead(&ChunkPosition{SegmentId: 2}))
+	assert.Nil(t, wal.Close())
+
+	opts.RequireContiguousSegments = true
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	assert.Nil(t, os.Remove(SegmentFileName(dir, ".SDF", 3)))
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, ErrSegmentMissing)
+	assert.Contains(t, err.Error(), "3.SDF")
+
+	// the gap is ignored by default.
+	opts.RequireContiguousSegments = false
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	CloseWal(wal)
+}
+
+func TestWalOpenEmptySegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-empty-segments")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	pos1, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	// segment file 2 is left with only its header.
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	pos3, err := wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+	// a segment file created right before a crash.
+	assert.Nil(t, os.WriteFile(SegmentFileName(dir, ".SDF", 4), nil, 0644))
+
+	exists := func(id SegSerialID) bool {
+		_, err := os.Stat(SegmentFileName(dir, ".SDF", id))
+		return err == nil
+	}
+	opts.RequireContiguousSegments = true
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, exists(2))
+	assert.Equal(t, SegSerialID(4), wal.ActiveSegmentID())
+	assert.Nil(t, wal.Close())
+
+	// the empty older segment file is deleted, the last one is the active one.
+	opts.RequireContiguousSegments = false
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.False(t, exists(2))
+	assert.Equal(t, []SegSerialID{1, 3, 4}, wal.SegmentIDs())
+	assert.Equal(t, SegSerialID(4), wal.ActiveSegmentID())
+	pos4, err := wal.Write([]byte("again"))
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(4), pos4.SegmentId)
+
+	var values []string
+	reader := wal.NewReader()
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		values = append(values, string(data))
+	}
+	assert.Equal(t, []string{"hello", "world", "again"}, values)
+	for _, pos := range []*ChunkPosition{pos1, pos3} {
+		_, err := wal.Read(pos)
+		assert.Nil(t, err)
+	}
+}
+
+func TestWalMergeSmallSegmentsOnOpen(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-merge-small-segments")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+		if i%2 == 1 {
+			assert.Nil(t, wal.OpenNewActiveSegment())
+		}
+	}
+	// a large segment file breaks the runs.
+	assert.Nil(t, wal.TruncateTail(positions[8]))
+	pos, err := wal.Write(bytes.Repeat([]byte("x"), 20*KB))
+	assert.Nil(t, err)
+	positions[8] = pos
+	positions = positions[:9]
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	assert.Nil(t, wal.Close())
+
+	opts.MergeSmallSegmentsOnOpen = 8 * KB
+	remap := make(map[ChunkPosition]*ChunkPosition)
+	opts.OnMergeRemap = func(oldPos, newPos *ChunkPosition) {
+		remap[*oldPos] = newPos
+	}
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []SegSerialID{1, 5, 6}, wal.SegmentIDs())
+	assert.Equal(t, 8, len(remap))
+	for i, pos := range positions[:8] {
+		data, err := wal.Read(remap[*pos])
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, KB), data)
+	}
+	data, err := wal.Read(positions[8])
+	assert.Nil(t, err)
+	assert.Equal(t, 20*KB, len(data))
+	assert.Nil(t, wal.Close())
+
+	// a committed merge is finished by the next Open, an uncommitted one is undone.
+	tmpName := SegmentFileName(dir, mergeFileExt(".SDF"), 5)
+	content, err := os.ReadFile(SegmentFileName(dir, ".SDF", 1))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(tmpName, content, 0644))
+	assert.Nil(t, writeMergeManifest(opts, 5, 5))
+	assert.Nil(t, os.WriteFile(SegmentFileName(dir, mergeFileExt(".SDF"), 1), content, 0644))
+	opts.MergeSmallSegmentsOnOpen = 0
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	_, err = os.Stat(filepath.Join(dir, mergeManifestName))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(SegmentFileName(dir, mergeFileExt(".SDF"), 1))
+	assert.True(t, os.IsNotExist(err))
+	data, err = wal.Read(&ChunkPosition{SegmentId: 5, BlockNumber: remap[*positions[0]].BlockNumber, ChunkOffset: remap[*positions[0]].ChunkOffset})
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0}, KB), data)
+}
+
+func TestWalMergeSkipsNotSegmentFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-merge-not-segment")
+	defer os.RemoveAll(dir)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := wal.Write(bytes.Repeat([]byte{byte(i)}, KB))
+		assert.Nil(t, err)
+		assert.Nil(t, wal.OpenNewActiveSegment())
+	}
+	assert.Nil(t, wal.Close())
+	notSegment := SegmentFileName(dir, ".SDF", 2)
+	assert.Nil(t, os.WriteFile(notSegment, []byte("not a segment file"), 0644))
+
+	// the runs stop at the skipped file, it is kept.
+	opts.MergeSmallSegmentsOnOpen = 8 * KB
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Equal(t, []SegSerialID{1, 3, 5}, wal.SegmentIDs())
+	content, err := os.ReadFile(notSegment)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("not a segment file"), content)
+	var records [][]byte
+	reader := wal.NewReader()
+	defer reader.Close()
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		records = append(records, data)
+	}
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte{0}, KB), bytes.Repeat([]byte{2}, KB), bytes.Repeat([]byte{3}, KB)}, records)
+}
+
+func TestWalFollow(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-follow")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	for i := 0; i < 2; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	records, errs := wal.Follow(ctx, nil)
+	var positions []*ChunkPosition
+	for i := 0; i < 6; i++ {
+		// the records after the first two are written while it waits, across segment files.
+		if i >= 2 {
+			pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+			assert.Nil(t, err)
+			positions = append(positions, pos)
+		}
+		select {
+		case record := <-records:
+			assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), record.Data)
+			if i >= 2 {
+				assert.Equal(t, positions[i-2], record.Pos)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no record followed")
+		}
+	}
+	cancel()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+	_, ok := <-records
+	assert.False(t, ok)
+
+	assert.True(t, positions[3].SegmentId > positions[0].SegmentId)
+
+	// follow from a position.
+	ctx, cancel = context.WithCancel(context.Background())
+	records, errs = wal.Follow(ctx, positions[2])
+	record := <-records
+	assert.Equal(t, positions[2], record.Pos)
+	record = <-records
+	assert.Equal(t, positions[3], record.Pos)
+	cancel()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+}
+
+func TestWalFollowReset(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-follow-reset")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records, _ := wal.Follow(ctx, nil)
+	receive := func() Record {
+		select {
+		case record := <-records:
+			return record
+		case <-time.After(5 * time.Second):
+			t.Fatal("no record followed")
+		}
+		return Record{}
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), receive().Data)
+	}
+	assert.True(t, wal.ActiveSegmentID() > 1)
+
+	// the record written after Reset is at the start of the initial segment file again.
+	assert.Nil(t, wal.Reset())
+	pos, err := wal.Write([]byte("after reset"))
+	assert.Nil(t, err)
+	record := receive()
+	assert.Equal(t, []byte("after reset"), record.Data)
+	assert.Equal(t, pos, record.Pos)
+}
+
+func TestWalNextIDFunc(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-next-id-func")
+	// the node 3, every id is 10 after the previous one.
+	const node = 3_000_000_000
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		NextIDFunc: func(prev SegSerialID) SegSerialID {
+			if prev == 0 {
+				return node + 1
+			}
+			return prev + 10
+		},
+		RequireContiguousSegments: true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(node+1), wal.ActiveSegmentID())
+	var positions []*ChunkPosition
+	for i := 0; i < 7; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	assert.Equal(t, []SegSerialID{node + 1, node + 11, node + 21, node + 31}, wal.SegmentIDs())
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", node+11))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Equal(t, SegSerialID(node+31), wal.ActiveSegmentID())
+	reader := wal.NewReader()
+	for i := 0; i < 7; i++ {
+		data, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, positions[i], pos)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), data)
+	}
+	reader.Close()
+
+	// the ids must increase.
+	wal.options.NextIDFunc = func(prev SegSerialID) SegSerialID {
+		return prev
+	}
+	assert.NotNil(t, wal.OpenNewActiveSegment())
+}
+
+// failingRenameFS fails the renames to the file fail.
+type failingRenameFS struct {
+	OSFS
+	fail string
+}
+
+func (fs *failingRenameFS) Rename(oldpath, newpath string) error {
+	if newpath == fs.fail {
+		return errors.New("rename failed")
+	}
+	return fs.OSFS.Rename(oldpath, newpath)
+}
+
+// failingCloseFS opens the segment files whose Close fails, after closing them.
+type failingCloseFS struct {
+	OSFS
+}
+
+type failingCloseFile struct {
+	File
+}
+
+func (fs *failingCloseFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := fs.OSFS.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, ".SDF") {
+		return fd, err
+	}
+	return &failingCloseFile{File: fd}, nil
+}
+
+func (f *failingCloseFile) Close() error {
+	_ = f.File.Close()
+	return errors.New("close failed")
+}
+
+func TestWalCloseFailureUnlocksDir(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-close-failure")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		FS:                &failingCloseFS{},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, wal.Close())
+
+	// the directory lock is released even though the segment files failed to close.
+	opts.FS = nil
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Equal(t, []SegSerialID{1, 2}, wal.SegmentIDs())
+}
+
+// failingChecksumFS fails to create the checksum files while fail is set.
+type failingChecksumFS struct {
+	OSFS
+	fail bool
+}
+
+func (fs *failingChecksumFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fs.fail && strings.HasSuffix(name, checksumFileExt) {
+		return nil, errors.New("create checksum file failed")
+	}
+	return fs.OSFS.OpenFile(name, flag, perm)
+}
+
+func TestWalRotateFailureRemovesNewSegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-rotate-failure")
+	fs := &failingChecksumFS{}
+	opts := Options{
+		DirPath:               dir,
+		DiskFileExtension:     ".SDF",
+		SegmentSize:           32 * KB,
+		SegmentFooterChecksum: true,
+		FS:                    fs,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	fs.fail = true
+	assert.NotNil(t, wal.OpenNewActiveSegment())
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", 2))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []SegSerialID{1}, wal.SegmentIDs())
+
+	fs.fail = false
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	assert.Equal(t, []SegSerialID{1, 2}, wal.SegmentIDs())
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(2), pos.SegmentId)
+}
+
+func TestWalRenameFileExtRollback(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-rename-rollback")
+	defer os.RemoveAll(dir)
+	fs := &failingRenameFS{}
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		FS:                fs,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	ids := wal.SegmentIDs()
+	assert.True(t, len(ids) > 2)
+	assert.Nil(t, wal.Close())
+
+	// the third segment file fails, the first two are renamed back.
+	fs.fail = SegmentFileName(dir, ".OLD", ids[2])
+	assert.NotNil(t, wal.RenameFileExt(".OLD"))
+	fs.fail = ""
+	for _, id := range ids {
+		_, err := os.Stat(SegmentFileName(dir, ".SDF", id))
+		assert.Nil(t, err)
+		_, err = os.Stat(SegmentFileName(dir, ".OLD", id))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	assert.Nil(t, wal.RenameFileExt(".OLD"))
+	for _, id := range ids {
+		_, err := os.Stat(SegmentFileName(dir, ".OLD", id))
+		assert.Nil(t, err)
+	}
+}
+
+func TestWalSegmentPath(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-path")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	for i := 0; i < 5; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	ids := wal.SegmentIDs()
+	assert.True(t, len(ids) > 1)
+	for _, id := range ids {
+		path, err := wal.SegmentPath(id)
+		assert.Nil(t, err)
+		assert.Equal(t, SegmentFileName(dir, ".SDF", id), path)
+	}
+	_, err = wal.SegmentPath(ids[len(ids)-1] + 1)
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+
+	// the path follows the extension set by RenameFileExt.
+	assert.Nil(t, wal.Close())
+	assert.Nil(t, wal.RenameFileExt(".OLD"))
+	opts.DiskFileExtension = ".OLD"
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	path, err := wal.SegmentPath(ids[0])
+	assert.Nil(t, err)
+	assert.Equal(t, SegmentFileName(dir, ".OLD", ids[0]), path)
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func TestWalSegmentInfo(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-info")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	// 2 records in the block 0, then one spanning the blocks 0 to 2.
+	for _, size := range []int{10 * KB, 10 * KB, 50 * KB} {
+		_, err = wal.Write(make([]byte, size))
+		assert.Nil(t, err)
+	}
+	info, err := wal.SegmentInfo(1)
+	assert.Nil(t, err)
+	assert.Equal(t, SegSerialID(1), info.ID)
+	assert.Equal(t, wal.activeSegment.Size(), info.Size)
+	assert.Equal(t, int64(3), info.Blocks)
+	assert.Equal(t, int64(5), info.Chunks)
+	assert.Equal(t, int64(3), info.Records)
+	assert.Equal(t, int64(1), info.SpanningRecords)
+
+	_, err = wal.SegmentInfo(2)
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestWalMirrorDirPath(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-mirror")
+	mirrorDir, _ := os.MkdirTemp("", "test-mirror-copy")
+	defer os.RemoveAll(mirrorDir)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MirrorDirPath:     mirrorDir,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.TruncateHead(&ChunkPosition{SegmentId: 2}))
+	ids := wal.SegmentIDs()
+	assert.Nil(t, wal.Close())
+
+	// the mirror has the same segment files.
+	_, err = os.Stat(SegmentFileName(mirrorDir, ".SDF", 1))
+	assert.True(t, os.IsNotExist(err))
+	for _, id := range ids {
+		content, err := os.ReadFile(SegmentFileName(dir, ".SDF", id))
+		assert.Nil(t, err)
+		mirrored, err := os.ReadFile(SegmentFileName(mirrorDir, ".SDF", id))
+		assert.Nil(t, err)
+		assert.Equal(t, content, mirrored)
+	}
+
+	// a corrupted chunk is read from the mirror.
+	name := SegmentFileName(dir, ".SDF", positions[4].SegmentId)
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte("corrupted"), int64(positions[4].ChunkOffset)+chunkHeaderSize)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	data, err := wal.Read(positions[4])
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{4}, 10*KB), data)
+	assert.Nil(t, wal.Close())
+
+	// a missing mirror is copied by Open.
+	assert.Nil(t, os.Remove(SegmentFileName(mirrorDir, ".SDF", ids[0])))
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	content, err := os.ReadFile(SegmentFileName(dir, ".SDF", ids[0]))
+	assert.Nil(t, err)
+	mirrored, err := os.ReadFile(SegmentFileName(mirrorDir, ".SDF", ids[0]))
+	assert.Nil(t, err)
+	assert.Equal(t, content, mirrored)
+}
+
+func TestWalSegmentFooterChecksum(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-checksum")
+	opts := Options{
+		DirPath:               dir,
+		DiskFileExtension:     ".SDF",
+		SegmentSize:           32 * KB,
+		SegmentFooterChecksum: true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	active := wal.ActiveSegmentID()
+	assert.True(t, active > 1)
+	assert.Nil(t, wal.VerifySegment(1))
+	// the active segment has no checksum until it is closed.
+	assert.ErrorIs(t, wal.VerifySegment(active), ErrNoSegmentChecksum)
+	assert.ErrorIs(t, wal.VerifySegment(active+1), ErrSegmentNotFound)
+	assert.Nil(t, wal.Close())
+
+	name := SegmentFileName(dir, ".SDF", 1)
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte("y"), segmentHeaderSize+chunkHeaderSize+10)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Nil(t, wal.VerifySegment(active))
+	assert.ErrorIs(t, wal.VerifySegment(1), ErrInvalidCRC)
+	// the checksum file is removed with its segment file.
+	assert.Nil(t, wal.TruncateHead(&ChunkPosition{SegmentId: 2}))
+	_, err = os.Stat(name + checksumFileExt)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWalSegmentFooterChecksumReopen(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-checksum-reopen")
+	opts := Options{
+		DirPath:               dir,
+		DiskFileExtension:     ".SDF",
+		SegmentSize:           64 * KB,
+		SegmentFooterChecksum: true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	for i := 0; i < 300; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte{byte(i)}, 1*KB))
+		assert.Nil(t, err)
+	}
+	ids := wal.SegmentIDs()
+	assert.True(t, len(ids) > 2)
+	assert.Nil(t, wal.Close())
+
+	// the checksum files are not taken for segment files.
+	_, ok := ParseSegmentID(filepath.Base(SegmentFileName(dir, ".SDF", 1))+checksumFileExt, ".SDF")
+	assert.False(t, ok)
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, wal.SegmentIDs())
+	reader := wal.NewReader()
+	count := 0
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(bytes.Repeat([]byte{byte(count)}, 1*KB), data))
+		count++
+	}
+	assert.Equal(t, 300, count)
+}
+
+func TestWalReaderNextRawChunk(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-raw-chunk")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	large := bytes.Repeat([]byte("x"), 2*defaultBlockSize+100)
+	_, err = wal.Write([]byte("small"))
+	assert.Nil(t, err)
+	largePos, err := wal.Write(large)
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte("last"))
+	assert.Nil(t, err)
+
+	reader := wal.NewReader()
+	defer reader.Close()
+	_, _, err = reader.Next()
+	assert.Nil(t, err)
+	// the chunks of the peeked record are returned.
+	_, _, err = reader.Peek()
+	assert.Nil(t, err)
+
+	var types []ChunkType
+	var payload []byte
+	for {
+		chunk, pos, err := reader.NextRawChunk()
+		assert.Nil(t, err)
+		if len(types) == 0 {
+			assert.Equal(t, largePos.BlockNumber, pos.BlockNumber)
+			assert.Equal(t, largePos.ChunkOffset, pos.ChunkOffset)
+		}
+		assert.Equal(t, uint32(chunkHeaderSize+len(chunk.Data)), pos.ChunkSize)
+		types = append(types, chunk.Type)
+		payload = append(payload, chunk.Data...)
+		if chunk.Type == ChunkTypeLast {
+			break
+		}
+	}
+	assert.Equal(t, []ChunkType{ChunkTypeFirst, ChunkTypeMiddle, ChunkTypeLast}, types)
+	assert.Equal(t, large, payload)
+
+	// Next continues at the record boundary.
+	data, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("last"), data)
+	_, _, err = reader.NextRawChunk()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalBlockSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-block-size")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		BlockSize:         4 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	large := bytes.Repeat([]byte("x"), 10*KB)
+	pos, err := wal.Write(large)
+	assert.Nil(t, err)
+	// the record is split into the chunks of 3 blocks.
+	assert.Equal(t, uint32(len(large)+3*chunkHeaderSize), pos.ChunkSize)
+	small, err := wal.Write([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), small.BlockNumber)
+	assert.Nil(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	data, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+	data, err = wal.Read(small)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), data)
+	assert.Nil(t, wal.Close())
+
+	// the segment files were written with another block size.
+	opts.BlockSize = 0
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, ErrBlockSizeMismatch)
+	opts.BlockSize = 3 * KB
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+	os.RemoveAll(dir)
+}
+
+func TestWalWriteBatch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-batch")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	batch1, batch2 := wal.NewWriteBatch(), wal.NewWriteBatch()
+	batch1.Append([]byte("batch1-1"))
+	batch2.Append([]byte("batch2-1"))
+	batch1.Append([]byte("batch1-2"))
+
+	positions, err := batch1.Commit()
+	assert.Nil(t, err)
+	assert.Len(t, positions, 2)
+	assert.Equal(t, 0, batch1.Len())
+	assert.Equal(t, 1, batch2.Len())
+	val, err := wal.Read(positions[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "batch1-2", string(val))
+
+	// a batch larger than a segment is kept for inspection.
+	batch2.Append(bytes.Repeat([]byte("x"), 32*KB))
+	_, err = batch2.Commit()
+	assert.Equal(t, ErrPendingSizeTooLarge, err)
+	assert.Equal(t, 2, batch2.Len())
+}
+
+func TestWalWriteBatchSync(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-batch-sync")
+	syncs := 0
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		DiskFlushSync:     true,
+		OnSyncLatency:     func(d time.Duration) { syncs++ },
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	batch := wal.NewWriteBatch()
+	batch.Append([]byte("hello"))
+	batch.Append([]byte("world"))
+	positions, err := batch.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(positions))
+	assert.Equal(t, 1, syncs)
+	assert.Equal(t, uint32(0), wal.bytesWrite)
+}
+
+func TestWalCloseWithFlush(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-close-flush")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	wal.PendingWrites([]byte("dropped"))
+	assert.Equal(t, ErrPendingWritesDropped, wal.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	wal.PendingWrites([]byte("flushed"))
+	assert.Nil(t, wal.CloseWithFlush())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	reader := wal.NewReader()
+	data, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("flushed"), data)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalSyncSegment(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-sync-segment")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	for i := 0; i < 4; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	assert.True(t, wal.ActiveSegmentID() > 1)
+	assert.Nil(t, wal.SyncSegment(1))
+	assert.Nil(t, wal.SyncSegment(wal.ActiveSegmentID()))
+	assert.ErrorIs(t, wal.SyncSegment(wal.ActiveSegmentID()+1), ErrSegmentNotFound)
+}
+
+func TestWalReaderSnapshot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-snapshot")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	_, err = wal.Write([]byte("before"))
+	assert.Nil(t, err)
+
+	reader := wal.NewReader()
+	defer reader.Close()
+	// the records written after the reader is created are not read by it.
+	_, err = wal.Write([]byte("after"))
+	assert.Nil(t, err)
+	data, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("before"), data)
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWalSegmentIDs(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-segment-ids")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	assert.Equal(t, []SegSerialID{1}, wal.SegmentIDs())
+	for i := 0; i < 7; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []SegSerialID{1, 2, 3}, wal.SegmentIDs())
+	assert.Nil(t, wal.TruncateHead(&ChunkPosition{SegmentId: 2}))
+	assert.Equal(t, []SegSerialID{2, 3}, wal.SegmentIDs())
+}
+
+func TestWalAllowBatchSpanSegments(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-batch-span")
+	opts := Options{
+		DirPath:                dir,
+		DiskFileExtension:      ".SDF",
+		SegmentSize:            32 * KB,
+		AllowBatchSpanSegments: true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	for i := 0; i < 10; i++ {
+		wal.PendingWrites(bytes.Repeat([]byte{byte(i)}, 10*KB))
+	}
+	positions, err := wal.WriteAll()
+	assert.Nil(t, err)
+	assert.Len(t, positions, 10)
+	assert.Equal(t, SegSerialID(4), wal.ActiveSegmentID())
+	for i, pos := range positions {
+		assert.Equal(t, SegSerialID(i/3+1), pos.SegmentId)
+		data, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), data)
+	}
+
+	// a record alone still must fit in a segment file.
+	wal.PendingWrites([]byte("small"))
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 32*KB))
+	_, err = wal.WriteAll()
+	assert.Equal(t, ErrDataSizeTooLarge, err)
+	assert.Equal(t, 0, wal.PendingCount())
+}
+
+func TestWalLatencyCallbacks(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-latency")
+	var syncs, rotations int
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		DiskFlushSync:     true,
+		OnSyncLatency:     func(d time.Duration) { syncs++ },
+		OnRotateLatency:   func(d time.Duration) { rotations++ },
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	for i := 0; i < 4; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	// a sync per write, and one before the rotation.
+	assert.Equal(t, 5, syncs)
+	assert.Equal(t, 1, rotations)
+	assert.Nil(t, wal.Sync())
+	assert.Equal(t, 6, syncs)
+}
+
+func TestWalNoSyncOnRotate(t *testing.T) {
+	for _, noSync := range []bool{false, true} {
+		dir, _ := os.MkdirTemp("", "test-no-sync-on-rotate")
+		syncs := 0
+		opts := Options{
+			DirPath:           dir,
+			DiskFileExtension: ".SDF",
+			SegmentSize:       32 * KB,
+			NoSyncOnRotate:    noSync,
+			OnSyncLatency:     func(d time.Duration) { syncs++ },
+		}
+		wal, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 4; i++ {
+			_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, SegSerialID(2), wal.ActiveSegmentID())
+		// the rotated segment file is synced by default.
+		if noSync {
+			assert.Equal(t, 0, syncs)
+		} else {
+			assert.Equal(t, 1, syncs)
+		}
+		CloseWal(wal)
+	}
+}
+
+// failingSyncFS opens the files whose Sync fails once fail is set.
+type failingSyncFS struct {
+	OSFS
+	fail atomic.Bool
+}
+
+type failingSyncFile struct {
+	File
+	fs *failingSyncFS
+}
+
+func (fs *failingSyncFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := fs.OSFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &failingSyncFile{File: fd, fs: fs}, nil
+}
+
+func (f *failingSyncFile) Sync() error {
+	if f.fs.fail.Load() {
+		return errors.New("sync failed")
+	}
+	return f.File.Sync()
+}
+
+func TestWalAsyncRotateSync(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-async-rotate-sync")
+	var syncs atomic.Int32
+	var evicted []SegSerialID
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		AsyncRotateSync:   true,
+		MaxSegments:       3,
+		OnSyncLatency:     func(d time.Duration) { syncs.Add(1) },
+		OnSegmentEvicted:  func(id SegSerialID) { evicted = append(evicted, id) },
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 20*KB))
+		assert.Nil(t, err)
+	}
+	// the evicted segment files are synced before they are deleted.
+	assert.Equal(t, []SegSerialID{1, 2, 3, 4, 5, 6, 7}, evicted)
+	assert.True(t, syncs.Load() >= 7)
+	assert.Nil(t, wal.DeleteSegment(8))
+	assert.Nil(t, wal.Close())
+	// every rotated segment file is synced once Close returns.
+	assert.Equal(t, int32(9), syncs.Load())
+
+	// a failed sync is returned by Close.
+	fs := &failingSyncFS{}
+	opts.DirPath, _ = os.MkdirTemp("", "test-async-rotate-sync")
+	opts.FS = fs
+	opts.MaxSegments = 0
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer os.RemoveAll(opts.DirPath)
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	fs.fail.Store(true)
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	_, err = wal.Write([]byte("world"))
+	assert.Nil(t, err)
+	err = wal.Close()
+	var segErr *SegmentError
+	assert.ErrorAs(t, err, &segErr)
+	assert.Equal(t, "sync", segErr.Op)
+	assert.Equal(t, SegSerialID(1), segErr.SegmentId)
+	os.RemoveAll(dir)
+}
+
+func TestWalSyncDirOnCreate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories can't be synced on windows")
+	}
+	dir, _ := os.MkdirTemp("", "test-sync-dir")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		SyncDirOnCreate:   true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	assert.Equal(t, SegSerialID(2), wal.ActiveSegmentID())
+	_, err = os.Stat(SegmentFileName(dir, ".SDF", 2))
+	assert.Nil(t, err)
+}
+
+func TestWalKeepLastN(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-keep-last-n")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	// 3 records per segment file, the active one has 1.
+	for i := 0; i < 10; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Nil(t, wal.KeepLastN(20))
+	assert.Equal(t, []SegSerialID{1, 2, 3, 4}, wal.SegmentIDs())
+	assert.Nil(t, wal.KeepLastN(5))
+	assert.Equal(t, []SegSerialID{2, 3, 4}, wal.SegmentIDs())
+	assert.Nil(t, wal.KeepLastN(1))
+	assert.Equal(t, []SegSerialID{4}, wal.SegmentIDs())
+	count, err := wal.RecordCount()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.NotNil(t, wal.KeepLastN(-1))
+}
+
+func TestWalLastWriteRotated(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-last-write-rotated")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	for i := 0; i < 4; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+		assert.Equal(t, i == 3, wal.LastWriteRotated())
+	}
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 10*KB))
+	_, err = wal.WriteAll()
+	assert.Nil(t, err)
+	assert.False(t, wal.LastWriteRotated())
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 10*KB))
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 10*KB))
+	_, err = wal.WriteAll()
+	assert.Nil(t, err)
+	assert.True(t, wal.LastWriteRotated())
+}
+
+func TestWalWriteToShardLastWriteRotated(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-to-shard-rotated")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		Shards:            2,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	for i := 0; i < 4; i++ {
+		_, err = wal.WriteToShard(1, bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+		assert.Equal(t, i == 3, wal.LastWriteRotated())
+	}
+	_, err = wal.WriteToShard(0, []byte("x"))
+	assert.Nil(t, err)
+	assert.False(t, wal.LastWriteRotated())
+}
+
+func TestWalWriteAllResult(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-write-all-result")
+	opts := Options{
+		DirPath:                dir,
+		DiskFileExtension:      ".SDF",
+		SegmentSize:            32 * KB,
+		AllowBatchSpanSegments: true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 10*KB))
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 10*KB))
+	result, err := wal.WriteAllResult()
+	assert.Nil(t, err)
+	assert.Len(t, result.Positions, 2)
+	assert.Equal(t, []SegSerialID{1}, result.SegmentIDs)
+	assert.False(t, result.Rotated)
+
+	wal.PendingWrites(bytes.Repeat([]byte("x"), 20*KB))
+	result, err = wal.WriteAllResult()
+	assert.Nil(t, err)
+	assert.Equal(t, []SegSerialID{2}, result.SegmentIDs)
+	assert.True(t, result.Rotated)
+
+	// a batch spanning segment files.
+	for i := 0; i < 4; i++ {
+		wal.PendingWrites(bytes.Repeat([]byte("x"), 10*KB))
+	}
+	result, err = wal.WriteAllResult()
+	assert.Nil(t, err)
+	assert.Len(t, result.Positions, 4)
+	assert.Equal(t, []SegSerialID{2, 3}, result.SegmentIDs)
+	assert.True(t, result.Rotated)
+
+	result, err = wal.WriteAllResult()
+	assert.Nil(t, err)
+	assert.Empty(t, result.Positions)
+	assert.False(t, result.Rotated)
+}
+
+func TestWalTruncatePartialTail(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-truncate-partial-tail")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var positions []*ChunkPosition
+	for i := 0; i < 5; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Close())
+
+	// a crash in the middle of the last record.
+	name := SegmentFileName(dir, ".SDF", 2)
+	stat, err := os.Stat(name)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(name, stat.Size()-100))
+	last := positions[4]
+	tail := stat.Size() - 100 - (int64(last.BlockNumber)*defaultBlockSize + last.ChunkOffset)
+
+	opts.TruncatePartialTail = true
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	assert.Equal(t, tail, wal.TruncatedTail())
+
+	reader := wal.NewReader()
+	count := 0
+	for {
+		_, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		count++
+	}
+	reader.Close()
+	assert.Equal(t, 4, count)
+	pos, err := wal.Write([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, last.ChunkOffset, pos.ChunkOffset)
+
+	// nothing left to truncate.
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), wal.TruncatedTail())
+}
+
+func TestWalNoSpace(t *testing.T) {
+	// a full disk is reported as ErrNoSpace.
+	err := segmentError("write", 1, &os.PathError{Op: "write", Path: "1.SDF", Err: syscall.ENOSPC})
+	assert.ErrorIs(t, err, ErrNoSpace)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+
+	if !diskSpaceSupported {
+		t.Skip("the free disk space can't be read on this platform")
+	}
+	dir, _ := os.MkdirTemp("", "test-no-space")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		MinFreeBytes:      math.MaxInt64,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	_, err = wal.Write([]byte("data"))
+	assert.ErrorIs(t, err, ErrNoSpace)
+	wal.PendingWrites([]byte("data"))
+	_, err = wal.WriteAll()
+	assert.ErrorIs(t, err, ErrNoSpace)
+	assert.True(t, wal.IsEmpty())
+}
+
+func TestWalReadAhead(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-read-ahead")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		BlockCacheEntries: 16,
+		ReadAhead:         4,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	reader := wal.NewReader()
+	defer reader.Close()
+	_, _, err = reader.Next()
+	assert.Nil(t, err)
+	// the blocks after the reader are prefetched, but not further than ReadAhead.
+	assert.Eventually(t, func() bool {
+		return wal.blockCache.Contains(uint64(1)<<32 | 3)
+	}, time.Second, time.Millisecond)
+	assert.False(t, wal.blockCache.Contains(uint64(1)<<32|4))
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("x"), 10*KB), data)
+	}
+}
+
+func TestWalValidate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-validate")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var positions []*ChunkPosition
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte("x"), 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	corrupted, err := wal.Validate()
+	assert.Nil(t, err)
+	assert.Empty(t, corrupted)
+	assert.Nil(t, wal.Close())
+
+	// corrupt a chunk of the block 0 and one of the block 2.
+	fd, err := os.OpenFile(SegmentFileName(dir, ".SDF", 1), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	for _, pos := range []*ChunkPosition{positions[1], positions[7]} {
+		_, err = fd.WriteAt([]byte("y"), int64(pos.BlockNumber)*defaultBlockSize+pos.ChunkOffset+chunkHeaderSize+1)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, fd.Close())
+
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+	corrupted, err = wal.Validate()
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+	assert.Len(t, corrupted, 2)
+	for i, pos := range []*ChunkPosition{positions[1], positions[7]} {
+		assert.Equal(t, pos.BlockNumber, corrupted[i].BlockNumber)
+		assert.Equal(t, pos.ChunkOffset, corrupted[i].ChunkOffset)
+	}
+}
+
+func TestWalPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the permissions are not supported on windows")
+	}
+	parent, _ := os.MkdirTemp("", "test-permissions")
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "wal")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		DirPerm:           0700,
+		FilePerm:          0600,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	stat, err := os.Stat(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+	stat, err = os.Stat(SegmentFileName(dir, ".SDF", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
+func TestWalFork(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-fork")
+	forkDir, _ := os.MkdirTemp("", "test-fork-copy")
+	defer os.RemoveAll(forkDir)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	var positions []*ChunkPosition
+	for i := 0; i < 5; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 10*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+
+	fork, err := wal.Fork(forkDir)
+	assert.Nil(t, err)
+	defer func() {
+		_ = fork.Close()
+	}()
+	for i, pos := range positions {
+		data, err := fork.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 10*KB), data)
+	}
+	// the writes to one don't show up in the other.
+	pos, err := wal.Write([]byte("origin"))
+	assert.Nil(t, err)
+	forkPos, err := fork.Write([]byte("forked"))
+	assert.Nil(t, err)
+	assert.Equal(t, pos, forkPos)
+	data, err := fork.Read(forkPos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("forked"), data)
+	data, err = wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("origin"), data)
+
+	// the directory of the fork must be empty.
+	_, err = wal.Fork(forkDir)
+	assert.ErrorIs(t, err, ErrDirLocked)
+}
+
+func TestWalReadInto(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-read-into")
+	cipher, err := NewAESGCMCipher(bytes.Repeat([]byte{1}, 32))
+	assert.Nil(t, err)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SEG",
+		SegmentSize:       32 * MB,
+		Compressor:        SnappyCompressor{},
+		Cipher:            cipher,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	small, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	large := bytes.Repeat([]byte("wal"), 20*KB)
+	largePos, err := wal.Write(large)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 16)
+	n, err := wal.ReadInto(small, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	// the buffer is too small, the size it needs is returned.
+	n, err = wal.ReadInto(largePos, buf)
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+	assert.Equal(t, len(large), n)
+	buf = make([]byte, n)
+	n, err = wal.ReadInto(largePos, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, large, buf[:n])
+}
+
+func TestWalReadWithMeta(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-read-with-meta")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SEG",
+		SegmentSize:       32 * MB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	start := time.Now()
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	data, meta, err := wal.ReadWithMeta(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	assert.WithinDuration(t, start, meta.CreatedAt, time.Minute)
+	assert.WithinDuration(t, start, meta.ModTime, time.Minute)
+
+	_, _, err = wal.ReadWithMeta(&ChunkPosition{SegmentId: 9})
+	assert.NotNil(t, err)
+
+	// the segment file created before Open is as old as its last modification.
+	assert.Nil(t, wal.Close())
+	old := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.Chtimes(SegmentFileName(dir, ".SEG", pos.SegmentId), old, old))
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	data, meta, err = wal.ReadWithMeta(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	assert.True(t, old.Equal(meta.CreatedAt))
+	assert.True(t, old.Equal(meta.ModTime))
+}
+
+func TestWalReaderAt(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-reader-at")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		StoreTimestamps:   true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { CloseWal(wal) }()
+
+	record := make([]byte, 100*KB)
+	for i := range record {
+		record[i] = byte(i % 251)
+	}
+	_, err = wal.Write([]byte("small"))
+	assert.Nil(t, err)
+	pos, err := wal.Write(record)
+	assert.Nil(t, err)
+
+	reader, size, err := wal.ReaderAt(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(record)), size)
+	data, err := io.ReadAll(io.NewSectionReader(reader, 0, size))
+	assert.Nil(t, err)
+	assert.Equal(t, record, data)
+	// a read across the blocks.
+	buf := make([]byte, 10*KB)
+	n, err := reader.ReadAt(buf, 30*KB)
+	assert.Nil(t, err)
+	assert.Equal(t, len(buf), n)
+	assert.Equal(t, record[30*KB:40*KB], buf)
+	n, err = reader.ReadAt(buf, size-KB)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, KB, n)
+	assert.Equal(t, record[len(record)-KB:], buf[:n])
+	n, err = reader.ReadAt(buf, -1)
+	assert.Equal(t, ErrNegativeOffset, err)
+	assert.Equal(t, 0, n)
+
+	// the compressed records can't be read in part.
+	assert.Nil(t, wal.Close())
+	opts.Compressor = SnappyCompressor{}
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	pos, err = wal.Write(record)
+	assert.Nil(t, err)
+	reader, _, err = wal.ReaderAt(pos)
+	assert.ErrorIs(t, err, ErrRecordNotSeekable)
+	assert.Nil(t, reader)
+	data, err = wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, record, data)
+}
+
+func TestWalOnWriteOnRead(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-on-write-on-read")
+	written := make(map[ChunkPosition]string)
+	read := make(map[ChunkPosition]string)
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * MB,
+		OnWrite: func(pos *ChunkPosition, data []byte) {
+			written[*pos] = string(data)
+		},
+		OnRead: func(pos *ChunkPosition, data []byte) {
+			read[*pos] = string(data)
+		},
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	pos1, err := wal.Write([]byte("first"))
+	assert.Nil(t, err)
+	wal.PendingWrites([]byte("second"))
+	wal.PendingWrites([]byte("third"))
+	positions, err := wal.WriteAll()
+	assert.Nil(t, err)
+	assert.Equal(t, map[ChunkPosition]string{
+		*pos1:         "first",
+		*positions[0]: "second",
+		*positions[1]: "third",
+	}, written)
+
+	_, err = wal.Read(pos1)
+	assert.Nil(t, err)
+	buf := make([]byte, 16)
+	_, err = wal.ReadInto(positions[1], buf)
+	assert.Nil(t, err)
+	// a failed read is not observed.
+	_, err = wal.ReadInto(positions[0], buf[:1])
+	assert.ErrorIs(t, err, io.ErrShortBuffer)
+	assert.Equal(t, map[ChunkPosition]string{
+		*pos1:         "first",
+		*positions[1]: "third",
+	}, read)
+}
+
+func TestWalNoActiveSegmentCache(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-no-active-cache")
+	opts := Options{
+		DirPath:              dir,
+		DiskFileExtension:    ".SEG",
+		SegmentSize:          32 * MB,
+		BlockCache:           10 * defaultBlockSize,
+		NoActiveSegmentCache: true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 3; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 20*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	// the active segment file bypasses the cache.
+	for i := 0; i < 2; i++ {
+		_, err = wal.Read(positions[0])
+		assert.Nil(t, err)
+	}
+	stats := wal.Stats()
+	assert.Equal(t, uint64(0), stats.CacheHits)
+	assert.Equal(t, uint64(0), stats.CacheMisses)
+
+	// it is cached once it is an older segment file.
+	assert.Nil(t, wal.OpenNewActiveSegment())
+	for i := 0; i < 2; i++ {
+		_, err = wal.Read(positions[0])
+		assert.Nil(t, err)
+	}
+	stats = wal.Stats()
+	assert.Equal(t, uint64(1), stats.CacheHits)
+	assert.Equal(t, uint64(1), stats.CacheMisses)
+}
+
+func TestWalFirstLastPosition(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-first-last")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.FirstPosition()
+	assert.Equal(t, ErrEmpty, err)
+	_, err = wal.LastPosition()
+	assert.Equal(t, ErrEmpty, err)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 5; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 12*KB))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	first, err := wal.FirstPosition()
+	assert.Nil(t, err)
+	assert.Equal(t, positions[0], first)
+	last, err := wal.LastPosition()
+	assert.Nil(t, err)
+	assert.Equal(t, positions[4], last)
+	assert.Nil(t, wal.Close())
+
+	// the last position is found again after reopening.
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+	last, err = wal.LastPosition()
+	assert.Nil(t, err)
+	assert.Equal(t, positions[4], last)
+}
+
+func TestWalDirectIO(t *testing.T) {
+	if !directIOSupported {
+		t.Skip("direct I/O is not supported on this platform")
+	}
+	dir, _ := os.MkdirTemp("", "test-direct-io")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       MB,
+		DirectIO:          true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+
+	var records [][]byte
+	var positions []*ChunkPosition
+	write := func(wal *WAL, size int) {
+		data := bytes.Repeat([]byte{byte(len(records))}, size)
+		pos, err := wal.Write(data)
+		assert.Nil(t, err)
+		records = append(records, data)
+		positions = append(positions, pos)
+	}
+	for _, size := range []int{10, 40 * KB, 5, 32*KB - 20, 100} {
+		write(wal, size)
+	}
+	stat, err := os.Stat(SegmentFileName(dir, ".SDF", 1))
+	assert.Nil(t, err)
+	assert.Zero(t, stat.Size()%defaultBlockSize)
+	assert.Nil(t, wal.Close())
+
+	// the zero padded tail is not part of the segment after reopening, with or without direct I/O.
+	for _, directIO := range []bool{false, true} {
+		opts.DirectIO = directIO
+		wal, err = Open(opts)
+		assert.Nil(t, err)
+		write(wal, 1000)
+		for i, pos := range positions {
+			val, err := wal.Read(pos)
+			assert.Nil(t, err)
+			assert.Equal(t, records[i], val)
+		}
+		reader := wal.NewReader()
+		for range records {
+			_, _, err := reader.Next()
+			assert.Nil(t, err)
+		}
+		_, _, err = reader.Next()
+		assert.Equal(t, io.EOF, err)
+		assert.Nil(t, wal.Close())
+	}
+	os.RemoveAll(dir)
+}
+
+func TestWalMMapReads(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-mmap-reads")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MMapReads:         true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 100; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1024))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.True(t, wal.ActiveSegmentID() > 1)
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1024), data)
+	}
+}
+
+func TestWalMMapReadsTruncateTail(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test-mmap-truncate")
+	opts := Options{
+		DirPath:           dir,
+		DiskFileExtension: ".SDF",
+		SegmentSize:       32 * KB,
+		MMapReads:         true,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer CloseWal(wal)
+
+	var positions []*ChunkPosition
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 1024))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.True(t, wal.ActiveSegmentID() > 1)
+
+	// the first segment file is mapped by the reader.
+	last := positions[20]
+	assert.Equal(t, SegSerialID(1), last.SegmentId)
+	reader, size, err := wal.ReaderAt(last)
+	assert.Nil(t, err)
+
+	assert.Nil(t, wal.TruncateTail(positions[10]))
+	assert.Nil(t, wal.OpenNewActiveSegment())
+
+	// the discarded record is past the end of the file, not of a stale mapping.
+	_, err = reader.ReadAt(make([]byte, size), 0)
+	assert.NotNil(t, err)
+	for i, pos := range positions[:10] {
+		data, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1024), data)
+	}
+}